@@ -0,0 +1,103 @@
+package tagstash_test
+
+import (
+	"testing"
+
+	"github.com/aryszka/tagstash"
+	"github.com/aryszka/tagstash/tagstashtest"
+)
+
+// the benchmarks use the mock storage, so that they measure tagstash, the cache and the ranking, and not the
+// database
+
+type benchValue struct {
+	value string
+	tags  []string
+}
+
+func benchValues(n, tagsPerValue, vocab int) []benchValue {
+	var v []benchValue
+	for _, e := range tagstashtest.Generate(n, tagsPerValue, vocab) {
+		if len(v) == 0 || v[len(v)-1].value != e.Value {
+			v = append(v, benchValue{value: e.Value})
+		}
+
+		last := &v[len(v)-1]
+		last.tags = append(last.tags, e.Tag)
+	}
+
+	return v
+}
+
+func benchStash(b *testing.B, v []benchValue) *tagstash.TagStash {
+	stash, err := tagstash.New(tagstash.Options{
+		Storage:      tagstash.NewMockStorage(),
+		CacheOptions: tagstash.CacheOptions{CacheSize: 1 << 26},
+	})
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, vi := range v {
+		if err := stash.Set(vi.value, vi.tags...); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return stash
+}
+
+func BenchmarkGet(b *testing.B) {
+	v := benchValues(1<<12, 5, 1<<10)
+	stash := benchStash(b, v)
+	defer stash.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stash.Get(v[i%len(v)].tags[:3]...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	v := benchValues(1<<12, 5, 1<<10)
+	stash := benchStash(b, v)
+	defer stash.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vi := v[i%len(v)]
+		if err := stash.Set(vi.value, vi.tags...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetAllWide(b *testing.B) {
+	v := benchValues(1<<12, 5, 1<<10)
+	stash := benchStash(b, v)
+	defer stash.Close()
+
+	var tags []string
+	seen := make(map[string]bool)
+	for _, vi := range v {
+		for _, t := range vi.tags {
+			if !seen[t] && len(tags) < 32 {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stash.GetAll(tags...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
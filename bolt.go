@@ -0,0 +1,427 @@
+package tagstash
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltTags   = []byte("tags")
+	boltValues = []byte("values")
+)
+
+var (
+	// ErrEmptyKey is returned by the bolt storage when storing an association with an empty tag or value,
+	// which bbolt cannot use as a key.
+	ErrEmptyKey = errors.New("empty tag or value")
+
+	// ErrDamagedStorageData is returned by the bolt storage when the reverse lookup of a value refers to a
+	// missing association.
+	ErrDamagedStorageData = errors.New("damaged storage data")
+)
+
+// boltStorage stores the associations in a bbolt file. The tags bucket holds a bucket for every tag, with the
+// associated values as keys and the tag index as value. The values bucket holds a bucket for every value,
+// with the associated tags as keys, for the reverse lookup.
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltStorage creates a storage backed by a single bbolt file, which doesn't require cgo or a database
+// server. The file is created if it doesn't exist. The returned storage implements TagLookup, ValueEntryLookup,
+// EntryStreamer, ValueDeleter, TagReplacer, TagPager, TagEnumerator, TagCounter and TagPrefixLookup. It
+// doesn't accept empty tags or values, and returns ErrEmptyKey when storing them.
+func NewBoltStorage(path string) (Storage, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltTags); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists(boltValues)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) Get(tags []string) ([]*Entry, error) {
+	var e []*Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tb := tx.Bucket(boltTags)
+		for _, tag := range tags {
+			b := tb.Bucket([]byte(tag))
+			if b == nil {
+				continue
+			}
+
+			if err := b.ForEach(func(value, index []byte) error {
+				tagIndex, err := strconv.Atoi(string(index))
+				if err != nil {
+					return err
+				}
+
+				e = append(e, &Entry{
+					Tag:      tag,
+					Value:    string(value),
+					TagIndex: tagIndex,
+				})
+
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return e, err
+}
+
+func (s *boltStorage) GetTags(value string) ([]string, error) {
+	var tags []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltValues).Bucket([]byte(value))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(tag, _ []byte) error {
+			tags = append(tags, string(tag))
+			return nil
+		})
+	})
+
+	return tags, err
+}
+
+// valueEntries returns the associations of a value, ordered by the tag index, and by the tag.
+func valueEntries(tx *bolt.Tx, value []byte) ([]*Entry, error) {
+	b := tx.Bucket(boltValues).Bucket(value)
+	if b == nil {
+		return nil, nil
+	}
+
+	var e []*Entry
+	tb := tx.Bucket(boltTags)
+	if err := b.ForEach(func(tag, _ []byte) error {
+		b := tb.Bucket(tag)
+		if b == nil {
+			return ErrDamagedStorageData
+		}
+
+		index := b.Get(value)
+		if index == nil {
+			return ErrDamagedStorageData
+		}
+
+		tagIndex, err := strconv.Atoi(string(index))
+		if err != nil {
+			return err
+		}
+
+		e = append(e, &Entry{
+			Tag:      string(tag),
+			Value:    string(value),
+			TagIndex: tagIndex,
+		})
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// the tags are iterated in byte order, which is kept for the same tag index
+	sort.SliceStable(e, func(i, j int) bool { return e[i].TagIndex < e[j].TagIndex })
+	return e, nil
+}
+
+func (s *boltStorage) GetValueEntries(value string) ([]*Entry, error) {
+	var e []*Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		e, err = valueEntries(tx, []byte(value))
+		return err
+	})
+
+	return e, err
+}
+
+func (s *boltStorage) StreamAll(f func(*Entry) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltValues).ForEach(func(value, _ []byte) error {
+			e, err := valueEntries(tx, value)
+			if err != nil {
+				return err
+			}
+
+			for _, ei := range e {
+				if err := f(ei); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
+
+func (s *boltStorage) ListTagsPage(cursor string, limit int) ([]string, error) {
+	var tags []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltTags).Cursor()
+		k, _ := c.Seek([]byte(cursor))
+		if k != nil && string(k) == cursor {
+			k, _ = c.Next()
+		}
+
+		for ; k != nil && len(tags) < limit; k, _ = c.Next() {
+			tags = append(tags, string(k))
+		}
+
+		return nil
+	})
+
+	return tags, err
+}
+
+func (s *boltStorage) ListTags() ([]string, error) {
+	var tags []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTags).ForEach(func(k, _ []byte) error {
+			tags = append(tags, string(k))
+			return nil
+		})
+	})
+
+	return tags, err
+}
+
+func (s *boltStorage) GetByTagPrefix(prefix string) ([]*Entry, error) {
+	var e []*Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tb := tx.Bucket(boltTags)
+		c := tb.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			tag := string(k)
+			if err := tb.Bucket(k).ForEach(func(value, index []byte) error {
+				tagIndex, err := strconv.Atoi(string(index))
+				if err != nil {
+					return err
+				}
+
+				e = append(e, &Entry{Tag: tag, Value: string(value), TagIndex: tagIndex})
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return e, err
+}
+
+func (s *boltStorage) CountTag(tag string) (int, error) {
+	var count int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTags).Bucket([]byte(tag))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, _ []byte) error {
+			count++
+			return nil
+		})
+	})
+
+	return count, err
+}
+
+func setEntry(tx *bolt.Tx, e *Entry) error {
+	if e.Tag == "" || e.Value == "" {
+		return ErrEmptyKey
+	}
+
+	tb, err := tx.Bucket(boltTags).CreateBucketIfNotExists([]byte(e.Tag))
+	if err != nil {
+		return err
+	}
+
+	if err := tb.Put([]byte(e.Value), []byte(strconv.Itoa(e.TagIndex))); err != nil {
+		return err
+	}
+
+	vb, err := tx.Bucket(boltValues).CreateBucketIfNotExists([]byte(e.Value))
+	if err != nil {
+		return err
+	}
+
+	return vb.Put([]byte(e.Tag), []byte{})
+}
+
+func (s *boltStorage) Set(e *Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return setEntry(tx, e) })
+}
+
+// removeValueTag drops the reverse lookup of an association, and the bucket of the value when it has no more
+// tags.
+func removeValueTag(tx *bolt.Tx, value, tag []byte) error {
+	vbs := tx.Bucket(boltValues)
+	vb := vbs.Bucket(value)
+	if vb == nil {
+		return nil
+	}
+
+	if err := vb.Delete(tag); err != nil {
+		return err
+	}
+
+	if k, _ := vb.Cursor().First(); k == nil {
+		return vbs.DeleteBucket(value)
+	}
+
+	return nil
+}
+
+func removeEntry(tx *bolt.Tx, e *Entry) error {
+	tbs := tx.Bucket(boltTags)
+	tb := tbs.Bucket([]byte(e.Tag))
+	if tb == nil {
+		return nil
+	}
+
+	if err := tb.Delete([]byte(e.Value)); err != nil {
+		return err
+	}
+
+	if k, _ := tb.Cursor().First(); k == nil {
+		if err := tbs.DeleteBucket([]byte(e.Tag)); err != nil {
+			return err
+		}
+	}
+
+	return removeValueTag(tx, []byte(e.Value), []byte(e.Tag))
+}
+
+func (s *boltStorage) Remove(e *Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return removeEntry(tx, e) })
+}
+
+func (s *boltStorage) WriteBatch(set, remove []*Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, e := range set {
+			if err := setEntry(tx, e); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range remove {
+			if err := removeEntry(tx, e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func deleteTag(tx *bolt.Tx, tag string) error {
+	tbs := tx.Bucket(boltTags)
+	tb := tbs.Bucket([]byte(tag))
+	if tb == nil {
+		return nil
+	}
+
+	var values [][]byte
+	if err := tb.ForEach(func(value, _ []byte) error {
+		values = append(values, append([]byte(nil), value...))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		if err := removeValueTag(tx, v, []byte(tag)); err != nil {
+			return err
+		}
+	}
+
+	return tbs.DeleteBucket([]byte(tag))
+}
+
+func (s *boltStorage) Delete(tag string) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return deleteTag(tx, tag) })
+}
+
+func (s *boltStorage) ReplaceTag(tag string, e []*Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteTag(tx, tag); err != nil {
+			return err
+		}
+
+		for _, ei := range e {
+			if err := setEntry(tx, ei); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *boltStorage) DeleteValues(values []string) ([]string, int, error) {
+	var (
+		tags []string
+		n    int
+		seen = make(map[string]bool)
+	)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, v := range values {
+			e, err := valueEntries(tx, []byte(v))
+			if err != nil {
+				return err
+			}
+
+			for _, ei := range e {
+				if err := removeEntry(tx, ei); err != nil {
+					return err
+				}
+
+				if !seen[ei.Tag] {
+					seen[ei.Tag] = true
+					tags = append(tags, ei.Tag)
+				}
+			}
+
+			n += len(e)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return tags, n, nil
+}
+
+func (s *boltStorage) Close() {
+	s.db.Close()
+}
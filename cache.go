@@ -1,10 +1,13 @@
 package tagstash
 
 import (
+	"compress/gzip"
 	"errors"
 	"io"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aryszka/forget"
@@ -14,8 +17,30 @@ import (
 const forEver = time.Duration((^uint64(0)) >> 1)
 
 type cache struct {
-	forget *forget.Cache
-	mx     *sync.Mutex
+
+	// updated atomically, because the reads hold only the read lock. Kept first, for the 64-bit alignment
+	// on 32-bit platforms.
+	hits, misses, written, failures int64
+
+	forget        *forget.Cache
+	mx            *sync.RWMutex
+	overflow      CacheOverflow
+	maxTagEntries int
+	evict         bool
+	compress      bool
+	now           func() time.Time
+
+	// tags that overflowed with SkipOnOverflow, or have more than maxTagEntries associations, and are
+	// served only from the storage
+	skipped map[string]bool
+
+	// tags written to the cache, and the expiration of the tags loaded from a snapshot
+	tags    map[string]bool
+	expires map[string]time.Time
+
+	snapshotPath string
+	snapshotTTL  time.Duration
+	quit, done   chan struct{}
 }
 
 var (
@@ -36,37 +61,109 @@ func newCache(o CacheOptions) *cache {
 			CacheSize: o.CacheSize,
 			ChunkSize: o.ExpectedItemSize,
 		}),
-		mx: &sync.Mutex{},
+		mx:            &sync.RWMutex{},
+		overflow:      o.Overflow,
+		maxTagEntries: o.MaxTagEntries,
+		evict:         o.EvictOnCorruption,
+		compress:      o.CompressEntries,
+		now:           time.Now,
+		skipped:       make(map[string]bool),
+		tags:          make(map[string]bool),
+		expires:       make(map[string]time.Time),
+		snapshotPath:  o.SnapshotPath,
+		snapshotTTL:   o.SnapshotTTL,
 	}
 }
 
-func readAll(r io.Reader, tag string) ([]*Entry, error) {
-	var entries []*Entry
+// encodeIndex formats the tag index of an entry, followed by its expiration, if set, and by its weight, if set.
+// Without an expiration, the weight follows an empty field.
+func encodeIndex(e *Entry) string {
+	var expires string
+	if !e.Expires.IsZero() {
+		expires = strconv.FormatInt(e.Expires.UnixNano(), 10)
+	}
+
+	switch {
+	case e.Weight != 0:
+		return strconv.Itoa(e.TagIndex) + " " + expires + " " + strconv.FormatFloat(e.Weight, 'g', -1, 64)
+	case expires != "":
+		return strconv.Itoa(e.TagIndex) + " " + expires
+	default:
+		return strconv.Itoa(e.TagIndex)
+	}
+}
+
+func decodeIndex(v string, e *Entry) error {
+	index, expires, weight := v, "", ""
+	if i := strings.IndexByte(v, ' '); i >= 0 {
+		index, expires = v[:i], v[i+1:]
+	}
+
+	if i := strings.IndexByte(expires, ' '); i >= 0 {
+		expires, weight = expires[:i], expires[i+1:]
+	}
+
+	var err error
+	if e.TagIndex, err = strconv.Atoi(index); err != nil {
+		return err
+	}
+
+	if expires != "" {
+		ns, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		e.Expires = time.Unix(0, ns)
+	}
+
+	if weight != "" {
+		if e.Weight, err = strconv.ParseFloat(weight, 64); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func expired(e *Entry, now time.Time) bool {
+	return !e.Expires.IsZero() && !e.Expires.After(now)
+}
+
+// readEach calls f for the cached associations of a tag, skipping the expired ones. The current time is read
+// only for the associations that have an expiration.
+func readEach(r io.Reader, tag string, now func() time.Time, f func(*Entry)) error {
 	kvr := keyval.NewEntryReader(r)
 	for {
 		e, err := kvr.ReadEntry()
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 
-			return nil, err
+			return err
 		}
 
-		tagIndex, err := strconv.Atoi(e.Val)
-		if err != nil {
-			return nil, err
+		ei := &Entry{Tag: tag}
+		if err := decodeIndex(e.Val, ei); err != nil {
+			return err
 		}
 
 		if len(e.Key) != 1 {
-			return nil, ErrDamagedCacheData
+			return ErrDamagedCacheData
 		}
 
-		entries = append(entries, &Entry{
-			Value:    e.Key[0],
-			Tag:      tag,
-			TagIndex: tagIndex,
-		})
+		ei.Value = e.Key[0]
+		if ei.Expires.IsZero() || ei.Expires.After(now()) {
+			f(ei)
+		}
+	}
+}
+
+func readAll(r io.Reader, tag string, now func() time.Time) ([]*Entry, error) {
+	var entries []*Entry
+	if err := readEach(r, tag, now, func(e *Entry) { entries = append(entries, e) }); err != nil {
+		return nil, err
 	}
 
 	return entries, nil
@@ -77,7 +174,7 @@ func writeAll(w io.Writer, e []*Entry) error {
 	for _, ei := range e {
 		err := kvw.WriteEntry(&keyval.Entry{
 			Key: []string{ei.Value},
-			Val: strconv.Itoa(ei.TagIndex),
+			Val: encodeIndex(ei),
 		})
 
 		if err != nil {
@@ -88,47 +185,161 @@ func writeAll(w io.Writer, e []*Entry) error {
 	return nil
 }
 
+// decode returns the reader of the serialized associations of a tag, decompressing them when CompressEntries
+// is set.
+func (c *cache) decode(r io.Reader) (io.Reader, error) {
+	if !c.compress {
+		return r, nil
+	}
+
+	return gzip.NewReader(r)
+}
+
+// encode writes the serialized associations of a tag, compressed when CompressEntries is set.
+func (c *cache) encode(w io.Writer, e []*Entry) error {
+	if !c.compress {
+		return writeAll(w, e)
+	}
+
+	gw, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+
+	if err := writeAll(gw, e); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// readTag calls f for the cached associations of a tag, skipping the expired ones.
+func (c *cache) readTag(r io.Reader, tag string, f func(*Entry)) error {
+	d, err := c.decode(r)
+	if err != nil {
+		return err
+	}
+
+	return readEach(d, tag, c.now, f)
+}
+
+// withTagEntries updates the cached associations of a tag. Only the tags are updated whose complete list of
+// associations was written with setTag, or loaded from a snapshot. Starting a new list with a single
+// association would make the queries trust an incomplete list, so a tag that is not cached is left to be read
+// from the storage on the next query.
 func (c *cache) withTagEntries(tag string, op func([]*Entry) []*Entry) error {
 	c.mx.Lock()
 	defer c.mx.Unlock()
 
+	if c.skipped[tag] {
+		return nil
+	}
+
+	r, ok := c.forget.Get(tag)
+	if !ok {
+		return nil
+	}
+
+	defer r.Close()
+
 	var entries []*Entry
-	if r, ok := c.forget.Get(tag); ok {
-		defer r.Close()
+	err := c.readTag(r, tag, func(e *Entry) { entries = append(entries, e) })
+	if err != nil && c.evict {
+		// the tag is read again from the storage on the next query
+		c.drop(tag)
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-		var err error
-		entries, err = readAll(r, tag)
-		if err != nil {
-			return err
-		}
+	return c.write(tag, op(entries))
+}
+
+func (c *cache) write(tag string, entries []*Entry) error {
+	if c.skipped[tag] {
+		return nil
+	}
+
+	if c.maxTagEntries > 0 && len(entries) > c.maxTagEntries {
+		c.skip(tag)
+		return nil
 	}
 
-	entries = op(entries)
+	// tags loaded from a snapshot keep their expiration when they are updated
+	ttl := forEver
+	if e, ok := c.expires[tag]; ok {
+		ttl = e.Sub(c.now())
+		if ttl <= 0 {
+			c.drop(tag)
+			return nil
+		}
+	}
 
-	w, ok := c.forget.Set(tag, forEver)
+	w, ok := c.forget.Set(tag, ttl)
 	if !ok {
-		return ErrFailedToCacheEntry
+		atomic.AddInt64(&c.failures, 1)
+		return c.overflowed(tag, ErrFailedToCacheEntry)
+	}
+
+	err := c.encode(w, entries)
+	w.Close()
+	if err != nil {
+		atomic.AddInt64(&c.failures, 1)
+		return c.overflowed(tag, err)
 	}
 
-	defer w.Close()
-	return writeAll(w, entries)
+	atomic.AddInt64(&c.written, int64(len(entries)))
+	c.tags[tag] = true
+	return nil
 }
 
-func (c *cache) Get(tags []string) ([]*Entry, error) {
-	var entries []*Entry
+func (c *cache) drop(tag string) {
+	delete(c.tags, tag)
+	delete(c.expires, tag)
+	c.forget.Delete(tag)
+}
+
+func (c *cache) overflowed(tag string, err error) error {
+	if c.overflow != SkipOnOverflow {
+		return err
+	}
+
+	c.skip(tag)
+	return nil
+}
+
+func (c *cache) skip(tag string) {
+	c.skipped[tag] = true
+	c.drop(tag)
+}
+
+// each calls f for every cached association of the provided tags, as they are decoded.
+func (c *cache) each(tags []string, f func(*Entry)) error {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
 	for _, t := range tags {
 		r, ok := c.forget.Get(t)
 		if !ok {
+			atomic.AddInt64(&c.misses, 1)
 			continue
 		}
 
-		defer r.Close()
-		tagEntries, err := readAll(r, t)
+		atomic.AddInt64(&c.hits, 1)
+		err := c.readTag(r, t, f)
+		r.Close()
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-		entries = append(entries, tagEntries...)
+	return nil
+}
+
+func (c *cache) Get(tags []string) ([]*Entry, error) {
+	var entries []*Entry
+	if err := c.each(tags, func(e *Entry) { entries = append(entries, e) }); err != nil {
+		return nil, err
 	}
 
 	return entries, nil
@@ -140,6 +351,8 @@ func (c *cache) Set(e *Entry) error {
 		for _, ei := range entries {
 			if ei.Value == e.Value {
 				ei.TagIndex = e.TagIndex
+				ei.Expires = e.Expires
+				ei.Weight = e.Weight
 				exists = true
 				break
 			}
@@ -153,6 +366,40 @@ func (c *cache) Set(e *Entry) error {
 	})
 }
 
+// setEntries updates multiple associations of a tag, the same way as Set(), with a single update of the
+// cached list.
+func (c *cache) setEntries(tag string, e []*Entry) error {
+	return c.withTagEntries(tag, func(entries []*Entry) []*Entry {
+		byValue := make(map[string]*Entry)
+		for _, ei := range entries {
+			byValue[ei.Value] = ei
+		}
+
+		for _, ei := range e {
+			if current, ok := byValue[ei.Value]; ok {
+				current.TagIndex = ei.TagIndex
+				current.Expires = ei.Expires
+				current.Weight = ei.Weight
+				continue
+			}
+
+			entries = append(entries, ei)
+			byValue[ei.Value] = ei
+		}
+
+		return entries
+	})
+}
+
+// setTag replaces all the cached associations of a tag with a single write. The entries are expected to be
+// read from the storage, therefore the expiration of a tag loaded from a snapshot is cleared.
+func (c *cache) setTag(tag string, entries []*Entry) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	delete(c.expires, tag)
+	return c.write(tag, entries)
+}
+
 func (c *cache) Remove(e *Entry) error {
 	return c.withTagEntries(e.Tag, func(entries []*Entry) []*Entry {
 		for i, ei := range entries {
@@ -167,11 +414,51 @@ func (c *cache) Remove(e *Entry) error {
 	})
 }
 
+func (c *cache) invalidate(tag string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.drop(tag)
+}
+
 func (c *cache) Delete(tag string) error {
-	c.forget.Delete(tag)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	delete(c.skipped, tag)
+	c.drop(tag)
 	return nil
 }
 
+func (c *cache) CachedTags() []string {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+func (c *cache) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:           atomic.LoadInt64(&c.hits),
+		Misses:         atomic.LoadInt64(&c.misses),
+		EntriesWritten: atomic.LoadInt64(&c.written),
+		WriteFailures:  atomic.LoadInt64(&c.failures),
+	}
+}
+
 func (c *cache) Close() {
+	if c.quit != nil {
+		close(c.quit)
+		<-c.done
+	}
+
+	if c.snapshotPath != "" {
+		c.saveSnapshot()
+	}
+
 	c.forget.Close()
 }
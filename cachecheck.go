@@ -0,0 +1,72 @@
+package tagstash
+
+// the tag used to verify a custom cache. It is deleted from the cache after the verification.
+const cacheCheckTag = "tagstash:cache-check"
+
+// noCache replaces a custom cache that failed the verification. It doesn't hold any associations.
+type noCache struct{}
+
+func (noCache) Get([]string) ([]*Entry, error) { return nil, nil }
+func (noCache) Set(*Entry) error               { return nil }
+func (noCache) Remove(*Entry) error            { return nil }
+func (noCache) Delete(string) error            { return nil }
+func (noCache) Close()                         {}
+
+// cacheHolds tells whether the cache returns either no associations of the check tag, or exactly the
+// expected ones.
+func cacheHolds(c Cache, expect map[string]int) bool {
+	e, err := c.Get([]string{cacheCheckTag})
+	if err != nil {
+		return false
+	}
+
+	if len(e) == 0 {
+		return true
+	}
+
+	if len(e) != len(expect) {
+		return false
+	}
+
+	for _, ei := range e {
+		if index, ok := expect[ei.Value]; !ok || ei.Tag != cacheCheckTag || ei.TagIndex != index {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkCache verifies that a custom cache satisfies the cache contract, by writing, updating, removing and
+// deleting the associations of a reserved tag.
+func checkCache(c Cache) bool {
+	defer c.Delete(cacheCheckTag)
+
+	for _, e := range []*Entry{
+		{Value: "foo", Tag: cacheCheckTag, TagIndex: 0},
+		{Value: "bar", Tag: cacheCheckTag, TagIndex: 1},
+		{Value: "foo", Tag: cacheCheckTag, TagIndex: 2},
+	} {
+		if err := c.Set(e); err != nil {
+			return false
+		}
+	}
+
+	if !cacheHolds(c, map[string]int{"foo": 2, "bar": 1}) {
+		return false
+	}
+
+	if err := c.Remove(&Entry{Value: "bar", Tag: cacheCheckTag}); err != nil {
+		return false
+	}
+
+	if !cacheHolds(c, map[string]int{"foo": 2}) {
+		return false
+	}
+
+	if err := c.Delete(cacheCheckTag); err != nil {
+		return false
+	}
+
+	return cacheHolds(c, nil)
+}
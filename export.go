@@ -0,0 +1,73 @@
+package tagstash
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/aryszka/keyval"
+)
+
+// Export writes all the stored associations to w, in the same keyval format as the cache snapshots, with the
+// tag and the value as the key, and the tag index, the expiration and the weight, when set, as the value. The
+// associations are written as they are read from the storage, ordered by the value, then by the tag index,
+// without collecting them in memory. It returns ErrNotSupported if the storage implementation doesn't support
+// iterating over all the associations.
+func (t *TagStash) Export(w io.Writer) error {
+	kvw := keyval.NewEntryWriter(w)
+	return t.StreamAll(func(e *Entry) error {
+		return kvw.WriteEntry(&keyval.Entry{
+			Key: []string{e.Tag, e.Value},
+			Val: encodeIndex(e),
+		})
+	})
+}
+
+// Import stores the associations read from r, in the format written by Export(), keeping their tag index,
+// expiration and weight. The existing associations of the same value and tag are overwritten. The whole input
+// is read and checked before writing, and the storage applies all the associations in a single transaction,
+// so that on a malformed record, or on a failure, none of them is stored. A malformed record is reported with
+// ErrInvalidImport, together with its 1-based position. The cache is updated the same way as by SetBatch(). It
+// returns ErrNotSupported if the storage implementation doesn't support writing in batches.
+func (t *TagStash) Import(r io.Reader) error {
+	bw, ok := t.storage.(BatchWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	var (
+		set    []*Entry
+		values []string
+		seen   = make(map[string]bool)
+	)
+
+	kvr := keyval.NewEntryReader(r)
+	for n := 1; ; n++ {
+		kv, err := kvr.ReadEntry()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%w: record %d: %v", ErrInvalidImport, n, err)
+		}
+
+		if len(kv.Key) != 2 {
+			return fmt.Errorf("%w: record %d: expected a tag and a value", ErrInvalidImport, n)
+		}
+
+		e := &Entry{Tag: t.normalizeTag(kv.Key[0]), Value: kv.Key[1]}
+		if err := decodeIndex(kv.Val, e); err != nil {
+			return fmt.Errorf("%w: record %d: %v", ErrInvalidImport, n, err)
+		}
+
+		if err := t.checkLength(e.Value, []string{e.Tag}); err != nil {
+			return fmt.Errorf("%w: record %d: %v", ErrInvalidImport, n, err)
+		}
+
+		set = append(set, e)
+		if !seen[e.Value] {
+			seen[e.Value] = true
+			values = append(values, e.Value)
+		}
+	}
+
+	return t.writeBatch(bw, "import", set, values)
+}
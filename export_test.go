@@ -0,0 +1,29 @@
+package tagstash
+
+import "os"
+
+func NewTestStorage() Storage {
+	s, err := newStorage(newTestStorageOptions(), realClock{})
+	if err != nil {
+		panic(err)
+	}
+
+	return s
+}
+
+func NewTestBoltStorage() Storage {
+	if err := os.RemoveAll(testBoltSource); err != nil {
+		panic(err)
+	}
+
+	s, err := NewBoltStorage(testBoltSource)
+	if err != nil {
+		panic(err)
+	}
+
+	return s
+}
+
+func NewMockStorage() Storage {
+	return &mockStorageLookup{&mockStorage{}}
+}
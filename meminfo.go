@@ -0,0 +1,64 @@
+package tagstash
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const meminfoPath = "/proc/meminfo"
+
+// parseMemTotal returns the total memory, in bytes, from the content of /proc/meminfo.
+func parseMemTotal(r io.Reader) (int, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, err
+		}
+
+		return kb << 10, nil
+	}
+
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, ErrNotSupported
+}
+
+// systemMemory returns the total memory of the system, in bytes. It returns ErrNotSupported on the systems
+// without /proc/meminfo.
+func systemMemory() (int, error) {
+	f, err := os.Open(meminfoPath)
+	if os.IsNotExist(err) {
+		return 0, ErrNotSupported
+	} else if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+	return parseMemTotal(f)
+}
+
+// cacheSizeFromRatio returns the cache size as the ratio of the system memory. Ratios above 1 are treated as
+// 1.
+func cacheSizeFromRatio(ratio float64, memory func() (int, error)) (int, error) {
+	if ratio > 1 {
+		ratio = 1
+	}
+
+	m, err := memory()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(float64(m) * ratio), nil
+}
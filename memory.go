@@ -0,0 +1,164 @@
+package tagstash
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryStorage keeps the associations in maps, indexed both by the tags and by the values, for the reverse
+// lookup. The maps hold the tag index of the associations.
+type memoryStorage struct {
+	mx     sync.RWMutex
+	tags   map[string]map[string]int
+	values map[string]map[string]int
+}
+
+// NewMemoryStorage creates a storage that keeps the associations in memory, without cgo, a file or a database
+// server, e.g. for tests or small embedded uses. The associations are lost when the process exits. It is safe
+// for concurrent use. The returned storage implements TagLookup, ValueEntryLookup, BatchWriter, TagEnumerator
+// and TagCounter.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		tags:   make(map[string]map[string]int),
+		values: make(map[string]map[string]int),
+	}
+}
+
+func (s *memoryStorage) Get(tags []string) ([]*Entry, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var e []*Entry
+	for _, tag := range tags {
+		values := make([]string, 0, len(s.tags[tag]))
+		for v := range s.tags[tag] {
+			values = append(values, v)
+		}
+
+		sort.Strings(values)
+		for _, v := range values {
+			e = append(e, &Entry{Value: v, Tag: tag, TagIndex: s.tags[tag][v]})
+		}
+	}
+
+	return e, nil
+}
+
+func (s *memoryStorage) GetTags(value string) ([]string, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	tags := make([]string, 0, len(s.values[value]))
+	for tag := range s.values[value] {
+		tags = append(tags, tag)
+	}
+
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (s *memoryStorage) GetValueEntries(value string) ([]*Entry, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var e []*Entry
+	for tag, index := range s.values[value] {
+		e = append(e, &Entry{Value: value, Tag: tag, TagIndex: index})
+	}
+
+	sort.Slice(e, func(i, j int) bool {
+		if e[i].TagIndex == e[j].TagIndex {
+			return e[i].Tag < e[j].Tag
+		}
+
+		return e[i].TagIndex < e[j].TagIndex
+	})
+
+	return e, nil
+}
+
+func (s *memoryStorage) ListTags() ([]string, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	tags := make([]string, 0, len(s.tags))
+	for tag := range s.tags {
+		tags = append(tags, tag)
+	}
+
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (s *memoryStorage) CountTag(tag string) (int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return len(s.tags[tag]), nil
+}
+
+func (s *memoryStorage) set(e *Entry) {
+	if s.tags[e.Tag] == nil {
+		s.tags[e.Tag] = make(map[string]int)
+	}
+
+	if s.values[e.Value] == nil {
+		s.values[e.Value] = make(map[string]int)
+	}
+
+	s.tags[e.Tag][e.Value] = e.TagIndex
+	s.values[e.Value][e.Tag] = e.TagIndex
+}
+
+func (s *memoryStorage) remove(e *Entry) {
+	delete(s.tags[e.Tag], e.Value)
+	if len(s.tags[e.Tag]) == 0 {
+		delete(s.tags, e.Tag)
+	}
+
+	delete(s.values[e.Value], e.Tag)
+	if len(s.values[e.Value]) == 0 {
+		delete(s.values, e.Value)
+	}
+}
+
+func (s *memoryStorage) Set(e *Entry) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.set(e)
+	return nil
+}
+
+func (s *memoryStorage) Remove(e *Entry) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.remove(e)
+	return nil
+}
+
+func (s *memoryStorage) Delete(tag string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for v := range s.tags[tag] {
+		s.remove(&Entry{Value: v, Tag: tag})
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) WriteBatch(set, remove []*Entry) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for _, e := range set {
+		s.set(e)
+	}
+
+	for _, e := range remove {
+		s.remove(e)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) Close() {}
@@ -1,10 +1,18 @@
 package tagstash
 
-import "errors"
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
 type mockStorage struct {
 	entries                 []*Entry
 	failNext, failNextWrite bool
+	now                     func() time.Time
+	scores                  map[string]int
 }
 
 type mockStorageLookup struct {
@@ -35,13 +43,26 @@ func (s *mockStorage) failWrite() error {
 	return nil
 }
 
+func (s *mockStorage) currentTime() time.Time {
+	if s.now == nil {
+		return time.Now()
+	}
+
+	return s.now()
+}
+
 func (s *mockStorage) Get(tags []string) ([]*Entry, error) {
 	if err := s.fail(); err != nil {
 		return nil, err
 	}
 
+	now := s.currentTime()
 	var entries []*Entry
 	for _, e := range s.entries {
+		if expired(e, now) {
+			continue
+		}
+
 		for _, t := range tags {
 			if t == e.Tag {
 				entries = append(entries, e)
@@ -52,21 +73,145 @@ func (s *mockStorage) Get(tags []string) ([]*Entry, error) {
 	return entries, nil
 }
 
+func (s *mockStorage) GetMaxIndex(tags []string, maxIndex map[string]int) ([]*Entry, error) {
+	entries, err := s.Get(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	var limited []*Entry
+	for _, e := range entries {
+		if withinMaxIndex(e, maxIndex) {
+			limited = append(limited, e)
+		}
+	}
+
+	return limited, nil
+}
+
 func (s *mockStorageLookup) GetTags(value string) ([]string, error) {
 	if err := s.fail(); err != nil {
 		return nil, err
 	}
 
+	now := s.currentTime()
+	var tags []string
+	for _, e := range s.entries {
+		if e.Value == value && !expired(e, now) {
+			tags = append(tags, e.Tag)
+		}
+	}
+
+	return tags, nil
+}
+
+func (s *mockStorageLookup) ListTags() ([]string, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+
 	var tags []string
+	seen := make(map[string]bool)
 	for _, e := range s.entries {
-		if e.Value == value {
+		if !seen[e.Tag] {
+			seen[e.Tag] = true
 			tags = append(tags, e.Tag)
 		}
 	}
 
+	sort.Strings(tags)
 	return tags, nil
 }
 
+func (s *mockStorageLookup) GetByTagPrefix(prefix string) ([]*Entry, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+
+	now := s.currentTime()
+	var e []*Entry
+	for _, ei := range s.entries {
+		if strings.HasPrefix(ei.Tag, prefix) && !expired(ei, now) {
+			e = append(e, &Entry{Value: ei.Value, Tag: ei.Tag, TagIndex: ei.TagIndex, Expires: ei.Expires})
+		}
+	}
+
+	return e, nil
+}
+
+func (s *mockStorageLookup) CountTag(tag string) (int, error) {
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+
+	now := s.currentTime()
+	var count int
+	for _, e := range s.entries {
+		if e.Tag == tag && !expired(e, now) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *mockStorageLookup) GetValueEntries(value string) ([]*Entry, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+
+	now := s.currentTime()
+	var e []*Entry
+	for _, ei := range s.entries {
+		if ei.Value == value && !expired(ei, now) {
+			e = append(e, ei)
+		}
+	}
+
+	sort.Slice(e, func(i, j int) bool {
+		if e[i].TagIndex == e[j].TagIndex {
+			return e[i].Tag < e[j].Tag
+		}
+
+		return e[i].TagIndex < e[j].TagIndex
+	})
+
+	return e, nil
+}
+
+func (s *mockStorageLookup) StreamAll(f func(*Entry) error) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+
+	now := s.currentTime()
+	var e []*Entry
+	for _, ei := range s.entries {
+		if !expired(ei, now) {
+			e = append(e, ei)
+		}
+	}
+
+	sort.Slice(e, func(i, j int) bool {
+		switch {
+		case e[i].Value != e[j].Value:
+			return e[i].Value < e[j].Value
+		case e[i].TagIndex != e[j].TagIndex:
+			return e[i].TagIndex < e[j].TagIndex
+		default:
+			return e[i].Tag < e[j].Tag
+		}
+	})
+
+	for _, ei := range e {
+		if err := f(ei); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (s *mockStorage) Set(e *Entry) error {
 	if err := s.failWrite(); err != nil {
 		return err
@@ -75,6 +220,8 @@ func (s *mockStorage) Set(e *Entry) error {
 	for _, ei := range s.entries {
 		if ei.Tag == e.Tag && ei.Value == e.Value {
 			ei.TagIndex = e.TagIndex
+			ei.Expires = e.Expires
+			ei.Weight = e.Weight
 			return nil
 		}
 	}
@@ -115,4 +262,156 @@ func (s *mockStorage) Delete(tag string) error {
 	return nil
 }
 
+func (s *mockStorage) WriteBatch(set, remove []*Entry) error {
+	if err := s.failWrite(); err != nil {
+		return err
+	}
+
+	for _, e := range set {
+		s.Set(e)
+	}
+
+	for _, e := range remove {
+		s.Remove(e)
+	}
+
+	return nil
+}
+
+func (s *mockStorage) StoresWeight() {}
+
+func (s *mockStorage) DeleteExpired(t time.Time) ([]string, int, error) {
+	if err := s.failWrite(); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		tags []string
+		next = make([]*Entry, 0, len(s.entries))
+	)
+
+	for _, e := range s.entries {
+		if expired(e, t) {
+			tags = append(tags, e.Tag)
+			continue
+		}
+
+		next = append(next, e)
+	}
+
+	n := len(s.entries) - len(next)
+	s.entries = next
+	return tags, n, nil
+}
+
+func (s *mockStorage) DeleteValues(values []string) ([]string, int, error) {
+	if err := s.failWrite(); err != nil {
+		return nil, 0, err
+	}
+
+	drop := make(map[string]bool)
+	for _, v := range values {
+		drop[v] = true
+	}
+
+	var (
+		tags []string
+		seen = make(map[string]bool)
+		next = make([]*Entry, 0, len(s.entries))
+	)
+
+	for _, e := range s.entries {
+		if drop[e.Value] {
+			if !seen[e.Tag] {
+				seen[e.Tag] = true
+				tags = append(tags, e.Tag)
+			}
+
+			continue
+		}
+
+		next = append(next, e)
+	}
+
+	n := len(s.entries) - len(next)
+	s.entries = next
+	return tags, n, nil
+}
+
+func (s *mockStorage) ReplaceTag(tag string, e []*Entry) error {
+	if err := s.failWrite(); err != nil {
+		return err
+	}
+
+	next := make([]*Entry, 0, len(s.entries)+len(e))
+	for _, ei := range s.entries {
+		if ei.Tag != tag {
+			next = append(next, ei)
+		}
+	}
+
+	for _, ei := range e {
+		next = append(next, &Entry{Value: ei.Value, Tag: ei.Tag, TagIndex: ei.TagIndex})
+	}
+
+	s.entries = next
+	return nil
+}
+
+func (s *mockStorage) IncrementScore(value string, by int) error {
+	if err := s.failWrite(); err != nil {
+		return err
+	}
+
+	if s.scores == nil {
+		s.scores = make(map[string]int)
+	}
+
+	s.scores[value] += by
+	return nil
+}
+
+func (s *mockStorage) GetScores(values []string) (map[string]int, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+
+	scores := make(map[string]int)
+	for _, v := range values {
+		if score, ok := s.scores[v]; ok {
+			scores[v] = score
+		}
+	}
+
+	return scores, nil
+}
+
 func (s *mockStorage) Close() {}
+
+// blockingStorage counts the concurrent calls to Get, and blocks them until released.
+type blockingStorage struct {
+	*mockStorage
+	mx           sync.Mutex
+	current, max int
+	started      chan struct{}
+	release      chan struct{}
+}
+
+func (s *blockingStorage) Get(tags []string) ([]*Entry, error) {
+	s.mx.Lock()
+	s.current++
+	if s.current > s.max {
+		s.max = s.current
+	}
+
+	s.mx.Unlock()
+
+	s.started <- struct{}{}
+	<-s.release
+
+	s.mx.Lock()
+	s.current--
+	s.mx.Unlock()
+
+	return s.mockStorage.Get(tags)
+}
@@ -0,0 +1,455 @@
+package tagstash
+
+import (
+	"math"
+	"sort"
+)
+
+// Consistency defines where a query reads the value-tag associations from.
+type Consistency int
+
+const (
+	// Cached lets a query take the associations from the cache, and fetch only the missing tags from the
+	// persistent storage. This is the default.
+	Cached Consistency = iota
+
+	// Strong makes a query read all the associations from the persistent storage, bypassing the cache.
+	Strong
+)
+
+// QueryOption customizes how a query is evaluated.
+type QueryOption func(*query)
+
+type query struct {
+	limit        int
+	minMatch     int
+	consistency  Consistency
+	exclude      []string
+	require      []string
+	valueFilter  func(string) bool
+	dbRanking    bool
+	orderByIndex bool
+	idfRanking   bool
+
+	penalizeCommon     bool
+	commonTagThreshold int
+	commonTagPenalty   float64
+
+	maxIndex     map[string]int
+	shorterFirst bool
+
+	// when set, the matched positions of the returned entries are collected, keyed by the entries
+	positions map[*Entry][]TagPosition
+}
+
+// TagConstraint limits the associations of a query tag that count toward the match to those with a tag index
+// lower than or equal to MaxIndex, e.g. to match only the values where the tag is among the first few tags.
+type TagConstraint struct {
+	Tag      string
+	MaxIndex int
+}
+
+// WithLimit sets the maximum number of returned values. Values lower than 1 mean no limit.
+func WithLimit(n int) QueryOption {
+	return func(q *query) { q.limit = n }
+}
+
+// WithMinMatch sets the minimum number of query tags that a value needs to match in order to be returned.
+func WithMinMatch(n int) QueryOption {
+	return func(q *query) { q.minMatch = n }
+}
+
+// WithConsistency sets where the query reads the associations from.
+func WithConsistency(c Consistency) QueryOption {
+	return func(q *query) { q.consistency = c }
+}
+
+// WithExclude drops those values from the result that are associated with any of the provided tags.
+func WithExclude(tags ...string) QueryOption {
+	return func(q *query) { q.exclude = append(q.exclude, tags...) }
+}
+
+// WithRequire drops those values from the result that are not associated with all the provided tags. The
+// required tags don't count toward the ranking, only the query tags do.
+func WithRequire(tags ...string) QueryOption {
+	return func(q *query) { q.require = append(q.require, tags...) }
+}
+
+// WithValueFilter drops those values from the result for which the predicate returns false. The filter is
+// applied before the limit, so the limit counts only the values that pass the predicate.
+func WithValueFilter(keep func(string) bool) QueryOption {
+	return func(q *query) { q.valueFilter = keep }
+}
+
+// WithDBRanking makes the query rank the values in the persistent storage, and transfer only the ranked
+// values, instead of all the matching associations. It requires a storage implementing RankedLookup,
+// otherwise the query returns ErrNotSupported. The query reads the storage directly, bypassing the cache, and
+// the returned entries carry only the value, without a tag and tag index. When it is combined with other
+// filtering options, those are applied to the ranked values before the limit.
+func WithDBRanking() QueryOption {
+	return func(q *query) { q.dbRanking = true }
+}
+
+// WithOrderByIndex makes a query with a single tag return the values ordered by the tag index of their
+// association, ascending, and by the value when the tag index is the same. It gives a stable browse order for
+// a single tag, where every value matches the same number of tags. It is ignored by queries with multiple
+// tags.
+func WithOrderByIndex() QueryOption {
+	return func(q *query) { q.orderByIndex = true }
+}
+
+// WithIDFRanking makes the query rank the values primarily by the rarity of the tags that they match, before
+// the number of matching tags. Each matching tag adds its inverse document frequency, log(1 + n/df), to the
+// weight of a value, where df is the number of values associated with the tag, and n is the number of
+// distinct values matching any of the query tags. This way, a value matching a single rare tag can outrank a
+// value matching multiple common ones. It cannot be combined with WithDBRanking(), the query returns
+// ErrNotSupported.
+func WithIDFRanking() QueryOption {
+	return func(q *query) { q.idfRanking = true }
+}
+
+// WithTagConstraints makes the query count the associations of the constrained tags only when their tag index
+// doesn't exceed the maximum of the constraint. A value whose only association with a constrained tag is above
+// the maximum doesn't match that tag, and so the match count and the index delta used for the ranking consider
+// only the associations within the constraints. When the same tag is constrained multiple times, the lowest
+// maximum applies. When the storage implements IndexLimitedLookup, the constraints are applied by the storage.
+// It cannot be combined with WithDBRanking(), the query returns ErrNotSupported.
+func WithTagConstraints(c ...TagConstraint) QueryOption {
+	return func(q *query) {
+		if q.maxIndex == nil {
+			q.maxIndex = make(map[string]int)
+		}
+
+		for _, ci := range c {
+			if current, ok := q.maxIndex[ci.Tag]; !ok || ci.MaxIndex < current {
+				q.maxIndex[ci.Tag] = ci.MaxIndex
+			}
+		}
+	}
+}
+
+// WithShorterValues makes the query prefer the shorter values among the values that are ranked equally, and
+// the lexicographically lower ones among the values of the same length, e.g. to return a canonical URL before
+// its longer variants. It doesn't affect the queries ranked by the storage, WithDBRanking(), or the queries
+// ordered by WithOrderByIndex().
+func WithShorterValues() QueryOption {
+	return func(q *query) { q.shorterFirst = true }
+}
+
+// WithCommonTagPenalty makes the query down-weight the matches on the common tags, like stop words, so that a
+// value matching only a tag carried by most values doesn't rank close to a value matching a rare tag. The
+// values are ranked primarily by the sum of the weights of the tags that they match, before the number of the
+// matching tags, where every matching tag weighs 1, except for the tags associated with more values than the
+// threshold, whose weight is reduced by the penalty. The number of values of each query tag is counted from
+// its associations, at the time of the query. It cannot be combined with WithDBRanking() or WithIDFRanking(),
+// the query returns ErrNotSupported.
+func WithCommonTagPenalty(threshold int, penalty float64) QueryOption {
+	return func(q *query) {
+		q.penalizeCommon = true
+		q.commonTagThreshold = threshold
+		q.commonTagPenalty = penalty
+	}
+}
+
+func filterEntries(e []*Entry, keep func(*Entry) bool) []*Entry {
+	f := e[:0]
+	for _, ei := range e {
+		if keep(ei) {
+			f = append(f, ei)
+		}
+	}
+
+	return f
+}
+
+func (t *TagStash) exclude(e []*Entry, tags []string, c Consistency) ([]*Entry, error) {
+	values := make(map[string]bool)
+	if err := t.fetchEach(tags, c, nil, func(ei *Entry) { values[ei.Value] = true }); err != nil {
+		return nil, err
+	}
+
+	return filterEntries(e, func(ei *Entry) bool { return !values[ei.Value] }), nil
+}
+
+func (t *TagStash) requireAll(e []*Entry, tags []string, c Consistency) ([]*Entry, error) {
+	tags = uniqueTags(tags)
+	matched := make(map[string]map[string]bool)
+	if err := t.fetchEach(tags, c, nil, func(ei *Entry) {
+		if matched[ei.Value] == nil {
+			matched[ei.Value] = make(map[string]bool)
+		}
+
+		matched[ei.Value][ei.Tag] = true
+	}); err != nil {
+		return nil, err
+	}
+
+	return filterEntries(e, func(ei *Entry) bool { return len(matched[ei.Value]) == len(tags) }), nil
+}
+
+func (t *TagStash) getRanked(tags []string, q query) ([]*Entry, error) {
+	rl, ok := t.storage.(RankedLookup)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	// the limit can be applied by the storage only when no further filtering follows
+	limit := q.limit
+	if len(q.exclude) > 0 || len(q.require) > 0 || q.minMatch > 0 || q.valueFilter != nil {
+		limit = 0
+	}
+
+	v, err := t.storageGetRanked(rl, tags, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Entry, len(v))
+	for i, vi := range v {
+		entries[i] = &Entry{
+			Value:             vi.Value,
+			requestTagMatch:   vi.MatchCount,
+			requestIndexDelta: vi.IndexDelta,
+		}
+	}
+
+	return entries, nil
+}
+
+func (t *TagStash) setScores(e []*Entry) error {
+	ss, ok := t.storage.(ScoreStorage)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	if len(e) == 0 {
+		return nil
+	}
+
+	values := make([]string, len(e))
+	for i, ei := range e {
+		values[i] = ei.Value
+	}
+
+	scores, err := t.storageGetScores(ss, values)
+	if err != nil {
+		return err
+	}
+
+	for _, ei := range e {
+		ei.requestScore = scores[ei.Value]
+	}
+
+	return nil
+}
+
+// getAllWeighted collects the associations of the query tags first, to count the values of each tag, and
+// merges them with the weight of their tag, calculated from the number of values of the tag, df, and the
+// number of distinct values matching any of the query tags, n.
+func (t *TagStash) getAllWeighted(tags []string, q query, weight func(df, n int) float64) ([]*Entry, error) {
+	var (
+		entries []*Entry
+		df      = make(map[string]int)
+		values  = make(map[string]bool)
+	)
+
+	if err := t.fetchEach(tags, q.consistency, q.maxIndex, func(e *Entry) {
+		entries = append(entries, e)
+		df[e.Tag]++
+		values[e.Value] = true
+	}); err != nil {
+		return nil, err
+	}
+
+	m := newMerge(tags)
+	m.dedupKey = t.dedupKey
+	m.positions = q.positions
+	m.weights = make(map[string]float64)
+	for tag, count := range df {
+		m.weights[tag] = weight(count, len(values))
+	}
+
+	for _, e := range entries {
+		m.add(e)
+	}
+
+	m.sortPositions()
+	return m.unique, nil
+}
+
+// normalizeQuery applies CaseInsensitiveTags to the tags of the query options. When multiple tag constraints
+// become the same tag, the lowest maximum wins, the same way as for repeated constraints.
+func (t *TagStash) normalizeQuery(q *query) {
+	if !t.caseInsensitive {
+		return
+	}
+
+	q.exclude = t.normalizeTags(q.exclude)
+	q.require = t.normalizeTags(q.require)
+	if len(q.maxIndex) == 0 {
+		return
+	}
+
+	maxIndex := make(map[string]int, len(q.maxIndex))
+	for tag, limit := range q.maxIndex {
+		tag = t.normalizeTag(tag)
+		if current, ok := maxIndex[tag]; !ok || limit < current {
+			maxIndex[tag] = limit
+		}
+	}
+
+	q.maxIndex = maxIndex
+}
+
+// queryTags returns the tags of a query in strongest-first order, considering InvertTagStrength, and expanded
+// with the QueryExpander, when set. With CaseInsensitiveTags, the tags differing only in case are merged.
+func (t *TagStash) queryTags(tags []string) []string {
+	if t.caseInsensitive {
+		tags = uniqueTags(t.normalizeTags(tags))
+	}
+
+	if t.invertTagStrength {
+		reversed := make([]string, len(tags))
+		for i, tag := range tags {
+			reversed[len(tags)-1-i] = tag
+		}
+
+		tags = reversed
+	}
+
+	if t.queryExpander == nil {
+		return tags
+	}
+
+	// the expander may receive its own slice, and a tag returned multiple times keeps its first position
+	return uniqueTags(t.queryExpander(append([]string(nil), tags...)))
+}
+
+// CandidatesFor returns the entries of the values matching a set of tags, one entry per value, the same way
+// as Query() without options, but without ranking them. The returned entries provide the measures used for
+// the ranking, with MatchCount() and IndexDelta(), so that alternative ranking algorithms can be evaluated
+// against the real candidates. The order of the entries is undefined. It returns ErrNoTags when called
+// without tags.
+func (t *TagStash) CandidatesFor(tags ...string) ([]*Entry, error) {
+	if len(tags) == 0 {
+		return nil, ErrNoTags
+	}
+
+	defer t.observe("candidates", tags)()
+	return t.getAll(t.queryTags(tags), query{})
+}
+
+// Query returns the entries of the values matching a set of tags, one entry per value, sorted by the same
+// rules that are used for prioritization when calling Get(). The returned entries carry the value, and the
+// tag and tag index of one of the matching associations. The evaluation can be customized with query
+// options. It returns ErrNoTags when called without tags.
+func (t *TagStash) Query(tags []string, opts ...QueryOption) (entries []*Entry, err error) {
+	if t.observer != nil {
+		start := t.clock.Now()
+		defer func() { t.observer.ObserveGet(t.clock.Now().Sub(start), len(entries), err) }()
+	}
+
+	if len(tags) == 0 {
+		return nil, ErrNoTags
+	}
+
+	defer t.observe("query", tags)()
+
+	var q query
+	for _, o := range opts {
+		o(&q)
+	}
+
+	t.normalizeQuery(&q)
+	tags = t.queryTags(tags)
+
+	switch {
+	case q.dbRanking && (q.idfRanking || q.penalizeCommon || len(q.maxIndex) > 0):
+		return nil, ErrNotSupported
+	case q.idfRanking && q.penalizeCommon:
+		return nil, ErrNotSupported
+	case q.dbRanking:
+		entries, err = t.getRanked(tags, q)
+	case q.idfRanking:
+		entries, err = t.getAllWeighted(tags, q, func(df, n int) float64 {
+			return math.Log(1 + float64(n)/float64(df))
+		})
+	case q.penalizeCommon:
+		entries, err = t.getAllWeighted(tags, q, func(df, _ int) float64 {
+			if df > q.commonTagThreshold {
+				return 1 - q.commonTagPenalty
+			}
+
+			return 1
+		})
+	default:
+		entries, err = t.getAll(tags, q)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(q.require) > 0 {
+		if entries, err = t.requireAll(entries, q.require, q.consistency); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(q.exclude) > 0 {
+		if entries, err = t.exclude(entries, q.exclude, q.consistency); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.minMatch > 0 {
+		entries = filterEntries(entries, func(e *Entry) bool { return e.requestTagMatch >= q.minMatch })
+	}
+
+	if q.valueFilter != nil {
+		entries = filterEntries(entries, func(e *Entry) bool { return q.valueFilter(e.Value) })
+	}
+
+	if t.rankByScore && !q.dbRanking {
+		if err := t.setScores(entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.sortEntries(entries, len(tags), q), nil
+}
+
+// sortEntries orders the matching entries of a query, and applies the limit.
+func (t *TagStash) sortEntries(entries []*Entry, queryTags int, q query) []*Entry {
+	// the entries ranked by the storage are already sorted. With a single tag, the index delta of an entry
+	// equals its tag index.
+	if q.orderByIndex && queryTags == 1 {
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].requestIndexDelta == entries[j].requestIndexDelta {
+				return entries[i].Value < entries[j].Value
+			}
+
+			return entries[i].requestIndexDelta < entries[j].requestIndexDelta
+		})
+	} else if !q.dbRanking {
+		s := entrySort{entries: entries, ranker: t.ranker, shorterValues: q.shorterFirst}
+		if q.limit == 1 && len(entries) > 0 {
+			return []*Entry{s.First()}
+		}
+
+		sort.Sort(s)
+	}
+
+	if q.limit > 0 && len(entries) > q.limit {
+		entries = entries[:q.limit]
+	}
+
+	return entries
+}
+
+// RankEntries sorts the entries returned by Query() by the same rules that are used for prioritization when
+// calling Get() with the default Ranker, MatchCountFirst. It allows ranking the combined results of multiple
+// queries, e.g. from multiple instances.
+func RankEntries(e []*Entry) {
+	sort.Sort(entrySort{entries: e})
+}
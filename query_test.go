@@ -0,0 +1,420 @@
+package tagstash
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	t.Run("limit", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "foo", "bar", "qux")
+		stash.Set("https://www.example.org/page3", "foo", "baz", "qux")
+
+		e, err := stash.Query([]string{"foo", "bar"}, WithLimit(2))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 2 {
+			t.Error("failed to apply limit", len(e))
+		}
+	})
+
+	t.Run("min match", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "foo", "qux")
+
+		e, err := stash.Query([]string{"foo", "bar"}, WithMinMatch(2))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 1 || e[0].Value != "https://www.example.org/page1" {
+			t.Error("failed to apply min match", mapEntries(e...))
+		}
+	})
+
+	t.Run("exclude", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "foo", "qux")
+
+		e, err := stash.Query([]string{"foo", "bar"}, WithExclude("baz"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 1 || e[0].Value != "https://www.example.org/page2" {
+			t.Error("failed to apply exclusion", mapEntries(e...))
+		}
+	})
+
+	t.Run("require", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "foo", "qux")
+		stash.Set("https://www.example.org/page3", "bar", "qux")
+
+		e, err := stash.Query([]string{"foo", "bar"}, WithRequire("qux"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 2 || e[0].Value != "https://www.example.org/page2" || e[1].Value != "https://www.example.org/page3" {
+			t.Error("failed to apply the requirement", mapEntries(e...))
+		}
+	})
+
+	t.Run("order by index", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page4", "bar", "foo")
+		stash.Set("https://www.example.org/page3", "bar", "baz", "foo")
+		stash.Set("https://www.example.org/page2", "foo")
+		stash.Set("https://www.example.org/page1", "baz", "foo")
+
+		e, err := stash.Query([]string{"foo"}, WithOrderByIndex())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		v := mapEntries(e...)
+		if strings.Join(v, " ") != strings.Join([]string{
+			"https://www.example.org/page2",
+			"https://www.example.org/page1",
+			"https://www.example.org/page4",
+			"https://www.example.org/page3",
+		}, " ") {
+			t.Error("failed to order by index", v)
+		}
+	})
+
+	t.Run("idf ranking", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "qux")
+		for i := 3; i < 10; i++ {
+			stash.Set(fmt.Sprintf("https://www.example.org/page%d", i), "foo", "bar", "baz")
+		}
+
+		e, err := stash.Query([]string{"foo", "bar", "baz", "qux"}, WithIDFRanking())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 9 || e[0].Value != "https://www.example.org/page2" {
+			t.Error("failed to rank the rare tag first", mapEntries(e...))
+		}
+
+		if v, err := stash.Get("foo", "bar", "baz", "qux"); err != nil || v == "https://www.example.org/page2" {
+			t.Error("unexpected default ranking", v, err)
+		}
+	})
+
+	t.Run("idf ranking with db ranking", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		if _, err := stash.Query([]string{"foo"}, WithIDFRanking(), WithDBRanking()); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("tag constraints", func(t *testing.T) {
+		for _, c := range []Consistency{Strong, Cached} {
+			stash := newTestStash()
+			defer stash.Close()
+
+			stash.Set("https://www.example.org/page1", "bar", "baz", "foo")
+			stash.Set("https://www.example.org/page2", "foo", "bar")
+			stash.Set("https://www.example.org/page3", "qux", "foo")
+
+			if c == Cached {
+				if _, err := stash.GetAll("foo", "bar"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			e, err := stash.Query(
+				[]string{"foo", "bar"},
+				WithConsistency(c),
+				WithTagConstraints(TagConstraint{Tag: "foo", MaxIndex: 0}),
+			)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if len(e) != 2 ||
+				e[0].Value != "https://www.example.org/page2" || e[0].MatchCount() != 2 ||
+				e[1].Value != "https://www.example.org/page1" || e[1].MatchCount() != 1 {
+				t.Error("failed to apply the tag constraints", c, mapEntries(e...))
+			}
+
+			// the constrained tag is not partially cached:
+			if v, err := stash.GetAll("foo"); err != nil || len(v) != 3 {
+				t.Error("failed to get all the values of the constrained tag", c, v, err)
+			}
+		}
+	})
+
+	t.Run("tag constraints with db ranking", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		if _, err := stash.Query(
+			[]string{"foo"},
+			WithDBRanking(),
+			WithTagConstraints(TagConstraint{Tag: "foo", MaxIndex: 0}),
+		); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("shorter values", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1?ref=home", "foo")
+		stash.Set("https://www.example.org/page2", "foo")
+		stash.Set("https://www.example.org/page1", "foo")
+		stash.Set("https://www.example.org/index", "bar", "foo")
+
+		e, err := stash.Query([]string{"foo"}, WithShorterValues())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		v := mapEntries(e...)
+		if len(v) != 4 ||
+			v[0] != "https://www.example.org/page1" ||
+			v[1] != "https://www.example.org/page2" ||
+			v[2] != "https://www.example.org/page1?ref=home" ||
+			v[3] != "https://www.example.org/index" {
+			t.Error("failed to prefer the shorter values", v)
+		}
+
+		e, err = stash.Query([]string{"foo"}, WithShorterValues(), WithLimit(1))
+		if err != nil || len(e) != 1 || e[0].Value != "https://www.example.org/page1" {
+			t.Error("failed to prefer the shorter value", mapEntries(e...), err)
+		}
+	})
+
+	t.Run("common tag penalty", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		for i := 0; i < 5; i++ {
+			stash.Set(fmt.Sprintf("https://www.example.org/page%d", i), "page")
+		}
+
+		stash.Set("https://www.example.org/rare", "foo", "bar", "rare")
+		stash.Set("https://www.example.org/both", "page", "foo", "rare")
+
+		e, err := stash.Query([]string{"page", "rare"}, WithCommonTagPenalty(3, 0.9))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 7 ||
+			e[0].Value != "https://www.example.org/both" ||
+			e[1].Value != "https://www.example.org/rare" {
+			t.Error("failed to penalize the common tag", mapEntries(e...))
+		}
+
+		if v, err := stash.GetAll("page", "rare"); err != nil || v[len(v)-1] != "https://www.example.org/rare" {
+			t.Error("unexpected default ranking", v, err)
+		}
+
+		for _, o := range []QueryOption{WithDBRanking(), WithIDFRanking()} {
+			if _, err := stash.Query([]string{"page"}, WithCommonTagPenalty(3, 0.9), o); err != ErrNotSupported {
+				t.Error("failed to fail with the right error", err)
+			}
+		}
+	})
+
+	t.Run("value filter", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar")
+		stash.Set("https://www.example.com/page2", "foo", "bar")
+		stash.Set("https://www.example.com/page3", "foo")
+
+		e, err := stash.Query([]string{"foo", "bar"}, WithLimit(1), WithValueFilter(func(v string) bool {
+			return strings.HasPrefix(v, "https://www.example.com/")
+		}))
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 1 || e[0].Value != "https://www.example.com/page2" {
+			t.Error("failed to apply value filter", mapEntries(e...))
+		}
+	})
+
+	t.Run("db ranking", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "bar", "foo")
+		stash.Set("https://www.example.org/page3", "baz", "qux", "foo")
+		stash.Set("https://www.example.org/page4", "bar", "qux")
+
+		tags := []string{"foo", "qux", "baz"}
+		expect, err := stash.Query(tags)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		e, err := stash.Query(tags, WithDBRanking())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != len(expect) {
+			t.Error("inconsistent ranking", mapEntries(e...), mapEntries(expect...))
+			return
+		}
+
+		for i := range e {
+			if e[i].Value != expect[i].Value {
+				t.Error("inconsistent ranking", mapEntries(e...), mapEntries(expect...))
+				return
+			}
+		}
+
+		e, err = stash.Query(tags, WithDBRanking(), WithLimit(1), WithExclude("qux"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 1 || e[0].Value != "https://www.example.org/page1" {
+			t.Error("failed to filter before the limit", mapEntries(e...))
+		}
+	})
+
+	t.Run("db ranking not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorage{}
+
+		if _, err := stash.Query([]string{"foo"}, WithDBRanking()); err != ErrNotSupported {
+			t.Error("failed to fail", err)
+		}
+	})
+
+	t.Run("strong consistency", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.cache.Close()
+		stash.cache = &mockStorage{}
+
+		stash.Set("https://www.example.org/page1", "foo")
+		stash.cache.Remove(&Entry{Value: "https://www.example.org/page1", Tag: "foo"})
+		stash.cache.Set(&Entry{Value: "https://www.example.org/page2", Tag: "foo"})
+
+		e, err := stash.Query([]string{"foo"}, WithConsistency(Strong))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(e) != 1 || e[0].Value != "https://www.example.org/page1" {
+			t.Error("failed to read from the storage", mapEntries(e...))
+		}
+	})
+}
+
+func TestDedupKeyFunc(t *testing.T) {
+	stash, err := New(Options{
+		Storage:      &mockStorage{},
+		DedupKeyFunc: func(v string) string { return strings.TrimSuffix(v, "/") },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo")
+	stash.Set("https://www.example.org/page1/", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "foo", "bar", "baz")
+
+	e, err := stash.Query([]string{"foo", "bar", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 2 ||
+		e[0].Value != "https://www.example.org/page2" ||
+		e[1].Value != "https://www.example.org/page1" && e[1].Value != "https://www.example.org/page1/" ||
+		e[1].requestTagMatch != 2 {
+		t.Error("failed to deduplicate the values", mapEntries(e...))
+	}
+}
+
+func TestCandidatesFor(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+	stash.Set("https://www.example.org/page2", "baz", "qux")
+
+	e, err := stash.CandidatesFor("foo", "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 2 {
+		t.Fatal("invalid candidates", mapEntries(e...))
+	}
+
+	for _, ei := range e {
+		switch {
+		case ei.Value == "https://www.example.org/page1" && ei.MatchCount() == 2 && ei.IndexDelta() == 1:
+		case ei.Value == "https://www.example.org/page2" && ei.MatchCount() == 1 && ei.IndexDelta() == 1:
+		default:
+			t.Error("invalid candidate", ei.Value, ei.MatchCount(), ei.IndexDelta())
+		}
+	}
+
+	if _, err := stash.CandidatesFor(); err != ErrNoTags {
+		t.Error("failed to fail with the right error", err)
+	}
+}
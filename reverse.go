@@ -0,0 +1,105 @@
+package tagstash
+
+import "sync"
+
+// reverseCache holds the tags of the values looked up with GetTags(). Every invalidation increments the
+// generation, and the tags read from the storage are cached only when no invalidation happened during the
+// read, so that a concurrent write cannot be overwritten by the stale tags. A nil reverse cache is disabled.
+type reverseCache struct {
+	mx         sync.Mutex
+	tags       map[string][]string
+	generation uint64
+
+	// values with expiring associations are not cached, because the cached tags wouldn't expire
+	volatile map[string]bool
+}
+
+func newReverseCache() *reverseCache {
+	return &reverseCache{
+		tags:     make(map[string][]string),
+		volatile: make(map[string]bool),
+	}
+}
+
+func (c *reverseCache) get(value string) ([]string, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	tags, ok := c.tags[value]
+	if !ok {
+		return nil, c.generation, false
+	}
+
+	return append([]string(nil), tags...), c.generation, true
+}
+
+func (c *reverseCache) set(value string, tags []string, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.generation != generation || c.volatile[value] {
+		return
+	}
+
+	c.tags[value] = append([]string(nil), tags...)
+}
+
+func (c *reverseCache) invalidate(values ...string) {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.generation++
+	for _, v := range values {
+		delete(c.tags, v)
+	}
+}
+
+func (c *reverseCache) setVolatile(value string) {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.generation++
+	c.volatile[value] = true
+	delete(c.tags, value)
+}
+
+// invalidateTags drops the values associated with any of the provided tags.
+func (c *reverseCache) invalidateTags(tags ...string) {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.generation++
+	drop := make(map[string]bool)
+	for _, t := range tags {
+		drop[t] = true
+	}
+
+	for v, vt := range c.tags {
+		for _, t := range vt {
+			if drop[t] {
+				delete(c.tags, v)
+				break
+			}
+		}
+	}
+}
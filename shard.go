@@ -0,0 +1,133 @@
+package tagstash
+
+import "sync"
+
+// ShardFunc selects the shard of a value. The result is taken modulo the number of shards.
+type ShardFunc func(value string) int
+
+// ShardedStash distributes the values across multiple tagstash instances. All the associations of a value
+// are stored in the same shard, selected by the ShardFunc, while the queries are evaluated by all the
+// shards, and their results are ranked together.
+type ShardedStash struct {
+	shards []*TagStash
+	shard  ShardFunc
+}
+
+// NewShardedStash creates a sharded stash from existing tagstash instances. It returns ErrInvalidSharding
+// when called without shards, or without a ShardFunc.
+func NewShardedStash(shard ShardFunc, shards ...*TagStash) (*ShardedStash, error) {
+	if shard == nil || len(shards) == 0 {
+		return nil, ErrInvalidSharding
+	}
+
+	for _, si := range shards {
+		if si == nil {
+			return nil, ErrInvalidSharding
+		}
+	}
+
+	return &ShardedStash{shards: shards, shard: shard}, nil
+}
+
+func (s *ShardedStash) shardOf(value string) *TagStash {
+	i := s.shard(value) % len(s.shards)
+	if i < 0 {
+		i += len(s.shards)
+	}
+
+	return s.shards[i]
+}
+
+// Query evaluates the query in every shard, and returns the combined entries ranked together. The limit, if
+// set, is applied to the combined result. The combined entries are ranked with the Ranker of the first shard,
+// respecting WithOrderByIndex() and WithShorterValues(). With WithDBRanking(), the shards rank their own
+// entries in the storage, and the combined entries are ranked with the Ranker. WithIDFRanking() and
+// WithCommonTagPenalty() are not supported, because the tag frequencies would be counted per shard, and the
+// query returns ErrNotSupported.
+func (s *ShardedStash) Query(tags []string, opts ...QueryOption) ([]*Entry, error) {
+	var q query
+	for _, o := range opts {
+		o(&q)
+	}
+
+	if q.idfRanking || q.penalizeCommon {
+		return nil, ErrNotSupported
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make([][]*Entry, len(s.shards))
+		errs    = make([]error, len(s.shards))
+	)
+
+	for i, si := range s.shards {
+		wg.Add(1)
+		go func(i int, si *TagStash) {
+			defer wg.Done()
+			results[i], errs[i] = si.Query(tags, opts...)
+		}(i, si)
+	}
+
+	wg.Wait()
+
+	var entries []*Entry
+	for i := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+
+		entries = append(entries, results[i]...)
+	}
+
+	first := s.shards[0]
+	q.dbRanking = false
+	return first.sortEntries(entries, len(first.queryTags(tags)), q), nil
+}
+
+// Get returns the best matching value for a set of tags across all the shards.
+func (s *ShardedStash) Get(tags ...string) (string, error) {
+	entries, err := s.Query(tags, WithLimit(1))
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+
+	return entries[0].Value, nil
+}
+
+// GetAll returns all matches for a set of tags across all the shards, ranked together.
+func (s *ShardedStash) GetAll(tags ...string) ([]string, error) {
+	entries, err := s.Query(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapEntries(entries...), nil
+}
+
+// Set stores tags associated with a value in the shard of the value.
+func (s *ShardedStash) Set(value string, tags ...string) error {
+	return s.shardOf(value).Set(value, tags...)
+}
+
+// Remove deletes a value-tag association from the shard of the value.
+func (s *ShardedStash) Remove(value string, tag string) error {
+	return s.shardOf(value).Remove(value, tag)
+}
+
+// Delete deletes all associations of a tag from every shard.
+func (s *ShardedStash) Delete(tag string) error {
+	for _, si := range s.shards {
+		if err := si.Delete(tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close releases all the resources of the shards.
+func (s *ShardedStash) Close() {
+	for _, si := range s.shards {
+		si.Close()
+	}
+}
@@ -0,0 +1,176 @@
+package tagstash
+
+import (
+	"strings"
+	"testing"
+)
+
+func testShardFunc(value string) int {
+	if strings.HasSuffix(value, "1") || strings.HasSuffix(value, "3") {
+		return 1
+	}
+
+	return 0
+}
+
+func newTestShardedStashOptions(t *testing.T, o Options) *ShardedStash {
+	shards := make([]*TagStash, 2)
+	for i := range shards {
+		o.Storage = &mockStorage{}
+		s, err := New(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shards[i] = s
+	}
+
+	s, err := NewShardedStash(testShardFunc, shards...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func newTestShardedStash(t *testing.T) *ShardedStash {
+	return newTestShardedStashOptions(t, Options{})
+}
+
+func TestShardedStash(t *testing.T) {
+	t.Run("routes by value", func(t *testing.T) {
+		s := newTestShardedStash(t)
+		defer s.Close()
+
+		s.Set("https://www.example.org/page1", "foo", "bar")
+		s.Set("https://www.example.org/page2", "foo")
+
+		if len(s.shards[0].storage.(*mockStorage).entries) != 1 ||
+			len(s.shards[1].storage.(*mockStorage).entries) != 2 {
+			t.Error("failed to route the values")
+		}
+	})
+
+	t.Run("ranks across shards", func(t *testing.T) {
+		s := newTestShardedStash(t)
+		defer s.Close()
+
+		s.Set("https://www.example.org/page1", "foo")
+		s.Set("https://www.example.org/page2", "foo", "bar")
+		s.Set("https://www.example.org/page3", "bar")
+		s.Set("https://www.example.org/page4", "baz")
+
+		v, err := s.GetAll("foo", "bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 3 ||
+			v[0] != "https://www.example.org/page2" ||
+			v[1] != "https://www.example.org/page1" ||
+			v[2] != "https://www.example.org/page3" {
+			t.Error("invalid ranking", v)
+		}
+
+		best, err := s.Get("foo", "bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if best != "https://www.example.org/page2" {
+			t.Error("invalid best match", best)
+		}
+	})
+
+	t.Run("no shards", func(t *testing.T) {
+		if _, err := NewShardedStash(testShardFunc); err != ErrInvalidSharding {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("no shard func", func(t *testing.T) {
+		s, err := New(Options{Storage: &mockStorage{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		if _, err := NewShardedStash(nil, s); err != ErrInvalidSharding {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("order by index across shards", func(t *testing.T) {
+		s := newTestShardedStash(t)
+		defer s.Close()
+
+		s.Set("https://www.example.org/page1", "bar", "foo")
+		s.Set("https://www.example.org/page2", "foo")
+		s.Set("https://www.example.org/page3", "baz", "qux", "foo")
+
+		e, err := s.Query([]string{"foo"}, WithOrderByIndex())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v := mapEntries(e...)
+		if len(v) != 3 ||
+			v[0] != "https://www.example.org/page2" ||
+			v[1] != "https://www.example.org/page1" ||
+			v[2] != "https://www.example.org/page3" {
+			t.Error("invalid order", v)
+		}
+	})
+
+	t.Run("ranker of the shards", func(t *testing.T) {
+		s := newTestShardedStashOptions(t, Options{Ranker: OrderFirst})
+		defer s.Close()
+
+		s.Set("https://www.example.org/page1", "foo", "bar")
+		s.Set("https://www.example.org/page2", "bar")
+
+		v, err := s.GetAll("bar", "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 2 || v[0] != "https://www.example.org/page2" || v[1] != "https://www.example.org/page1" {
+			t.Error("invalid ranking", v)
+		}
+	})
+
+	t.Run("per-shard tag frequencies not supported", func(t *testing.T) {
+		s := newTestShardedStash(t)
+		defer s.Close()
+
+		if _, err := s.Query([]string{"foo"}, WithIDFRanking()); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if _, err := s.Query([]string{"foo"}, WithCommonTagPenalty(1, 0.5)); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("delete from all shards", func(t *testing.T) {
+		s := newTestShardedStash(t)
+		defer s.Close()
+
+		s.Set("https://www.example.org/page1", "foo")
+		s.Set("https://www.example.org/page2", "foo")
+
+		if err := s.Delete("foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := s.GetAll("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 0 {
+			t.Error("failed to delete from all shards", v)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package tagstash
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/aryszka/keyval"
+)
+
+// startSnapshots loads the snapshot if it exists, and starts saving the snapshots periodically when an
+// interval is set.
+func (c *cache) startSnapshots(interval time.Duration) error {
+	if c.snapshotPath == "" {
+		return nil
+	}
+
+	if c.snapshotTTL <= 0 {
+		c.snapshotTTL = DefaultSnapshotTTL
+	}
+
+	if err := c.loadSnapshot(); err != nil {
+		return err
+	}
+
+	if interval <= 0 {
+		return nil
+	}
+
+	c.quit = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				c.saveSnapshot()
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *cache) loadSnapshot() error {
+	f, err := os.Open(c.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	var tags []string
+	byTag := make(map[string][]*Entry)
+	kvr := keyval.NewEntryReader(f)
+	for {
+		e, err := kvr.ReadEntry()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if len(e.Key) != 2 {
+			return ErrDamagedCacheData
+		}
+
+		tag := e.Key[0]
+		ei := &Entry{Tag: tag, Value: e.Key[1]}
+		if err := decodeIndex(e.Val, ei); err != nil {
+			return err
+		}
+
+		if _, ok := byTag[tag]; !ok {
+			tags = append(tags, tag)
+		}
+
+		byTag[tag] = append(byTag[tag], ei)
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	expires := c.now().Add(c.snapshotTTL)
+	for _, tag := range tags {
+		c.expires[tag] = expires
+		if err := c.write(tag, byTag[tag]); err != nil {
+			// the tags that don't fit in the cache are read from the storage on the next query
+			c.drop(tag)
+		}
+	}
+
+	return nil
+}
+
+func (c *cache) snapshotEntries() ([]*Entry, error) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	var entries []*Entry
+	for tag := range c.tags {
+		r, ok := c.forget.Get(tag)
+		if !ok {
+			continue
+		}
+
+		err := c.readTag(r, tag, func(e *Entry) { entries = append(entries, e) })
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// saveSnapshot writes the cached associations to a temporary file, and replaces the previous snapshot with it.
+func (c *cache) saveSnapshot() error {
+	entries, err := c.snapshotEntries()
+	if err != nil {
+		return err
+	}
+
+	tmp := c.snapshotPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	kvw := keyval.NewEntryWriter(f)
+	for _, e := range entries {
+		if err = kvw.WriteEntry(&keyval.Entry{
+			Key: []string{e.Tag, e.Value},
+			Val: encodeIndex(e),
+		}); err != nil {
+			break
+		}
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, c.snapshotPath)
+}
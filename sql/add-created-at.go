@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_add_created_at = `
+
+alter table tags
+add column created_at bigint;
+`
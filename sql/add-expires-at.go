@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_add_expires_at = `
+
+alter table tags
+add column expires_at bigint;
+`
@@ -0,0 +1,2 @@
+alter table tags
+add column expires_at bigint;
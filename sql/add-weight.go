@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_add_weight = `
+
+alter table tags
+add column weight double precision;
+`
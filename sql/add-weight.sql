@@ -0,0 +1,2 @@
+alter table tags
+add column weight double precision;
@@ -0,0 +1,9 @@
+package sql
+
+// generated code
+const Cmd_count_tag = `
+
+select count(*) from tags
+where tag = $1
+and (expires_at is null or expires_at > $2);
+`
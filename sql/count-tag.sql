@@ -0,0 +1,3 @@
+select count(*) from tags
+where tag = $1
+and (expires_at is null or expires_at > $2);
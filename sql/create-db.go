@@ -7,6 +7,9 @@ create table tags (
   tag text not null,
   value text not null,
   tag_index int,
+  created_at bigint,
+  expires_at bigint,
+  weight double precision,
   primary key (tag, value)
 );
 `
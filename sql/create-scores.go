@@ -0,0 +1,11 @@
+package sql
+
+// generated code
+const Cmd_create_scores = `
+
+create table if not exists scores (
+  value text not null,
+  score bigint not null,
+  primary key (value)
+);
+`
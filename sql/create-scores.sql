@@ -0,0 +1,5 @@
+create table if not exists scores (
+  value text not null,
+  score bigint not null,
+  primary key (value)
+);
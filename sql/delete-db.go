@@ -4,4 +4,5 @@ package sql
 const Cmd_delete_db = `
 
 drop table tags;
+drop table if exists scores;
 `
@@ -1 +1,2 @@
 drop table tags;
+drop table if exists scores;
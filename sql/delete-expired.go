@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_delete_expired = `
+
+delete from tags
+where expires_at <= $1;
+`
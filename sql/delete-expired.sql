@@ -0,0 +1,2 @@
+delete from tags
+where expires_at <= $1;
@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_delete_older_than = `
+
+delete from tags
+where created_at < $1;
+`
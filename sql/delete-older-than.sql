@@ -0,0 +1,2 @@
+delete from tags
+where created_at < $1;
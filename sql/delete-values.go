@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_delete_values = `
+
+delete from tags
+where value in (%s);
+`
@@ -0,0 +1,2 @@
+delete from tags
+where value in (%s);
@@ -0,0 +1,15 @@
+package sql
+
+// generated code
+const Cmd_get_all_entries = `
+
+select
+  tag,
+  value,
+  tag_index,
+  expires_at,
+  weight
+from tags
+where expires_at is null or expires_at > $1
+order by value, tag_index, tag;
+`
@@ -0,0 +1,15 @@
+package sql
+
+// generated code
+const Cmd_get_entries_by_prefix = `
+
+select
+  tag,
+  value,
+  tag_index,
+  expires_at,
+  weight
+from tags
+where tag like $1 escape '\'
+and (expires_at is null or expires_at > $2);
+`
@@ -0,0 +1,9 @@
+select
+  tag,
+  value,
+  tag_index,
+  expires_at,
+  weight
+from tags
+where tag like $1 escape '\'
+and (expires_at is null or expires_at > $2);
@@ -0,0 +1,16 @@
+package sql
+
+// generated code
+const Cmd_get_entries_max_index = `
+
+select
+  tag,
+  value,
+  tag_index,
+  expires_at,
+  weight
+from tags
+where tag in (%s)
+and (expires_at is null or expires_at > $%d)
+and %s;
+`
@@ -0,0 +1,10 @@
+select
+  tag,
+  value,
+  tag_index,
+  expires_at,
+  weight
+from tags
+where tag in (%s)
+and (expires_at is null or expires_at > $%d)
+and %s;
@@ -6,7 +6,10 @@ const Cmd_get_entries = `
 select
   tag,
   value,
-  tag_index
+  tag_index,
+  expires_at,
+  weight
 from tags
-where tag in (%s);
+where tag in (%s)
+and (expires_at is null or expires_at > $%d);
 `
@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_get_expired_tags = `
+
+select distinct tag from tags
+where expires_at <= $1;
+`
@@ -0,0 +1,2 @@
+select distinct tag from tags
+where expires_at <= $1;
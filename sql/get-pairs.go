@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_get_pairs = `
+
+select tag, value from tags
+where %s;
+`
@@ -0,0 +1,2 @@
+select tag, value from tags
+where %s;
@@ -0,0 +1,10 @@
+select
+  value,
+  count(*),
+  sum(abs((case tag %s end) - tag_index))
+from tags
+where tag in (%s)
+and (expires_at is null or expires_at > $%d)
+group by value
+order by sum(coalesce(weight, 1)) desc, 2 desc, 3, value
+%s;
@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_get_scores = `
+
+select value, score from scores
+where value in (%s);
+`
@@ -0,0 +1,2 @@
+select value, score from scores
+where value in (%s);
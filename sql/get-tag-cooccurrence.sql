@@ -0,0 +1,6 @@
+select a.tag, b.tag, count(*)
+from tags a
+join tags b on b.value = a.value and b.tag > a.tag
+group by a.tag, b.tag
+having count(*) >= $1
+order by 3 desc, 1, 2;
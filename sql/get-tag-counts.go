@@ -0,0 +1,10 @@
+package sql
+
+// generated code
+const Cmd_get_tag_counts = `
+
+select value, count(*) from tags
+where value in (%s)
+and (expires_at is null or expires_at > $%d)
+group by value;
+`
@@ -0,0 +1,4 @@
+select value, count(*) from tags
+where value in (%s)
+and (expires_at is null or expires_at > $%d)
+group by value;
@@ -0,0 +1,10 @@
+package sql
+
+// generated code
+const Cmd_get_tag_frequency = `
+
+select tag, count(*) as frequency from tags
+group by tag
+order by frequency desc, tag
+limit $1;
+`
@@ -0,0 +1,4 @@
+select tag, count(*) as frequency from tags
+group by tag
+order by frequency desc, tag
+limit $1;
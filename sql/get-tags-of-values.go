@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_get_tags_of_values = `
+
+select distinct tag from tags
+where value in (%s);
+`
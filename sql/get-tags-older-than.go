@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_get_tags_older_than = `
+
+select distinct tag from tags
+where created_at < $1;
+`
@@ -0,0 +1,2 @@
+select distinct tag from tags
+where created_at < $1;
@@ -0,0 +1,10 @@
+package sql
+
+// generated code
+const Cmd_get_tags_page = `
+
+select distinct tag from tags
+where tag > $1
+order by tag
+limit $2;
+`
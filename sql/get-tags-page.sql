@@ -0,0 +1,4 @@
+select distinct tag from tags
+where tag > $1
+order by tag
+limit $2;
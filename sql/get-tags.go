@@ -4,5 +4,6 @@ package sql
 const Cmd_get_tags = `
 
 select tag from tags
-where value = $1;
+where value = $1
+and (expires_at is null or expires_at > $2);
 `
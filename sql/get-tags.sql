@@ -1,2 +1,3 @@
 select tag from tags
-where value = $1;
+where value = $1
+and (expires_at is null or expires_at > $2);
@@ -0,0 +1,16 @@
+package sql
+
+// generated code
+const Cmd_get_value_entries = `
+
+select
+  tag,
+  value,
+  tag_index,
+  expires_at,
+  weight
+from tags
+where value = $1
+and (expires_at is null or expires_at > $2)
+order by tag_index, tag;
+`
@@ -0,0 +1,11 @@
+package sql
+
+// generated code
+const Cmd_get_values_missing_tag = `
+
+select distinct value from tags t
+where not exists (
+  select 1 from tags r
+  where r.value = t.value and r.tag = $1
+);
+`
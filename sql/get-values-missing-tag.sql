@@ -0,0 +1,5 @@
+select distinct value from tags t
+where not exists (
+  select 1 from tags r
+  where r.value = t.value and r.tag = $1
+);
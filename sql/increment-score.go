@@ -0,0 +1,9 @@
+package sql
+
+// generated code
+const Cmd_increment_score = `
+
+update scores
+set score = score + $2
+where value = $1;
+`
@@ -0,0 +1,3 @@
+update scores
+set score = score + $2
+where value = $1;
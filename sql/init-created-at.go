@@ -0,0 +1,9 @@
+package sql
+
+// generated code
+const Cmd_init_created_at = `
+
+update tags
+set created_at = $1
+where created_at is null;
+`
@@ -0,0 +1,3 @@
+update tags
+set created_at = $1
+where created_at is null;
@@ -0,0 +1,10 @@
+package sql
+
+// generated code
+const Cmd_init_score_pq = `
+
+insert into scores
+(value, score)
+values ($1, 0)
+on conflict(value) do nothing;
+`
@@ -0,0 +1,4 @@
+insert into scores
+(value, score)
+values ($1, 0)
+on conflict(value) do nothing;
@@ -0,0 +1,9 @@
+package sql
+
+// generated code
+const Cmd_init_score = `
+
+insert or ignore into scores
+(value, score)
+values ($1, 0);
+`
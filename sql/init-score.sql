@@ -0,0 +1,3 @@
+insert or ignore into scores
+(value, score)
+values ($1, 0);
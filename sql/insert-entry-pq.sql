@@ -1,5 +1,5 @@
 insert into tags
-(tag, value, tag_index)
-values ($1, $2, $3)
-on conflict(tag, value) do
-update set tag_index = $3;
+(tag, value, tag_index, created_at, expires_at, weight)
+values ($1, $2, $3, $4, $5, $6)
+on conflict(%s) do
+update set tag_index = $3, expires_at = $5, weight = $6;
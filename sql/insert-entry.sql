@@ -1,3 +1,3 @@
 insert or replace into tags
-(tag, value, tag_index)
-values ($1, $2, $3);
+(tag, value, tag_index, created_at, expires_at, weight)
+values ($1, $2, $3, coalesce((select created_at from tags where tag = $1 and value = $2), $4), $5, $6);
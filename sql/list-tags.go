@@ -0,0 +1,7 @@
+package sql
+
+// generated code
+const Cmd_list_tags = `
+
+select distinct tag from tags order by tag;
+`
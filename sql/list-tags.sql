@@ -0,0 +1 @@
+select distinct tag from tags order by tag;
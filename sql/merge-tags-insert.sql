@@ -0,0 +1,10 @@
+insert into tags
+(tag, value, tag_index, created_at, expires_at, weight)
+select cast($2 as text), s.value, s.tag_index, s.created_at, s.expires_at, s.weight
+from tags s
+where s.tag = $1
+and (s.expires_at is null or s.expires_at > $3)
+and not exists (
+  select 1 from tags d
+  where d.tag = $2 and d.value = s.value
+);
@@ -0,0 +1,14 @@
+package sql
+
+// generated code
+const Cmd_merge_tags_min_index = `
+
+update tags
+set tag_index = (
+  select case when s.tag_index < tags.tag_index then s.tag_index else tags.tag_index end
+  from tags s
+  where s.tag = $1 and s.value = tags.value
+)
+where tag = $2
+and value in (select value from tags where tag = $1);
+`
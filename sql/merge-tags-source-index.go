@@ -0,0 +1,13 @@
+package sql
+
+// generated code
+const Cmd_merge_tags_source_index = `
+
+update tags
+set tag_index = (
+  select s.tag_index from tags s
+  where s.tag = $1 and s.value = tags.value
+)
+where tag = $2
+and value in (select value from tags where tag = $1);
+`
@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_probe_created_at = `
+
+select created_at from tags
+where 1 = 0;
+`
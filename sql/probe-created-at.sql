@@ -0,0 +1,2 @@
+select created_at from tags
+where 1 = 0;
@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_probe_expires_at = `
+
+select expires_at from tags
+where 1 = 0;
+`
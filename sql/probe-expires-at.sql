@@ -0,0 +1,2 @@
+select expires_at from tags
+where 1 = 0;
@@ -0,0 +1,8 @@
+package sql
+
+// generated code
+const Cmd_probe_weight = `
+
+select weight from tags
+where 1 = 0;
+`
@@ -0,0 +1,2 @@
+select weight from tags
+where 1 = 0;
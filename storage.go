@@ -3,10 +3,14 @@ package tagstash
 //go:generate sql/gen.sh
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	sqlcmd "github.com/aryszka/tagstash/sql"
 
@@ -26,23 +30,68 @@ const (
 
 	// DefaultDataSourceName is used as the default data source (data.sqlite).
 	DefaultDataSourceName = "data.sqlite"
+
+	sqliteMaxParameters   = 999
+	postgresMaxParameters = 65535
 )
 
 type commands struct {
-	createDB    string
-	getEntries  string
-	getTags     string
-	insertEntry string
-	deleteEntry string
-	deleteTag   string
+	createDB         string
+	getEntries       string
+	getEntriesMax    string
+	getValueEntries  string
+	getAllEntries    string
+	getValuesTags    string
+	deleteValues     string
+	getTags          string
+	insertEntry      string
+	deleteEntry      string
+	deleteTag        string
+	getTagsOlderThan string
+	deleteOlderThan  string
+	getTagFrequency  string
+	getValuesMissing string
+	getTagCounts     string
+	getRanked        string
+	getCooccurrence  string
+	getPairs         string
+	getTagsPage      string
+	listTags         string
+	countTag         string
+	getPrefixEntries string
+	mergeSourceIndex string
+	mergeMinIndex    string
+	mergeInsert      string
+	probeCreatedAt   string
+	addCreatedAt     string
+	initCreatedAt    string
+	probeExpiresAt   string
+	addExpiresAt     string
+	probeWeight      string
+	addWeight        string
+	getExpiredTags   string
+	deleteExpired    string
+	createScores     string
+	initScore        string
+	incrementScore   string
+	getScores        string
 }
 
 type storage struct {
-	db       *sql.DB
-	commands commands
+	db        *sql.DB
+	commands  commands
+	now       func() time.Time
+	maxParams int
+
+	// applied on the client side, with a context deadline, for the drivers that don't support a server side
+	// statement timeout
+	statementTimeout time.Duration
+
+	// false when the database handle was passed in by the caller, and it is not closed with the storage
+	ownsDB bool
 }
 
-func getCommands(driverName string) commands {
+func getCommands(o StorageOptions) commands {
 	c := commands{
 		createDB:    sqlcmd.Cmd_create_db,
 		getEntries:  sqlcmd.Cmd_get_entries,
@@ -50,24 +99,202 @@ func getCommands(driverName string) commands {
 		insertEntry: sqlcmd.Cmd_insert_entry,
 		deleteEntry: sqlcmd.Cmd_delete_entry,
 		deleteTag:   sqlcmd.Cmd_delete_tag,
+
+		getEntriesMax:    sqlcmd.Cmd_get_entries_max_index,
+		getValueEntries:  sqlcmd.Cmd_get_value_entries,
+		getAllEntries:    sqlcmd.Cmd_get_all_entries,
+		getValuesTags:    sqlcmd.Cmd_get_tags_of_values,
+		deleteValues:     sqlcmd.Cmd_delete_values,
+		getTagsOlderThan: sqlcmd.Cmd_get_tags_older_than,
+		deleteOlderThan:  sqlcmd.Cmd_delete_older_than,
+		getTagFrequency:  sqlcmd.Cmd_get_tag_frequency,
+		getValuesMissing: sqlcmd.Cmd_get_values_missing_tag,
+		getTagCounts:     sqlcmd.Cmd_get_tag_counts,
+		getRanked:        sqlcmd.Cmd_get_ranked,
+		getCooccurrence:  sqlcmd.Cmd_get_tag_cooccurrence,
+		getPairs:         sqlcmd.Cmd_get_pairs,
+		getTagsPage:      sqlcmd.Cmd_get_tags_page,
+		listTags:         sqlcmd.Cmd_list_tags,
+		countTag:         sqlcmd.Cmd_count_tag,
+		getPrefixEntries: sqlcmd.Cmd_get_entries_by_prefix,
+		mergeSourceIndex: sqlcmd.Cmd_merge_tags_source_index,
+		mergeMinIndex:    sqlcmd.Cmd_merge_tags_min_index,
+		mergeInsert:      sqlcmd.Cmd_merge_tags_insert,
+		probeCreatedAt:   sqlcmd.Cmd_probe_created_at,
+		addCreatedAt:     sqlcmd.Cmd_add_created_at,
+		initCreatedAt:    sqlcmd.Cmd_init_created_at,
+		probeExpiresAt:   sqlcmd.Cmd_probe_expires_at,
+		addExpiresAt:     sqlcmd.Cmd_add_expires_at,
+		probeWeight:      sqlcmd.Cmd_probe_weight,
+		addWeight:        sqlcmd.Cmd_add_weight,
+		getExpiredTags:   sqlcmd.Cmd_get_expired_tags,
+		deleteExpired:    sqlcmd.Cmd_delete_expired,
+		createScores:     sqlcmd.Cmd_create_scores,
+		initScore:        sqlcmd.Cmd_init_score,
+		incrementScore:   sqlcmd.Cmd_increment_score,
+		getScores:        sqlcmd.Cmd_get_scores,
 	}
 
-	if driverName == postgres {
-		c.insertEntry = sqlcmd.Cmd_insert_entry_pq
+	if o.DriverName == postgres {
+		conflictColumns := o.ConflictColumns
+		if len(conflictColumns) == 0 {
+			conflictColumns = []string{"tag", "value"}
+		}
+
+		c.insertEntry = fmt.Sprintf(sqlcmd.Cmd_insert_entry_pq, strings.Join(conflictColumns, ", "))
+		c.initScore = sqlcmd.Cmd_init_score_pq
 	}
 
 	return c
 }
 
-func newStorage(o StorageOptions) (*storage, error) {
+func hasColumn(db *sql.DB, probe string) bool {
+	r, err := db.Query(probe)
+	if err != nil {
+		return false
+	}
+
+	r.Close()
+	return true
+}
+
+// migrate adds the created_at, expires_at and weight columns to databases created by earlier versions. The
+// existing associations get the time of the migration as their creation time, they don't expire, and they
+// have the default weight.
+func migrate(db *sql.DB, c commands, now time.Time) error {
+	if !hasColumn(db, c.probeCreatedAt) {
+		if err := migrateCreatedAt(db, c, now); err != nil {
+			return err
+		}
+	}
+
+	if !hasColumn(db, c.probeExpiresAt) {
+		if _, err := db.Exec(c.addExpiresAt); err != nil {
+			return err
+		}
+	}
+
+	if !hasColumn(db, c.probeWeight) {
+		if _, err := db.Exec(c.addWeight); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateCreatedAt(db *sql.DB, c commands, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(c.addCreatedAt); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(c.initCreatedAt, now.UnixNano()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func isPostgresURL(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// detectDriver returns the driver matching the format of a data source name: postgres for the PostgreSQL URLs
+// and for the key-value connection strings with both a host and a database name, otherwise the default.
+func detectDriver(dsn string) string {
+	if isPostgresURL(dsn) {
+		return postgres
+	}
+
+	var host, dbname bool
+	for _, kv := range strings.Fields(dsn) {
+		host = host || strings.HasPrefix(kv, "host=")
+		dbname = dbname || strings.HasPrefix(kv, "dbname=")
+	}
+
+	if host && dbname {
+		return postgres
+	}
+
+	return DefaultDriverName
+}
+
+// checkWritable verifies that the sqlite file of a data source name can be opened for writing, or created, so
+// that a misconfigured path fails on startup, instead of the first write. File URIs and in-memory databases
+// are not checked.
+func checkWritable(dsn string) error {
+	if strings.HasPrefix(dsn, "file:") || strings.HasPrefix(dsn, ":memory:") {
+		return nil
+	}
+
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		dsn = dsn[:i]
+	}
+
+	flag := os.O_RDWR
+	_, err := os.Stat(dsn)
+	if os.IsNotExist(err) {
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+
+	f, err := os.OpenFile(dsn, flag, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStorageNotWritable, err)
+	}
+
+	f.Close()
+	if flag&os.O_CREATE != 0 {
+		// the database is created by the driver
+		return os.Remove(dsn)
+	}
+
+	return nil
+}
+
+func configurePool(db *sql.DB, o StorageOptions) {
+	if o.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	}
+
+	if o.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(o.MaxIdleConns)
+	}
+
+	if o.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
+}
+
+func newStorage(o StorageOptions, clock Clock) (*storage, error) {
 	if o.DriverName == "" {
-		o.DriverName = DefaultDriverName
+		o.DriverName = detectDriver(o.DataSourceName)
 	}
 
 	if o.DataSourceName == "" {
 		o.DataSourceName = DefaultDataSourceName
 	}
 
+	var statementTimeout time.Duration
+	if o.StatementTimeout > 0 {
+		if o.DriverName == postgres {
+			dsn, err := withStatementTimeout(o.DataSourceName, o.StatementTimeout)
+			if err != nil {
+				return nil, err
+			}
+
+			o.DataSourceName = dsn
+		} else {
+			statementTimeout = o.StatementTimeout
+		}
+	}
+
 	var initDB bool
 	if o.DriverName == sqlite {
 		if _, err := os.Stat(o.DataSourceName); os.IsNotExist(err) {
@@ -75,101 +302,990 @@ func newStorage(o StorageOptions) (*storage, error) {
 		} else if err != nil {
 			return nil, err
 		}
+
+		if err := checkWritable(o.DataSourceName); err != nil {
+			return nil, err
+		}
 	}
 
-	db, err := sql.Open(o.DriverName, o.DataSourceName)
+	dsn := o.DataSourceName
+	if o.DriverName == sqlite {
+		dsn = withSQLiteParams(dsn, o.SQLiteJournalMode, o.SQLiteBusyTimeout)
+	}
+
+	db, err := sql.Open(o.DriverName, dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	c := getCommands(o.DriverName)
+	configurePool(db, o)
+
+	s, err := initStorage(db, o, initDB, statementTimeout, clock)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s.ownsDB = true
+	return s, nil
+}
+
+// NewStorageFromDB creates the default SQL storage using a database handle opened and owned by the caller,
+// e.g. to share it, or to instrument it. Of the options, DriverName selects the commands for the database,
+// and defaults to sqlite3. ConflictColumns, MaxQueryParameters and StartupRetry are applied the same way as
+// by the storage created by New(). StatementTimeout is applied as a deadline around each statement, for both
+// drivers, and the connection, pool and sqlite3 options are ignored. The tags table needs to exist, like when using
+// PostgreSQL, see sql/create-db.sql, while the columns missing from the databases created by earlier versions
+// are added. Closing the storage doesn't close the database handle.
+func NewStorageFromDB(db *sql.DB, o StorageOptions) (Storage, error) {
+	if o.DriverName == "" {
+		o.DriverName = sqlite
+	}
+
+	return initStorage(db, o, false, o.StatementTimeout, realClock{})
+}
+
+// initStorage prepares an open database for the storage. It creates the schema of a new database, or
+// migrates an existing one.
+func initStorage(db *sql.DB, o StorageOptions, initDB bool, statementTimeout time.Duration, clock Clock) (*storage, error) {
+	if o.MaxQueryParameters <= 0 {
+		o.MaxQueryParameters = sqliteMaxParameters
+		if o.DriverName == postgres {
+			o.MaxQueryParameters = postgresMaxParameters
+		}
+	}
+
+	if o.StartupRetry.Attempts > 0 {
+		if err := retryPing(db.Ping, o.StartupRetry, time.Sleep); err != nil {
+			return nil, err
+		}
+	}
+
+	c := getCommands(o)
 
 	if initDB {
 		if _, err := db.Exec(c.createDB); err != nil {
-			db.Close()
 			return nil, err
 		}
+	} else if err := migrate(db, c, clock.Now()); err != nil {
+		return nil, err
+	}
+
+	// the scores table is created on every startup, when missing, both for new and for existing databases
+	if _, err := db.Exec(c.createScores); err != nil {
+		return nil, err
 	}
 
 	return &storage{
-		db:       db,
-		commands: c,
+		db:        db,
+		commands:  c,
+		now:       clock.Now,
+		maxParams: o.MaxQueryParameters,
+
+		statementTimeout: statementTimeout,
 	}, nil
 }
 
+// retryPing calls ping until it succeeds, or the attempts are exhausted, and returns the last error.
+func retryPing(ping func() error, r StartupRetry, sleep func(time.Duration)) error {
+	var err error
+	for i := 0; i < r.Attempts; i++ {
+		if i > 0 {
+			sleep(r.Interval)
+		}
+
+		if err = ping(); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// withStatementTimeout sets the statement_timeout run-time parameter, in milliseconds, in a PostgreSQL
+// connection string, so that the server applies it to every connection. It accepts both the URL and the
+// key-value forms.
+func withStatementTimeout(dsn string, d time.Duration) (string, error) {
+	ms := int64(d / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+
+	if isPostgresURL(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+
+		q := u.Query()
+		q.Set("statement_timeout", strconv.FormatInt(ms, 10))
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	return strings.TrimSpace(fmt.Sprintf("%s statement_timeout=%d", dsn, ms)), nil
+}
+
+// withSQLiteParams sets the journal mode and the busy timeout, in milliseconds, as sqlite3 connection
+// parameters, so that the driver applies them to every connection.
+func withSQLiteParams(dsn string, journalMode string, busyTimeout time.Duration) string {
+	var params []string
+	if journalMode != "" {
+		params = append(params, "_journal_mode="+url.QueryEscape(journalMode))
+	}
+
+	if busyTimeout > 0 {
+		ms := int64(busyTimeout / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+
+		params = append(params, "_busy_timeout="+strconv.FormatInt(ms, 10))
+	}
+
+	if len(params) == 0 {
+		return dsn
+	}
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+
+	return dsn + sep + strings.Join(params, "&")
+}
+
+// statementContext returns the context of a single statement, or of a single transaction.
+func (s *storage) statementContext() (context.Context, context.CancelFunc) {
+	if s.statementTimeout <= 0 {
+		return context.Background(), func() {}
+	}
+
+	return context.WithTimeout(context.Background(), s.statementTimeout)
+}
+
+func inParams(args []string) (string, []interface{}) {
+	params := make([]string, len(args))
+	paramArgs := make([]interface{}, len(args))
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+		paramArgs[i] = args[i]
+	}
+
+	return strings.Join(params, ", "), paramArgs
+}
+
+// Get queries the associations of the tags in chunks, so that a single query doesn't exceed the parameter
+// limit of the driver. One parameter of each query is taken by the current time.
 func (s *storage) Get(tags []string) ([]*Entry, error) {
+	return s.getMaxIndex(tags, nil)
+}
+
+// GetMaxIndex queries the associations the same way as Get(), with an additional condition on the tag index
+// of each constrained tag. Two parameters of each query are taken by every constraint.
+func (s *storage) GetMaxIndex(tags []string, maxIndex map[string]int) ([]*Entry, error) {
+	return s.getMaxIndex(tags, maxIndex)
+}
+
+func (s *storage) getMaxIndex(tags []string, maxIndex map[string]int) ([]*Entry, error) {
+	chunk := s.maxParams - 1 - 2*len(maxIndex)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	if len(tags) <= chunk {
+		return s.getChunk(tags, maxIndex, s.now())
+	}
+
+	// the same tag in two chunks would return its associations twice
+	tags = uniqueTags(tags)
+
+	var (
+		e   []*Entry
+		now = s.now()
+	)
+
+	for i := 0; i < len(tags); i += chunk {
+		end := i + chunk
+		if end > len(tags) {
+			end = len(tags)
+		}
+
+		ei, err := s.getChunk(tags[i:end], maxIndex, now)
+		if err != nil {
+			return nil, err
+		}
+
+		e = append(e, ei...)
+	}
+
+	return e, nil
+}
+
+func uniqueTags(tags []string) []string {
+	var (
+		unique []string
+		seen   = make(map[string]bool)
+	)
+
+	for _, t := range tags {
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+
+	return unique
+}
+
+// maxIndexConditions returns the conditions excluding the associations of the constrained tags above their
+// maximum tag index, and appends their parameters to the arguments. Only the constraints of the queried tags
+// are included.
+func maxIndexConditions(tags []string, maxIndex map[string]int, args []interface{}) (string, []interface{}) {
+	var conditions []string
+	for _, tag := range uniqueTags(tags) {
+		limit, ok := maxIndex[tag]
+		if !ok {
+			continue
+		}
+
+		args = append(args, tag, limit)
+		conditions = append(conditions, fmt.Sprintf("not (tag = $%d and tag_index > $%d)", len(args)-1, len(args)))
+	}
+
+	return strings.Join(conditions, " and "), args
+}
+
+func (s *storage) getChunk(tags []string, maxIndex map[string]int, now time.Time) ([]*Entry, error) {
 	if len(tags) == 0 {
 		return nil, nil
 	}
 
-	params := make([]string, len(tags))
-	paramArgs := make([]interface{}, len(tags))
-	for i := range params {
-		params[i] = fmt.Sprintf("$%d", i+1)
-		paramArgs[i] = tags[i]
+	paramString, paramArgs := inParams(tags)
+	paramArgs = append(paramArgs, now.UnixNano())
+	query := fmt.Sprintf(s.commands.getEntries, paramString, len(paramArgs))
+	if conditions, args := maxIndexConditions(tags, maxIndex, paramArgs); conditions != "" {
+		query = fmt.Sprintf(s.commands.getEntriesMax, paramString, len(paramArgs), conditions)
+		paramArgs = args
 	}
 
-	paramString := strings.Join(params, ", ")
-	r, err := s.db.Query(fmt.Sprintf(s.commands.getEntries, paramString), paramArgs...)
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, query, paramArgs...)
 	if err != nil {
 		return nil, err
 	}
 
+	return scanEntries(r)
+}
+
+func scanEntries(r *sql.Rows) ([]*Entry, error) {
 	var e []*Entry
+	if err := scanEach(r, func(ei *Entry) error {
+		e = append(e, ei)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// scanEach calls f for every entry, as the rows are read, and stops when f returns an error.
+func scanEach(r *sql.Rows, f func(*Entry) error) error {
+	defer r.Close()
+
 	for r.Next() {
 		var (
 			tag, value string
 			tagIndex   int
+			expiresAt  sql.NullInt64
+			weight     sql.NullFloat64
 		)
 
-		if err := r.Scan(&tag, &value, &tagIndex); err != nil {
-			return nil, err
+		if err := r.Scan(&tag, &value, &tagIndex, &expiresAt, &weight); err != nil {
+			return err
 		}
 
-		e = append(e, &Entry{
+		ei := &Entry{
 			Tag:      tag,
 			Value:    value,
 			TagIndex: tagIndex,
-		})
+		}
+
+		if expiresAt.Valid {
+			ei.Expires = time.Unix(0, expiresAt.Int64)
+		}
+
+		if weight.Valid {
+			ei.Weight = weight.Float64
+		}
+
+		if err := f(ei); err != nil {
+			return err
+		}
 	}
 
-	return e, nil
+	return r.Err()
+}
+
+func scanStrings(r *sql.Rows) ([]string, error) {
+	defer r.Close()
+
+	var v []string
+	for r.Next() {
+		var vi string
+		if err := r.Scan(&vi); err != nil {
+			return nil, err
+		}
+
+		v = append(v, vi)
+	}
+
+	return v, r.Err()
 }
 
 func (s *storage) GetTags(value string) ([]string, error) {
-	r, err := s.db.Query(s.commands.getTags, value)
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.getTags, value, s.now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(r)
+}
+
+func (s *storage) GetValueEntries(value string) ([]*Entry, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.getValueEntries, value, s.now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	return scanEntries(r)
+}
+
+// likePrefix escapes the wildcards of a prefix for the like operator, and appends the trailing wildcard.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
+func (s *storage) GetByTagPrefix(prefix string) ([]*Entry, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.getPrefixEntries, likePrefix(prefix), s.now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := scanEntries(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite matches like case-insensitively
+	var matching []*Entry
+	for _, ei := range e {
+		if strings.HasPrefix(ei.Tag, prefix) {
+			matching = append(matching, ei)
+		}
+	}
+
+	return matching, nil
+}
+
+func (s *storage) StreamAll(f func(*Entry) error) error {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.getAllEntries, s.now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return scanEach(r, f)
+}
+
+func (s *storage) ValuesMissingTag(tag string) ([]string, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.getValuesMissing, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(r)
+}
+
+// TagCountForValues counts the tags in chunks of values, where one parameter of each query is taken by the
+// current time. The expired associations are not counted.
+func (s *storage) TagCountForValues(values []string) (map[string]int, error) {
+	c := make(map[string]int)
+	chunk := s.maxParams - 1
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	// the same value in two chunks would be counted twice
+	values = uniqueTags(values)
+	now := s.now()
+	for i := 0; i < len(values); i += chunk {
+		end := i + chunk
+		if end > len(values) {
+			end = len(values)
+		}
+
+		if err := s.tagCounts(values[i:end], now, c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (s *storage) tagCounts(values []string, now time.Time, c map[string]int) error {
+	paramString, paramArgs := inParams(values)
+	paramArgs = append(paramArgs, now.UnixNano())
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	query := fmt.Sprintf(s.commands.getTagCounts, paramString, len(paramArgs))
+	r, err := s.db.QueryContext(ctx, query, paramArgs...)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+	for r.Next() {
+		var (
+			value string
+			count int
+		)
+
+		if err := r.Scan(&value, &count); err != nil {
+			return err
+		}
+
+		c[value] += count
+	}
+
+	return r.Err()
+}
+
+func (s *storage) GetRanked(tags []string, limit int) ([]RankedValue, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	requestIndex := make(map[string]int)
+	var unique []string
+	for i, t := range tags {
+		if _, ok := requestIndex[t]; !ok {
+			unique = append(unique, t)
+		}
+
+		requestIndex[t] = i
+	}
+
+	paramString, paramArgs := inParams(unique)
+	cases := make([]string, len(unique))
+	for i, t := range unique {
+		cases[i] = fmt.Sprintf("when $%d then %d", i+1, requestIndex[t])
+	}
+
+	paramArgs = append(paramArgs, s.now().UnixNano())
+	nowParam := len(paramArgs)
+
+	var limitClause string
+	if limit > 0 {
+		paramArgs = append(paramArgs, limit)
+		limitClause = fmt.Sprintf("limit $%d", len(paramArgs))
+	}
+
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(
+		ctx,
+		fmt.Sprintf(s.commands.getRanked, strings.Join(cases, " "), paramString, nowParam, limitClause),
+		paramArgs...,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	var v []RankedValue
+	for r.Next() {
+		var rv RankedValue
+		if err := r.Scan(&rv.Value, &rv.MatchCount, &rv.IndexDelta); err != nil {
+			return nil, err
+		}
+
+		v = append(v, rv)
+	}
+
+	return v, r.Err()
+}
+
+// maximum number of value-tag pairs checked in a single query, to stay below the parameter limit of the
+// database drivers
+const maxPairsPerQuery = 400
+
+func (s *storage) hasPairs(pairs []Entry, exists map[Entry]bool) error {
+	conditions := make([]string, len(pairs))
+	args := make([]interface{}, 0, 2*len(pairs))
+	for i, p := range pairs {
+		conditions[i] = fmt.Sprintf("(tag = $%d and value = $%d)", 2*i+1, 2*i+2)
+		args = append(args, p.Tag, p.Value)
+	}
+
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, fmt.Sprintf(s.commands.getPairs, strings.Join(conditions, " or ")), args...)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+	for r.Next() {
+		var p Entry
+		if err := r.Scan(&p.Tag, &p.Value); err != nil {
+			return err
+		}
+
+		exists[p] = true
+	}
+
+	return r.Err()
+}
+
+func (s *storage) HasMany(pairs []Entry) (map[Entry]bool, error) {
+	exists := make(map[Entry]bool)
+	for i := 0; i < len(pairs); i += maxPairsPerQuery {
+		end := i + maxPairsPerQuery
+		if end > len(pairs) {
+			end = len(pairs)
+		}
+
+		if err := s.hasPairs(pairs[i:end], exists); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make(map[Entry]bool, len(pairs))
+	for _, p := range pairs {
+		result[p] = exists[Entry{Value: p.Value, Tag: p.Tag}]
+	}
+
+	return result, nil
+}
+
+func (s *storage) ListTagsPage(cursor string, limit int) ([]string, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.getTagsPage, cursor, limit)
 	if err != nil {
 		return nil, err
 	}
 
-	var tags []string
+	return scanStrings(r)
+}
+
+func (s *storage) ListTags() ([]string, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.listTags)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(r)
+}
+
+func (s *storage) CountTag(tag string) (int, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, s.commands.countTag, tag, s.now().UnixNano()).Scan(&count)
+	return count, err
+}
+
+func (s *storage) TagCooccurrence(minCount int) ([]TagPairCount, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.getCooccurrence, minCount)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	var c []TagPairCount
 	for r.Next() {
-		var tag string
-		if err := r.Scan(&tag); err != nil {
+		var pc TagPairCount
+		if err := r.Scan(&pc.Left, &pc.Right, &pc.Count); err != nil {
 			return nil, err
 		}
 
-		tags = append(tags, tag)
+		c = append(c, pc)
 	}
 
-	return tags, err
+	return c, r.Err()
+}
+
+func (s *storage) TagFrequency(n int) ([]TagCount, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	r, err := s.db.QueryContext(ctx, s.commands.getTagFrequency, n)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	var c []TagCount
+	for r.Next() {
+		var tc TagCount
+		if err := r.Scan(&tc.Tag, &tc.Count); err != nil {
+			return nil, err
+		}
+
+		c = append(c, tc)
+	}
+
+	return c, r.Err()
+}
+
+func (s *storage) insertArgs(e *Entry) []interface{} {
+	var expiresAt sql.NullInt64
+	if !e.Expires.IsZero() {
+		expiresAt = sql.NullInt64{Int64: e.Expires.UnixNano(), Valid: true}
+	}
+
+	var weight sql.NullFloat64
+	if e.Weight != 0 {
+		weight = sql.NullFloat64{Float64: e.Weight, Valid: true}
+	}
+
+	return []interface{}{e.Tag, e.Value, e.TagIndex, s.now().UnixNano(), expiresAt, weight}
 }
 
 func (s *storage) Set(e *Entry) error {
-	_, err := s.db.Exec(s.commands.insertEntry, e.Tag, e.Value, e.TagIndex)
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.commands.insertEntry, s.insertArgs(e)...)
 	return err
 }
 
+func (s *storage) WriteBatch(set, remove []*Entry) error {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, e := range set {
+		if _, err := tx.Exec(s.commands.insertEntry, s.insertArgs(e)...); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range remove {
+		if _, err := tx.Exec(s.commands.deleteEntry, e.Tag, e.Value); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *storage) ReplaceTag(tag string, e []*Entry) error {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.commands.deleteTag, tag); err != nil {
+		return err
+	}
+
+	for _, ei := range e {
+		if _, err := tx.Exec(s.commands.insertEntry, s.insertArgs(ei)...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (s *storage) Remove(e *Entry) error {
-	_, err := s.db.Exec(s.commands.deleteEntry, e.Tag, e.Value)
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.commands.deleteEntry, e.Tag, e.Value)
 	return err
 }
 
 func (s *storage) Delete(tag string) error {
-	_, err := s.db.Exec(s.commands.deleteTag, tag)
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.commands.deleteTag, tag)
 	return err
 }
 
+func (s *storage) MergeTags(source, dest string, p MergePolicy) error {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var updateIndex string
+	switch p {
+	case KeepSourceIndex:
+		updateIndex = s.commands.mergeSourceIndex
+	case KeepMinIndex:
+		updateIndex = s.commands.mergeMinIndex
+	}
+
+	if updateIndex != "" {
+		if _, err := tx.Exec(updateIndex, source, dest); err != nil {
+			return err
+		}
+	}
+
+	// the expired associations of the source are not moved, and the moved ones keep their expiration
+	if _, err := tx.Exec(s.commands.mergeInsert, source, dest, s.now().UnixNano()); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(s.commands.deleteTag, source); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *storage) DeleteOlderThan(t time.Time) ([]string, int, error) {
+	return s.deleteBefore(s.commands.getTagsOlderThan, s.commands.deleteOlderThan, t)
+}
+
+func (s *storage) DeleteExpired(now time.Time) ([]string, int, error) {
+	return s.deleteBefore(s.commands.getExpiredTags, s.commands.deleteExpired, now)
+}
+
+func (s *storage) StoresWeight() {}
+
+// deleteBefore deletes the associations selected by a timestamp, and returns their tags, in a single
+// transaction.
+func (s *storage) deleteBefore(getTags, deleteEntries string, t time.Time) ([]string, int, error) {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer tx.Rollback()
+
+	r, err := tx.Query(getTags, t.UnixNano())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tags, err := scanStrings(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result, err := tx.Exec(deleteEntries, t.UnixNano())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+
+	return tags, int(n), nil
+}
+
+// DeleteValues deletes the associations of the values, and returns their tags, in a single transaction. The
+// values are deleted in chunks that fit the parameter limit of the driver.
+func (s *storage) DeleteValues(values []string) ([]string, int, error) {
+	if len(values) == 0 {
+		return nil, 0, nil
+	}
+
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer tx.Rollback()
+
+	chunk := s.maxParams
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	var (
+		tags []string
+		n    int64
+		seen = make(map[string]bool)
+	)
+
+	for i := 0; i < len(values); i += chunk {
+		end := i + chunk
+		if end > len(values) {
+			end = len(values)
+		}
+
+		paramString, paramArgs := inParams(values[i:end])
+		r, err := tx.Query(fmt.Sprintf(s.commands.getValuesTags, paramString), paramArgs...)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		chunkTags, err := scanStrings(r)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, tag := range chunkTags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+
+		result, err := tx.Exec(fmt.Sprintf(s.commands.deleteValues, paramString), paramArgs...)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		chunkCount, err := result.RowsAffected()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n += chunkCount
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+
+	return tags, int(n), nil
+}
+
+func (s *storage) IncrementScore(value string, by int) error {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.commands.initScore, value); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(s.commands.incrementScore, value, by); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *storage) GetScores(values []string) (map[string]int, error) {
+	scores := make(map[string]int)
+	for i := 0; i < len(values); i += s.maxParams {
+		end := i + s.maxParams
+		if end > len(values) {
+			end = len(values)
+		}
+
+		if err := s.getScores(values[i:end], scores); err != nil {
+			return nil, err
+		}
+	}
+
+	return scores, nil
+}
+
+func (s *storage) getScores(values []string, scores map[string]int) error {
+	ctx, cancel := s.statementContext()
+	defer cancel()
+
+	paramString, paramArgs := inParams(values)
+	r, err := s.db.QueryContext(ctx, fmt.Sprintf(s.commands.getScores, paramString), paramArgs...)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+	for r.Next() {
+		var (
+			value string
+			score int
+		)
+
+		if err := r.Scan(&value, &score); err != nil {
+			return err
+		}
+
+		scores[value] = score
+	}
+
+	return r.Err()
+}
+
 func (s *storage) Close() {
-	s.db.Close()
+	if s.ownsDB {
+		s.db.Close()
+	}
 }
@@ -0,0 +1,26 @@
+package tagstash_test
+
+import (
+	"testing"
+
+	"github.com/aryszka/tagstash"
+	"github.com/aryszka/tagstash/tagstashtest"
+)
+
+func TestStorageContract(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		tagstashtest.RunStorageTests(t, tagstash.NewTestStorage)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		tagstashtest.RunStorageTests(t, tagstash.NewTestBoltStorage)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		tagstashtest.RunStorageTests(t, tagstash.NewMemoryStorage)
+	})
+
+	t.Run("mock", func(t *testing.T) {
+		tagstashtest.RunStorageTests(t, tagstash.NewMockStorage)
+	})
+}
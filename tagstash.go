@@ -3,6 +3,9 @@ package tagstash
 import (
 	"errors"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Entry represents a value-tag associaction.
@@ -17,14 +20,298 @@ type Entry struct {
 	// TagIndex marks how strong strong a tag describes a value.
 	TagIndex int
 
-	requestTagMatch, requestIndexDelta int
+	// Expires, when set, is the time after which the association is not returned anymore. Only
+	// storages implementing ExpiringStorage store the expiration.
+	Expires time.Time
+
+	// Weight defines how much a matching tag counts in the ranking. Zero means the default weight, 1. Only
+	// storages implementing WeightStorage store the weight.
+	Weight float64
+
+	requestTagMatch, requestIndexDelta, requestScore int
+	requestWeight, requestMatchWeight                float64
+}
+
+// MatchCount returns how many query tags the value of an entry matched. It is set only on the entries
+// returned by the queries.
+func (e *Entry) MatchCount() int { return e.requestTagMatch }
+
+// IndexDelta returns the sum of the differences between the positions of the matched tags in the query and
+// their tag index. It is set only on the entries returned by the queries.
+func (e *Entry) IndexDelta() int { return e.requestIndexDelta }
+
+// MatchWeight returns the sum of the weights of the associations matching the query tags. With the default
+// weights, it equals MatchCount(). It is set only on the entries returned by the queries.
+func (e *Entry) MatchWeight() float64 { return e.requestMatchWeight }
+
+func (e *Entry) weight() float64 {
+	if e.Weight == 0 {
+		return 1
+	}
+
+	return e.Weight
 }
 
+// Score returns the score of the value of an entry, set with IncrementScore(). It is set only on the entries
+// returned by the queries, when the RankByScore option is enabled.
+func (e *Entry) Score() int { return e.requestScore }
+
 // TagLookup when implemented by a storage, can return all tags associated with a value.
 type TagLookup interface {
 	GetTags(string) ([]string, error)
 }
 
+// ValueEntryLookup when implemented by a storage, can return all the associations of a value.
+type ValueEntryLookup interface {
+
+	// GetValueEntries returns the associations of a value, ordered by the tag index, and by the tag when
+	// the tag index is the same.
+	GetValueEntries(value string) ([]*Entry, error)
+}
+
+// ValueDeleter when implemented by a storage, can delete all the associations of multiple values at once.
+type ValueDeleter interface {
+
+	// DeleteValues deletes all the associations of the provided values, in a single transaction. It
+	// returns the distinct tags of the deleted associations, and the number of the deleted associations.
+	DeleteValues(values []string) ([]string, int, error)
+}
+
+// TagReplacer when implemented by a storage, can replace all the associations of a tag at once.
+type TagReplacer interface {
+
+	// ReplaceTag deletes all the associations of a tag, and stores the provided entries, all of the same
+	// tag, in a single transaction.
+	ReplaceTag(tag string, e []*Entry) error
+}
+
+// EntryStreamer when implemented by a storage, can iterate over all the stored associations.
+type EntryStreamer interface {
+
+	// StreamAll calls f for every association, ordered by the value, then by the tag index, and by the tag
+	// when the tag index is the same. The associations are read as they are iterated, without loading them
+	// all first. It stops, and returns the error, when f returns an error.
+	StreamAll(f func(*Entry) error) error
+}
+
+// TagCountLookup when implemented by a storage, can return the number of tags associated with values.
+type TagCountLookup interface {
+
+	// TagCountForValues returns the number of distinct tags associated with each of the provided values, not
+	// counting the expired associations. Values without associations may be missing from the result.
+	TagCountForValues([]string) (map[string]int, error)
+}
+
+// BatchWriter when implemented by a storage, can store and remove multiple associations in a single
+// transaction.
+type BatchWriter interface {
+
+	// WriteBatch stores the associations in set, the same way as Set(), and removes the associations in
+	// remove, all or none of them.
+	WriteBatch(set, remove []*Entry) error
+}
+
+// ScoreStorage when implemented by a storage, maintains a score per value, e.g. a popularity counter.
+type ScoreStorage interface {
+
+	// IncrementScore adds to the score of a value. The score of a value starts from zero.
+	IncrementScore(value string, by int) error
+
+	// GetScores returns the scores of the provided values. Values without a score may be missing from the
+	// result.
+	GetScores([]string) (map[string]int, error)
+}
+
+// MissingTagLookup when implemented by a storage, can return the values that are not associated with a tag.
+type MissingTagLookup interface {
+	ValuesMissingTag(string) ([]string, error)
+}
+
+// TagCount holds the number of values associated with a tag.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// TagPosition holds a query tag matched by a value, and the tag index of its association with the value.
+type TagPosition struct {
+	Tag   string
+	Index int
+}
+
+// ValuePositions holds a value matching a query, and the query tags that it matched.
+type ValuePositions struct {
+	Value string
+
+	// Positions contains the matched query tags, in the order of the query, with their tag index.
+	Positions []TagPosition
+}
+
+// RankedValue holds a value matching a query, with the measures used for its ranking.
+type RankedValue struct {
+
+	// Value is the matching value.
+	Value string
+
+	// Rank is the 1-based position of the value in the result. It is set by TagStash.GetRanked(), and not
+	// by the RankedLookup storage implementations.
+	Rank int
+
+	// MatchCount is the number of query tags associated with the value.
+	MatchCount int
+
+	// IndexDelta is the sum of the differences between the position of the matching tags in the query and
+	// their tag index.
+	IndexDelta int
+}
+
+// RankedLookup when implemented by a storage, can rank the values matching a set of tags without returning
+// all the matching associations.
+type RankedLookup interface {
+
+	// GetRanked returns at most limit values matching the tags, in the same order as tagstash ranks them,
+	// where values lower than 1 mean no limit. When a tag appears multiple times in the query, its last
+	// position is used.
+	GetRanked(tags []string, limit int) ([]RankedValue, error)
+}
+
+// IndexLimitedLookup when implemented by a storage, can filter the associations of a tag by their tag index.
+type IndexLimitedLookup interface {
+
+	// GetMaxIndex returns the entries whose tag is listed in the arguments, the same way as Get(), except
+	// for the associations of the tags in maxIndex whose tag index is greater than the maximum of their tag.
+	GetMaxIndex(tags []string, maxIndex map[string]int) ([]*Entry, error)
+}
+
+// TagPairCount holds the number of values associated with both tags of a pair.
+type TagPairCount struct {
+	Left, Right string
+	Count       int
+}
+
+// CooccurrenceLookup when implemented by a storage, can count how often pairs of tags are associated with the
+// same value.
+type CooccurrenceLookup interface {
+
+	// TagCooccurrence returns the tag pairs associated with at least minCount common values, in descending
+	// order of the count. In each pair, the left tag is lower than the right one.
+	TagCooccurrence(minCount int) ([]TagPairCount, error)
+}
+
+// PairLookup when implemented by a storage, can check the existence of many value-tag associations at once.
+type PairLookup interface {
+
+	// HasMany returns for each provided entry whether the association of its value and tag exists,
+	// regardless of the tag index. The keys of the result are the provided entries.
+	HasMany([]Entry) (map[Entry]bool, error)
+}
+
+// MergePolicy defines the tag index of a value that is associated with both tags when merging tags.
+type MergePolicy int
+
+const (
+	// KeepDestIndex keeps the tag index of the destination tag. This is the default.
+	KeepDestIndex MergePolicy = iota
+
+	// KeepSourceIndex uses the tag index of the source tag.
+	KeepSourceIndex
+
+	// KeepMinIndex uses the lower of the two tag indexes.
+	KeepMinIndex
+)
+
+// TagMerger when implemented by a storage, can move the associations of a tag to another tag.
+type TagMerger interface {
+
+	// MergeTags associates the values of the source tag with the destination tag, and deletes the
+	// source tag, in a single transaction. The values associated with both tags get the tag index
+	// defined by the policy.
+	MergeTags(source, dest string, p MergePolicy) error
+}
+
+// TagEnumerator when implemented by a storage, can list all the stored tags.
+type TagEnumerator interface {
+
+	// ListTags returns the distinct stored tags, in ascending order.
+	ListTags() ([]string, error)
+}
+
+// TagPrefixLookup when implemented by a storage, can find the associations of the tags starting with a prefix.
+type TagPrefixLookup interface {
+
+	// GetByTagPrefix returns all the associations of the tags that start with the prefix, matched case
+	// sensitively, not including the expired associations.
+	GetByTagPrefix(prefix string) ([]*Entry, error)
+}
+
+// TagCounter when implemented by a storage, can count the values of a tag without reading them.
+type TagCounter interface {
+
+	// CountTag returns the number of values associated with a tag, not counting the expired associations.
+	CountTag(tag string) (int, error)
+}
+
+// TagPager when implemented by a storage, can list the stored tags page by page.
+type TagPager interface {
+
+	// ListTagsPage returns at most limit tags, in ascending order, that are greater than the cursor.
+	ListTagsPage(cursor string, limit int) ([]string, error)
+}
+
+// ExpiringStorage when implemented by a storage, stores the expiration of the associations, doesn't return the
+// expired associations from Get() and GetTags(), and can delete them. The other lookups may include the
+// expired associations until they are deleted.
+type ExpiringStorage interface {
+
+	// DeleteExpired deletes the associations that expired before or at the provided time. It returns the
+	// tags of the deleted associations, and the number of the deleted associations.
+	DeleteExpired(time.Time) ([]string, int, error)
+}
+
+// WeightStorage when implemented by a storage, stores the weight of the associations, and returns it from the
+// lookups.
+type WeightStorage interface {
+
+	// StoresWeight marks the storages storing the weights. It is not called by tagstash.
+	StoresWeight()
+}
+
+// WeightedTag holds a tag and the weight of its association with a value.
+type WeightedTag struct {
+	Tag    string
+	Weight float64
+}
+
+// TagTTL holds a tag and the TTL of its association with a value.
+type TagTTL struct {
+	Tag string
+	TTL time.Duration
+}
+
+// ValueTags holds a value and its ordered tags, to be stored with SetBatch().
+type ValueTags struct {
+	Value string
+	Tags  []string
+}
+
+// TagFrequencyLookup when implemented by a storage, can return the most frequently used tags.
+type TagFrequencyLookup interface {
+
+	// TagFrequency returns at most n tags with the highest number of associated values, in descending
+	// order of the number of values.
+	TagFrequency(n int) ([]TagCount, error)
+}
+
+// AgeCleaner when implemented by a storage, can delete the associations created before a point in time.
+type AgeCleaner interface {
+
+	// DeleteOlderThan deletes the associations created before the provided time. The creation time of an
+	// association is set when it is first stored, and it is not changed when it is updated. Associations
+	// without a known creation time are not deleted. It returns the tags of the deleted associations, and
+	// the number of the deleted associations.
+	DeleteOlderThan(time.Time) ([]string, int, error)
+}
+
 // Storage implementations store value-tag associations.
 type Storage interface {
 
@@ -45,11 +332,68 @@ type Storage interface {
 	Close()
 }
 
+// Cache implementations hold the value-tag associations of the most often queried tags. Unlike a storage, a
+// cache is not the source of truth, it is allowed to lose the associations of a tag at any time. Tagstash
+// reads from the persistent storage only those tags whose associations are not returned by the cache.
+type Cache interface {
+
+	// Get returns the cached entries whose tag is listed in the arguments. It never reads from the
+	// persistent storage. For every tag, it returns either all the associations written to the cache, or
+	// none of them, except for the associations whose expiration, when set, has passed.
+	Get([]string) ([]*Entry, error)
+
+	// Set caches a value-tag association, or updates the tag index of an existing one. Tagstash calls it
+	// either to cache the associations of a tag read from the storage, one by one, or to update a tag whose
+	// associations are already cached. It doesn't call it with a tag that is not cached, so that the cache
+	// never holds an incomplete list of associations for a tag.
+	Set(*Entry) error
+
+	// Remove drops a single value-tag association from the cache.
+	Remove(*Entry) error
+
+	// Delete drops all the associations of the provided tag from the cache.
+	Delete(string) error
+
+	// Close releases any resources taken by the cache implementation.
+	Close()
+}
+
+// CacheTagLister when implemented by a cache, can list the tags held by the cache.
+type CacheTagLister interface {
+
+	// CachedTags returns the tags that have associations in the cache. It may return tags that were
+	// already dropped from the cache.
+	CachedTags() []string
+}
+
+// CacheStats holds the counters of a cache, since it was created.
+type CacheStats struct {
+
+	// Hits is the number of the tags found in the cache when reading it.
+	Hits int64
+
+	// Misses is the number of the tags not found in the cache when reading it.
+	Misses int64
+
+	// EntriesWritten is the number of the associations written to the cache.
+	EntriesWritten int64
+
+	// WriteFailures is the number of the failed writes of a tag, e.g. because its associations didn't fit in
+	// the cache.
+	WriteFailures int64
+}
+
+// CacheStatsReporter when implemented by a cache, can report its counters. The default cache implements it.
+type CacheStatsReporter interface {
+	CacheStats() CacheStats
+}
+
 // StorageOptions are used by the default storage implementation.
 type StorageOptions struct {
 
-	// DriverName specifies which data base driver to use. Currently supported: postgres, sqlite3. The
-	// default value is sqlite3.
+	// DriverName specifies which data base driver to use. Currently supported: postgres, sqlite3. When not
+	// set, postgres is used if DataSourceName is a PostgreSQL URL (postgres:// or postgresql://), or a
+	// connection string with both host= and dbname=, otherwise sqlite3.
 	DriverName string
 
 	// DataSourceName specifies the data source for the storage. In case of postgresql, it is the postgresql
@@ -59,22 +403,260 @@ type StorageOptions struct {
 	// When PostgreSQL is used, please refer to the driver implementation's documentation for configuration
 	// details: https://github.com/lib/pq.
 	DataSourceName string
+
+	// ConflictColumns lists the columns of the unique index used as the conflict target, when storing an
+	// association that already exists in PostgreSQL. It allows the upsert to work with a custom schema,
+	// regardless of how the unique constraint is named. The default is tag, value. It is ignored with
+	// sqlite3.
+	ConflictColumns []string
+
+	// MaxQueryParameters limits the number of parameters used by a single query. When getting the
+	// associations of more tags than fit in one query, the tags are split across multiple queries. The
+	// default is 999 for sqlite3, and 65535 for PostgreSQL.
+	MaxQueryParameters int
+
+	// StatementTimeout sets the maximum time that a single storage statement can run. With PostgreSQL, it is
+	// set as the statement_timeout of the connections, and the server aborts the statements running longer.
+	// With sqlite3, it is applied as a deadline around each statement, or around each transaction for the
+	// operations that use one. The default is no timeout.
+	StatementTimeout time.Duration
+
+	// StartupRetry, when set, makes the storage wait for the database to become reachable on startup,
+	// e.g. when tagstash starts before PostgreSQL is ready.
+	StartupRetry StartupRetry
+
+	// MaxOpenConns limits the number of the open connections to the database. Zero keeps the default of
+	// database/sql, no limit.
+	MaxOpenConns int
+
+	// MaxIdleConns limits the number of the idle connections kept open. Zero keeps the default of
+	// database/sql, while a negative value means that no idle connections are kept.
+	MaxIdleConns int
+
+	// ConnMaxLifetime sets the maximum time that a connection is reused. Zero keeps the default of
+	// database/sql, no limit.
+	ConnMaxLifetime time.Duration
+
+	// SQLiteJournalMode sets the journal mode of the sqlite3 connections, e.g. WAL, which lets the queries
+	// run while another connection writes. The WAL mode is kept by the database file, and it creates the
+	// -wal and -shm files next to it. Empty keeps the mode of the file, by default DELETE. It is ignored
+	// with PostgreSQL.
+	SQLiteJournalMode string
+
+	// SQLiteBusyTimeout sets how long a sqlite3 statement waits for a lock held by another connection,
+	// before failing with "database is locked". It is set for every connection. The default is no waiting.
+	// It is ignored with PostgreSQL.
+	SQLiteBusyTimeout time.Duration
+}
+
+// StartupRetry defines how many times the storage tries to reach the database on startup, and how long it
+// waits between the attempts.
+type StartupRetry struct {
+
+	// Attempts sets the maximum number of connection attempts. Values lower than 1 mean a single attempt,
+	// without checking the connection separately.
+	Attempts int
+
+	// Interval sets the time to wait after a failed attempt.
+	Interval time.Duration
 }
 
+// CacheOverflow defines how the default cache handles the tags whose associations don't fit in the cache.
+type CacheOverflow int
+
+const (
+	// FailOnOverflow makes the write operations of the cache return ErrFailedToCacheEntry when the
+	// associations of a tag don't fit in the cache. How Set() handles the error depends on the
+	// CacheWriteFailure option. This is the default.
+	FailOnOverflow CacheOverflow = iota
+
+	// SkipOnOverflow drops a tag from the cache when its associations don't fit, and the tag is served
+	// from the persistent storage only, until it is deleted with Delete().
+	SkipOnOverflow
+)
+
 // CacheOptions are used by the default cache implementation.
 type CacheOptions struct {
 
 	// CacheSize defines the maximum memory usage of the cache. Defaults to 1G.
 	CacheSize int
 
+	// CacheSizeRatio, when CacheSize is not set, defines the maximum memory usage of the cache as the ratio
+	// of the total system memory, e.g. 0.25 for a quarter of it, so that the same configuration works for
+	// hosts of different sizes. The size is calculated once, when calling New(). The system memory is read
+	// from /proc/meminfo, on systems without it, New() returns ErrNotSupported. Ratios above 1 are treated
+	// as 1.
+	CacheSizeRatio float64
+
 	// ExpectedItemSize provides a hint for the cache about the expected median size of the stored values.
 	//
 	// This option exists only for optimization, there is no good rule of thumb. Too high values will result
 	// in worse memory utilization, while too low values may affect the individual lookup performance.
 	// Generally, it is better to err for the smaller values.
 	ExpectedItemSize int
+
+	// Overflow defines how to handle the tags whose associations don't fit in the cache, e.g. because the
+	// tag has too many values.
+	Overflow CacheOverflow
+
+	// MaxTagEntries limits how many associations of a single tag the cache holds. The tags exceeding the
+	// limit are dropped from the cache, and served from the persistent storage only, until they are deleted
+	// with Delete(). Writing to these tags doesn't touch the cache. Values lower than 1 mean no limit.
+	MaxTagEntries int
+
+	// CompressEntries makes the cache compress the associations of each tag with gzip, so that more tags fit
+	// in CacheSize, at the cost of compressing them on every write, and decompressing them on every read. It
+	// pays off for the tags with many associations, while the associations of a tag with only a few values
+	// may take more space than without compression.
+	CompressEntries bool
+
+	// EvictOnCorruption makes the write operations drop a tag from the cache when its cached associations
+	// are damaged, instead of failing. The tag is read again from the persistent storage on the next query,
+	// including the association being written.
+	EvictOnCorruption bool
+
+	// SnapshotPath, when set, makes the cache save its content to this file when tagstash is closed, and
+	// load it on startup, so that the hot tags don't need to be read again from the persistent storage after
+	// a restart.
+	//
+	// The reloaded associations may be stale, when the storage was changed while tagstash was not running,
+	// or by another instance. To limit the staleness, the reloaded tags expire after SnapshotTTL, unless
+	// they are read again from the storage. The tags of the snapshot that don't fit in the cache are not
+	// loaded.
+	SnapshotPath string
+
+	// SnapshotInterval, when set, makes the cache save a snapshot periodically, not only on close.
+	SnapshotInterval time.Duration
+
+	// SnapshotTTL defines how long the tags loaded from a snapshot are kept. Defaults to
+	// DefaultSnapshotTTL.
+	SnapshotTTL time.Duration
+
+	// CacheReverseLookups enables caching the tags of the values returned by GetTags(). The cached tags of
+	// a value are dropped when its associations change. The values stored with SetWithTagTTL() are not
+	// cached. The reverse lookups are held in memory, independent of CacheSize, and they are enabled with
+	// custom caches, too.
+	CacheReverseLookups bool
+}
+
+// DefaultSnapshotTTL is the default expiration of the tags reloaded from a cache snapshot.
+const DefaultSnapshotTTL = 10 * time.Minute
+
+// CacheCheck defines how a custom cache is verified when creating a tagstash.
+type CacheCheck int
+
+const (
+	// NoCacheCheck accepts a custom cache without verifying it. This is the default.
+	NoCacheCheck CacheCheck = iota
+
+	// FailOnInvalidCache makes New() return ErrInvalidCache when a custom cache fails the verification.
+	FailOnInvalidCache
+
+	// DisableInvalidCache makes tagstash ignore a custom cache that fails the verification, and read all
+	// the associations from the persistent storage.
+	DisableInvalidCache
+)
+
+// CacheWriteFailure defines how Set() handles a cache write failing after the storage write succeeded. Set(),
+// Remove() and Delete() always write the storage first, and the cache only after the storage write succeeded,
+// so that a failed storage write leaves both of them unchanged.
+type CacheWriteFailure int
+
+const (
+	// InvalidateOnCacheFailure drops the tag from the cache, so that the next query reads it from the
+	// storage, and Set() succeeds. This is the default.
+	InvalidateOnCacheFailure CacheWriteFailure = iota
+
+	// RollbackOnCacheFailure removes the associations written by the failed Set() call from the storage
+	// and the cache, on a best-effort basis, and returns the error of the cache. Existing associations
+	// that were updated by the call are restored with their previous tag index, expiration and weight.
+	RollbackOnCacheFailure
+
+	// AcceptCacheDivergence returns the error of the cache, leaving the storage updated and the cache
+	// untouched.
+	AcceptCacheDivergence
+)
+
+// CacheMode defines how Set() treats the cache.
+type CacheMode int
+
+const (
+	// WriteThrough makes Set() update the associations of the cached tags in the cache, too. This is the
+	// default.
+	WriteThrough CacheMode = iota
+
+	// WriteAround makes Set() write only the storage, and drop the written tags from the cache, if they were
+	// cached, so that the next query reads them again from the storage, and caches them. It saves the cache
+	// writes for workloads where most of the written tags are not queried.
+	WriteAround
+)
+
+// DuplicateTagPolicy defines how Set() handles a tag listed multiple times.
+type DuplicateTagPolicy int
+
+const (
+	// KeepLastDuplicate stores the association with the tag index of the last occurrence. This is the
+	// default.
+	KeepLastDuplicate DuplicateTagPolicy = iota
+
+	// KeepFirstDuplicate stores the association with the tag index of the first occurrence.
+	KeepFirstDuplicate
+
+	// FailOnDuplicate makes Set() return ErrDuplicateTag, without storing any association.
+	FailOnDuplicate
+)
+
+// Clock provides the current time for tagstash when it records or compares timestamps.
+type Clock interface {
+	Now() time.Time
 }
 
+type realClock struct{}
+
+// Observer can be used to collect metrics about the operations of a stash, e.g. the latency and the error rate.
+// The methods are called synchronously, before the operations return, and they may be called concurrently.
+type Observer interface {
+
+	// ObserveGet is called after every Query(), and the methods based on it, like Get() and GetAll(), with
+	// the number of the returned values.
+	ObserveGet(d time.Duration, results int, err error)
+
+	// ObserveSet is called after every Set(), and after SetWithTagTTL() and SetWeighted() when the storage
+	// supports them.
+	ObserveSet(d time.Duration, err error)
+
+	// ObserveRemove is called after every Remove().
+	ObserveRemove(d time.Duration, err error)
+
+	// ObserveDelete is called after every Delete().
+	ObserveDelete(d time.Duration, err error)
+}
+
+// Ranker defines the order of the values returned by the queries. The entries compared by it carry the
+// measures of the query, see MatchCount(), IndexDelta() and Score().
+type Ranker interface {
+
+	// Less tells whether the value of the left entry is ranked before the value of the right one.
+	Less(left, right *Entry) bool
+}
+
+// RankerFunc can be used as a Ranker.
+type RankerFunc func(left, right *Entry) bool
+
+// Less calls the function itself.
+func (f RankerFunc) Less(left, right *Entry) bool { return f(left, right) }
+
+var (
+	// MatchCountFirst prioritizes the values matching more query tags, weighted by the weight of the
+	// associations, and among them, those whose tag order is closer to the order of the query tags. This is
+	// the default.
+	MatchCountFirst Ranker = RankerFunc(less)
+
+	// OrderFirst prioritizes the values whose tag order is closer to the order of the query tags, and among
+	// them, those matching more query tags, weighted by the weight of the associations.
+	OrderFirst Ranker = RankerFunc(orderFirst)
+)
+
 // Options are used to initialization tagstash.
 type Options struct {
 
@@ -82,7 +664,10 @@ type Options struct {
 	Storage Storage
 
 	// Custom cache implementation. By default, a builtin cache is used.
-	Cache Storage
+	Cache Cache
+
+	// CacheCheck defines whether a custom cache is verified against the cache contract when calling New().
+	CacheCheck CacheCheck
 
 	// CacheOptions define options for the default persistent storage implementation when not replaced by a custom
 	// storage.
@@ -91,36 +676,233 @@ type Options struct {
 	// CacheOptions define options for the default cache implementation when not replaced by a custom
 	// cache.
 	CacheOptions CacheOptions
+
+	// Clock is used to get the current time. By default, the system time is used.
+	Clock Clock
+
+	// DedupKeyFunc, when set, defines which values are considered equivalent in the query results, e.g.
+	// when the same URL is stored with and without a trailing slash. The values with the same key are
+	// returned once, as one of the original values, and each matching tag is counted once for them.
+	DedupKeyFunc func(value string) string
+
+	// CacheWriteFailure defines how Set() handles a failed cache write after the storage was updated.
+	CacheWriteFailure CacheWriteFailure
+
+	// CacheMode defines whether Set() updates the cache, or only drops the written tags from it.
+	CacheMode CacheMode
+
+	// DuplicateTagPolicy defines which position of a tag is used as its tag index, when it is listed
+	// multiple times in a single call to Set(). The same policy applies to all storage implementations.
+	DuplicateTagPolicy DuplicateTagPolicy
+
+	// InvertTagStrength makes tagstash treat the order of the tags as strongest-last, both when storing them
+	// with Set() and when querying them. The associations are stored with the usual strongest-first tag
+	// index, so the stored data doesn't depend on this option, it is equivalent to reversing the tags
+	// before every call.
+	InvertTagStrength bool
+
+	// RankByScore makes the queries prioritize the values with a higher score, set with IncrementScore(),
+	// among the values matching the same number of tags, before comparing the tag order. It requires a
+	// storage implementing ScoreStorage, otherwise the queries return ErrNotSupported. The scores are read
+	// from the storage on every query. It doesn't affect the queries ranked by the storage, WithDBRanking().
+	RankByScore bool
+
+	// MaxConcurrentQueries limits how many storage operations tagstash executes at the same time, across
+	// all the goroutines using it. All the calls to the storage, including the optional interfaces, like
+	// BatchWriter or TagMerger, wait while the limit is reached. Values lower than 1 mean no limit.
+	MaxConcurrentQueries int
+
+	// SlowQueryThreshold, when set together with OnSlowQuery, defines the duration of a query or a Set()
+	// above which OnSlowQuery is called.
+	SlowQueryThreshold time.Duration
+
+	// OnSlowQuery is called with the name of the operation ("query" or "set"), the tags and the elapsed
+	// time, when an operation took longer than SlowQueryThreshold. It is called synchronously, before the
+	// operation returns.
+	OnSlowQuery func(op string, tags []string, d time.Duration)
+
+	// MaxValueLength limits the length of the stored values, in bytes. Set() returns ErrValueTooLong for
+	// longer values, before writing anything. Values lower than 1 mean no limit.
+	MaxValueLength int
+
+	// MaxTagLength limits the length of the stored tags, in bytes. Set() returns ErrTagTooLong for longer
+	// tags, before writing anything. Values lower than 1 mean no limit.
+	MaxTagLength int
+
+	// QueryExpander, when set, transforms the tags of every query before the lookup, e.g. to add synonyms,
+	// stems or translations, without changing the stored data. It receives the query tags in strongest-first
+	// order, regardless of InvertTagStrength, and the returned tags are matched in strongest-first order, too.
+	// When it returns a tag multiple times, only its first position is used. The tags of the WithExclude()
+	// option are not expanded.
+	QueryExpander func(tags []string) []string
+
+	// CaseInsensitiveTags makes tagstash convert the tags to lower case, before storing, caching or querying
+	// them, in every method accepting tags, so that e.g. "Golang" and "golang" are the same tag. The
+	// methods returning tags return them as they are stored, so the tags stored before setting this option
+	// keep their case.
+	CaseInsensitiveTags bool
+
+	// ExpiredSweepInterval, when set, makes the stash delete the expired associations periodically, the
+	// same way as DeleteExpired(), until it is closed. The queries skip the expired associations even
+	// without it. It requires a storage implementing ExpiringStorage, otherwise New() returns
+	// ErrNotSupported.
+	ExpiredSweepInterval time.Duration
+
+	// Observer, when set, is notified about the duration and the result of the queries and the writes.
+	Observer Observer
+
+	// Ranker defines the order of the values returned by the queries. It doesn't affect the queries ranked
+	// by the storage, WithDBRanking(), or by the tag index, WithOrderByIndex(). Defaults to MatchCountFirst.
+	Ranker Ranker
 }
 
 type entrySort struct {
 	entries []*Entry
+	ranker  Ranker
+
+	// when set, the shorter value is preferred among the entries ranked equally
+	shorterValues bool
 }
 
 // TagStash is used to store tags associated with values and return the best matching value for a set of query
 // tags.
 type TagStash struct {
-	cache, storage Storage
+	cache   Cache
+	storage Storage
+	clock   Clock
+
+	queries            chan struct{}
+	reverse            *reverseCache
+	dedupKey           func(string) string
+	cacheWriteFailure  CacheWriteFailure
+	cacheMode          CacheMode
+	duplicateTagPolicy DuplicateTagPolicy
+	invertTagStrength  bool
+	rankByScore        bool
+	slowQueryThreshold time.Duration
+	onSlowQuery        func(string, []string, time.Duration)
+	maxValueLength     int
+	maxTagLength       int
+	queryExpander      func([]string) []string
+	caseInsensitive    bool
+	ranker             Ranker
+	observer           Observer
+
+	// stops the periodic deletion of the expired associations
+	sweepQuit, sweepDone chan struct{}
+
+	// the number of the owners of a shared stash, it is closed when the last one releases it
+	refMx sync.Mutex
+	refs  int
 }
 
-// ErrNotSupported is returned when a feature is not supported by the current implementation. E.g. the storage
-// doesn't support lookup by value.
-var ErrNotSupported = errors.New("not supported")
+var (
+	// ErrNotSupported is returned when a feature is not supported by the current implementation. E.g. the
+	// storage doesn't support lookup by value.
+	ErrNotSupported = errors.New("not supported")
+
+	// ErrNoTags is returned when a query is called without tags.
+	ErrNoTags = errors.New("no tags")
+
+	// ErrDuplicateTag is returned by Set() when a tag is listed multiple times, and the DuplicateTagPolicy
+	// option is set to FailOnDuplicate.
+	ErrDuplicateTag = errors.New("duplicate tag")
+
+	// ErrNoAssociation is returned when an operation requires a value-tag association that doesn't exist.
+	ErrNoAssociation = errors.New("association not found")
+
+	// ErrInvalidCache is returned by New() when a custom cache doesn't satisfy the cache contract, and
+	// the CacheCheck option is set to FailOnInvalidCache.
+	ErrInvalidCache = errors.New("invalid cache")
+
+	// ErrValueTooLong is returned when storing a value longer than the MaxValueLength option.
+	ErrValueTooLong = errors.New("value too long")
+
+	// ErrTagTooLong is returned when storing a tag longer than the MaxTagLength option.
+	ErrTagTooLong = errors.New("tag too long")
+
+	// ErrStorageNotWritable is returned by New() when the sqlite file of the default storage cannot be
+	// opened for writing, or created, e.g. because its directory doesn't exist. The returned error wraps
+	// it, together with the cause.
+	ErrStorageNotWritable = errors.New("storage not writable")
+
+	// ErrInvalidImport is returned by Import() when the input contains a malformed record. The returned
+	// error wraps it, together with the position of the record and the cause.
+	ErrInvalidImport = errors.New("invalid import")
+
+	// ErrInvalidSharding is returned by NewShardedStash() when it is called without shards, or without a
+	// ShardFunc.
+	ErrInvalidSharding = errors.New("invalid sharding")
+)
+
+func (realClock) Now() time.Time { return time.Now() }
 
 func less(left, right *Entry) bool {
+	if left.requestWeight != right.requestWeight {
+		return left.requestWeight > right.requestWeight
+	}
+
+	if left.requestMatchWeight != right.requestMatchWeight {
+		return left.requestMatchWeight > right.requestMatchWeight
+	}
+
 	if left.requestTagMatch == right.requestTagMatch {
+		if left.requestScore != right.requestScore {
+			return left.requestScore > right.requestScore
+		}
+
 		return left.requestIndexDelta < right.requestIndexDelta
 	}
 
 	return left.requestTagMatch > right.requestTagMatch
 }
 
+func orderFirst(left, right *Entry) bool {
+	if left.requestWeight != right.requestWeight {
+		return left.requestWeight > right.requestWeight
+	}
+
+	if left.requestIndexDelta == right.requestIndexDelta {
+		if left.requestMatchWeight != right.requestMatchWeight {
+			return left.requestMatchWeight > right.requestMatchWeight
+		}
+
+		if left.requestTagMatch != right.requestTagMatch {
+			return left.requestTagMatch > right.requestTagMatch
+		}
+
+		return left.requestScore > right.requestScore
+	}
+
+	return left.requestIndexDelta < right.requestIndexDelta
+}
+
 func (s entrySort) Len() int      { return len(s.entries) }
 func (s entrySort) Swap(i, j int) { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
 
 func (s entrySort) Less(i, j int) bool {
 	left, right := s.entries[i], s.entries[j]
-	return less(left, right)
+	return s.less(left, right)
+}
+
+func (s entrySort) rank(left, right *Entry) bool {
+	if s.ranker == nil {
+		return less(left, right)
+	}
+
+	return s.ranker.Less(left, right)
+}
+
+func (s entrySort) less(left, right *Entry) bool {
+	if !s.shorterValues || s.rank(left, right) || s.rank(right, left) {
+		return s.rank(left, right)
+	}
+
+	if len(left.Value) != len(right.Value) {
+		return len(left.Value) < len(right.Value)
+	}
+
+	return left.Value < right.Value
 }
 
 func (s entrySort) First() *Entry {
@@ -131,7 +913,7 @@ func (s entrySort) First() *Entry {
 
 	first := s.entries[0]
 	for _, e := range s.entries[1:] {
-		if less(e, first) {
+		if s.less(e, first) {
 			first = e
 		}
 	}
@@ -141,8 +923,36 @@ func (s entrySort) First() *Entry {
 
 // New creates and initializes a tagstash instance.
 func New(o Options) (*TagStash, error) {
+	if o.Clock == nil {
+		o.Clock = realClock{}
+	}
+
+	if o.ExpiredSweepInterval > 0 && o.Storage != nil {
+		if _, ok := o.Storage.(ExpiringStorage); !ok {
+			return nil, ErrNotSupported
+		}
+	}
+
+	if o.Cache != nil && o.CacheCheck != NoCacheCheck && !checkCache(o.Cache) {
+		if o.CacheCheck == FailOnInvalidCache {
+			return nil, ErrInvalidCache
+		}
+
+		o.Cache.Close()
+		o.Cache = noCache{}
+	}
+
+	if o.Cache == nil && o.CacheOptions.CacheSize <= 0 && o.CacheOptions.CacheSizeRatio > 0 {
+		size, err := cacheSizeFromRatio(o.CacheOptions.CacheSizeRatio, systemMemory)
+		if err != nil {
+			return nil, err
+		}
+
+		o.CacheOptions.CacheSize = size
+	}
+
 	if o.Storage == nil {
-		s, err := newStorage(o.StorageOptions)
+		s, err := newStorage(o.StorageOptions, o.Clock)
 		if err != nil {
 			return nil, err
 		}
@@ -151,88 +961,469 @@ func New(o Options) (*TagStash, error) {
 	}
 
 	if o.Cache == nil {
-		o.Cache = newCache(o.CacheOptions)
+		c := newCache(o.CacheOptions)
+		c.now = o.Clock.Now
+		if err := c.startSnapshots(o.CacheOptions.SnapshotInterval); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		o.Cache = c
 	}
 
-	return &TagStash{
-		storage: o.Storage,
-		cache:   o.Cache,
-	}, nil
-}
+	var queries chan struct{}
+	if o.MaxConcurrentQueries > 0 {
+		queries = make(chan struct{}, o.MaxConcurrentQueries)
+	}
 
-func setRequestIndex(tags []string, e []*Entry) (notFound []string) {
-	for i, t := range tags {
-		var found bool
-		for _, ei := range e {
-			if ei.Tag == t {
-				d := i - ei.TagIndex
-				if d < 0 {
-					d = 0 - d
-				}
+	var reverse *reverseCache
+	if o.CacheOptions.CacheReverseLookups {
+		reverse = newReverseCache()
+	}
 
-				ei.requestIndexDelta = d
-				found = true
-			}
-		}
+	t := &TagStash{
+		queries:            queries,
+		reverse:            reverse,
+		storage:            o.Storage,
+		cache:              o.Cache,
+		clock:              o.Clock,
+		dedupKey:           o.DedupKeyFunc,
+		cacheWriteFailure:  o.CacheWriteFailure,
+		cacheMode:          o.CacheMode,
+		duplicateTagPolicy: o.DuplicateTagPolicy,
+		invertTagStrength:  o.InvertTagStrength,
+		rankByScore:        o.RankByScore,
+		slowQueryThreshold: o.SlowQueryThreshold,
+		onSlowQuery:        o.OnSlowQuery,
+		maxValueLength:     o.MaxValueLength,
+		maxTagLength:       o.MaxTagLength,
+		queryExpander:      o.QueryExpander,
+		caseInsensitive:    o.CaseInsensitiveTags,
+		ranker:             o.Ranker,
+		observer:           o.Observer,
+		refs:               1,
+	}
 
-		if !found {
-			notFound = append(notFound, t)
-		}
+	if o.ExpiredSweepInterval > 0 {
+		t.startSweep(o.ExpiredSweepInterval)
 	}
 
-	return notFound
+	return t, nil
 }
 
-func uniqueValues(e []*Entry) []*Entry {
-	m := make(map[string]*Entry)
-	u := make([]*Entry, 0, len(e))
-	for _, ei := range e {
-		if eim, ok := m[ei.Value]; ok {
-			eim.requestTagMatch++
-			eim.requestIndexDelta += ei.requestIndexDelta
-			continue
+func (t *TagStash) startSweep(interval time.Duration) {
+	t.sweepQuit = make(chan struct{})
+	t.sweepDone = make(chan struct{})
+	go func() {
+		defer close(t.sweepDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.DeleteExpired()
+			case <-t.sweepQuit:
+				return
+			}
 		}
+	}()
+}
 
-		ei.requestTagMatch = 1
-		m[ei.Value] = ei
-		u = append(u, ei)
+// tagIndex returns the stored tag index of the tag at position i, considering InvertTagStrength.
+func (t *TagStash) tagIndex(i, n int) int {
+	if t.invertTagStrength {
+		return n - 1 - i
 	}
 
-	return u
+	return i
 }
 
-func mapEntries(e ...*Entry) []string {
-	v := make([]string, 0, len(e))
-	for _, ei := range e {
-		v = append(v, ei.Value)
+// observe starts measuring an operation. The returned function reports the operation with OnSlowQuery, if it
+// took longer than the threshold.
+func (t *TagStash) observe(op string, tags []string) func() {
+	if t.slowQueryThreshold <= 0 || t.onSlowQuery == nil {
+		return func() {}
 	}
 
-	return v
+	start := t.clock.Now()
+	return func() {
+		if d := t.clock.Now().Sub(start); d > t.slowQueryThreshold {
+			t.onSlowQuery(op, tags, d)
+		}
+	}
 }
 
-func (t *TagStash) getAll(tags []string) ([]*Entry, error) {
-	entries, err := t.cache.Get(tags)
-	if err != nil {
-		return nil, err
+// startQuery waits until a storage operation can be started, and returns the function that marks it done.
+func (t *TagStash) startQuery() func() {
+	if t.queries == nil {
+		return func() {}
 	}
 
-	notCached := setRequestIndex(tags, entries)
+	t.queries <- struct{}{}
+	return func() { <-t.queries }
+}
+
+func (t *TagStash) storageGet(tags []string) ([]*Entry, error) {
+	defer t.startQuery()()
+	return t.storage.Get(tags)
+}
+
+func (t *TagStash) storageGetMaxIndex(il IndexLimitedLookup, tags []string, maxIndex map[string]int) ([]*Entry, error) {
+	defer t.startQuery()()
+	return il.GetMaxIndex(tags, maxIndex)
+}
+
+func (t *TagStash) storageDeleteValues(vd ValueDeleter, values []string) ([]string, int, error) {
+	defer t.startQuery()()
+	return vd.DeleteValues(values)
+}
+
+func (t *TagStash) storageGetValueEntries(vl ValueEntryLookup, value string) ([]*Entry, error) {
+	defer t.startQuery()()
+	return vl.GetValueEntries(value)
+}
+
+func (t *TagStash) storageGetByTagPrefix(pl TagPrefixLookup, prefix string) ([]*Entry, error) {
+	defer t.startQuery()()
+	return pl.GetByTagPrefix(prefix)
+}
+
+func (t *TagStash) storageWriteBatch(bw BatchWriter, set, remove []*Entry) error {
+	defer t.startQuery()()
+	return bw.WriteBatch(set, remove)
+}
+
+func (t *TagStash) storageGetTags(tl TagLookup, value string) ([]string, error) {
+	defer t.startQuery()()
+	return tl.GetTags(value)
+}
+
+func (t *TagStash) storageTagCountForValues(tc TagCountLookup, values []string) (map[string]int, error) {
+	defer t.startQuery()()
+	return tc.TagCountForValues(values)
+}
+
+func (t *TagStash) storageListTagsPage(tp TagPager, cursor string, limit int) ([]string, error) {
+	defer t.startQuery()()
+	return tp.ListTagsPage(cursor, limit)
+}
+
+func (t *TagStash) storageDeleteExpired(es ExpiringStorage) ([]string, int, error) {
+	defer t.startQuery()()
+	return es.DeleteExpired(t.clock.Now())
+}
+
+func (t *TagStash) storageDeleteOlderThan(ac AgeCleaner, before time.Time) ([]string, int, error) {
+	defer t.startQuery()()
+	return ac.DeleteOlderThan(before)
+}
+
+func (t *TagStash) storageGetRanked(rl RankedLookup, tags []string, limit int) ([]RankedValue, error) {
+	defer t.startQuery()()
+	return rl.GetRanked(tags, limit)
+}
+
+func (t *TagStash) storageGetScores(ss ScoreStorage, values []string) (map[string]int, error) {
+	defer t.startQuery()()
+	return ss.GetScores(values)
+}
+
+func (t *TagStash) storageMergeTags(tm TagMerger, source, dest string, p MergePolicy) error {
+	defer t.startQuery()()
+	return tm.MergeTags(source, dest, p)
+}
+
+func (t *TagStash) storageReplaceTag(tr TagReplacer, tag string, e []*Entry) error {
+	defer t.startQuery()()
+	return tr.ReplaceTag(tag, e)
+}
+
+func (t *TagStash) storageSet(e *Entry) error {
+	defer t.startQuery()()
+	return t.storage.Set(e)
+}
+
+func (t *TagStash) storageRemove(e *Entry) error {
+	defer t.startQuery()()
+	return t.storage.Remove(e)
+}
+
+func (t *TagStash) storageDelete(tag string) error {
+	defer t.startQuery()()
+	return t.storage.Delete(tag)
+}
+
+// merge collects the matching entries of a query into one entry per value, as the entries are fetched.
+type merge struct {
+	requestIndex map[string]int
+	values       map[string]*Entry
+	unique       []*Entry
+
+	// when set, values with the same key are merged, and each tag is counted once per key
+	dedupKey func(string) string
+	tags     map[[2]string]bool
+
+	// when set, the weights of the matching tags are summed for each value
+	weights map[string]float64
+
+	// when set, the matching tags and their tag index are collected for each value
+	positions map[*Entry][]TagPosition
+}
+
+func newMerge(tags []string) *merge {
+	m := &merge{
+		requestIndex: make(map[string]int),
+		values:       make(map[string]*Entry),
+		unique:       make([]*Entry, 0),
+	}
+
+	for i, t := range tags {
+		m.requestIndex[t] = i
+	}
+
+	return m
+}
+
+func (m *merge) add(e *Entry) {
+	key := e.Value
+	if m.dedupKey != nil {
+		key = m.dedupKey(e.Value)
+		if m.tags == nil {
+			m.tags = make(map[[2]string]bool)
+		}
+
+		if m.tags[[2]string{key, e.Tag}] {
+			return
+		}
+
+		m.tags[[2]string{key, e.Tag}] = true
+	}
+
+	d := m.requestIndex[e.Tag] - e.TagIndex
+	if d < 0 {
+		d = 0 - d
+	}
+
+	w, ew := m.weights[e.Tag], e.weight()
+	if em, ok := m.values[key]; ok {
+		em.requestTagMatch++
+		em.requestIndexDelta += d
+		em.requestWeight += w * ew
+		em.requestMatchWeight += ew
+		m.addPosition(em, e)
+		return
+	}
+
+	e.requestTagMatch = 1
+	e.requestIndexDelta = d
+	e.requestWeight = w * ew
+	e.requestMatchWeight = ew
+	m.values[key] = e
+	m.unique = append(m.unique, e)
+	m.addPosition(e, e)
+}
+
+func (m *merge) addPosition(merged, e *Entry) {
+	if m.positions != nil {
+		m.positions[merged] = append(m.positions[merged], TagPosition{Tag: e.Tag, Index: e.TagIndex})
+	}
+}
+
+// sortPositions orders the collected positions of each value by the position of their tag in the query.
+func (m *merge) sortPositions() {
+	for _, p := range m.positions {
+		sort.Slice(p, func(i, j int) bool { return m.requestIndex[p[i].Tag] < m.requestIndex[p[j].Tag] })
+	}
+}
+
+// mapEntries returns the values of the entries. It never returns nil, GetAll() relies on it.
+func mapEntries(e ...*Entry) []string {
+	v := make([]string, 0, len(e))
+	for _, ei := range e {
+		v = append(v, ei.Value)
+	}
+
+	return v
+}
+
+// tagInvalidator is implemented by the default cache, to drop a tag without resetting its skipped state, unlike
+// Delete().
+type tagInvalidator interface {
+	invalidate(tag string)
+}
+
+type tagSetter interface {
+	setTag(string, []*Entry) error
+}
+
+// cacheStored writes the associations read from the storage to the cache. When the cache supports it, the
+// associations of each tag are written at once, otherwise one by one.
+func (t *TagStash) cacheStored(e []*Entry) error {
+	ts, ok := t.cache.(tagSetter)
+	if !ok {
+		for _, ei := range e {
+			if err := t.cache.Set(ei); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	var tags []string
+	byTag := make(map[string][]*Entry)
+	for _, ei := range e {
+		if _, ok := byTag[ei.Tag]; !ok {
+			tags = append(tags, ei.Tag)
+		}
+
+		byTag[ei.Tag] = append(byTag[ei.Tag], ei)
+	}
+
+	for _, tag := range tags {
+		if err := ts.setTag(tag, byTag[tag]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cacheUpdate writes a changed association to the cache, only if the cache already holds the associations of
+// the tag. Otherwise the cache would hold an incomplete list of the tag, and the queries would trust it as
+// complete. The default cache checks this itself, while for custom caches, the tag is looked up first.
+func (t *TagStash) cacheUpdate(e *Entry) error {
+	if _, ok := t.cache.(tagSetter); !ok {
+		cached, err := t.cache.Get([]string{e.Tag})
+		if err != nil {
+			return err
+		}
+
+		if len(cached) == 0 {
+			return nil
+		}
+	}
+
+	return t.cache.Set(e)
+}
+
+type cacheIterator interface {
+	each([]string, func(*Entry)) error
+}
+
+// withinMaxIndex tells whether an association counts for a query with per-tag maximum tag indexes.
+func withinMaxIndex(e *Entry, maxIndex map[string]int) bool {
+	limit, ok := maxIndex[e.Tag]
+	return !ok || e.TagIndex <= limit
+}
+
+func constrainsAny(tags []string, maxIndex map[string]int) bool {
+	for _, tag := range tags {
+		if _, ok := maxIndex[tag]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetchEach calls f for the associations of the tags, from the cache, or from the storage for the tags that
+// are not cached. The associations of the tags in maxIndex above their maximum tag index are skipped. When the
+// storage implements IndexLimitedLookup, these are filtered by the storage, and, since the fetched lists of the
+// constrained tags are incomplete, only the unconstrained tags are cached. The associations of a tag are read
+// from one of the layers only, so a stale tag index in the cache is never merged with a fresh one from the
+// storage. The tags are deduplicated, and since both layers hold a value at most once for a tag, f is called
+// at most once for every tag and value pair, and the merge doesn't count a matching tag twice. When the cache
+// supports it, the cached associations are passed to f as they are decoded, without collecting them first.
+func (t *TagStash) fetchEach(tags []string, c Consistency, maxIndex map[string]int, f func(*Entry)) error {
+	tags = uniqueTags(tags)
+	notCached := tags
+	if c != Strong {
+		found := make(map[string]bool)
+		cached := func(e *Entry) {
+			found[e.Tag] = true
+			if withinMaxIndex(e, maxIndex) {
+				f(e)
+			}
+		}
+
+		if ci, ok := t.cache.(cacheIterator); ok {
+			if err := ci.each(tags, cached); err != nil {
+				return err
+			}
+		} else {
+			entries, err := t.cache.Get(tags)
+			if err != nil {
+				return err
+			}
+
+			for _, e := range entries {
+				cached(e)
+			}
+		}
+
+		notCached = nil
+		for _, t := range tags {
+			if !found[t] {
+				notCached = append(notCached, t)
+			}
+		}
+	}
+
+	var (
+		stored  []*Entry
+		limited bool
+		err     error
+	)
+
+	if il, ok := t.storage.(IndexLimitedLookup); ok && constrainsAny(notCached, maxIndex) {
+		limited = true
+		stored, err = t.storageGetMaxIndex(il, notCached, maxIndex)
+	} else {
+		stored, err = t.storageGet(notCached)
+	}
 
-	stored, err := t.storage.Get(notCached)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if c != Strong {
+		complete := stored
+		if limited {
+			complete = nil
+			for _, e := range stored {
+				if _, ok := maxIndex[e.Tag]; !ok {
+					complete = append(complete, e)
+				}
+			}
+		}
+
+		if err := t.cacheStored(complete); err != nil {
+			return err
+		}
 	}
 
 	for _, e := range stored {
-		if err := t.cache.Set(e); err != nil {
-			return nil, err
+		if withinMaxIndex(e, maxIndex) {
+			f(e)
 		}
 	}
 
-	setRequestIndex(tags, stored)
-	entries = append(entries, stored...)
+	return nil
+}
+
+func (t *TagStash) getAll(tags []string, q query) ([]*Entry, error) {
+	m := newMerge(tags)
+	m.dedupKey = t.dedupKey
+	m.positions = q.positions
+	if err := t.fetchEach(tags, q.consistency, q.maxIndex, m.add); err != nil {
+		return nil, err
+	}
 
-	return uniqueValues(entries), nil
+	m.sortPositions()
+	return m.unique, nil
 }
 
 // Get returns the best matching value for a set of tags. When there are overlapping tags and values, it
@@ -240,7 +1431,7 @@ func (t *TagStash) getAll(tags []string) ([]*Entry, error) {
 // number of matching tags, it prioritizes those that whose tag order matches the closer the order of the tags
 // in the arguments. The tag order means the order of tags at the time of the definition (Set()).
 func (t *TagStash) Get(tags ...string) (string, error) {
-	entries, err := t.getAll(tags)
+	entries, err := t.Query(tags, WithLimit(1))
 	if err != nil {
 		return "", err
 	}
@@ -249,84 +1440,1519 @@ func (t *TagStash) Get(tags ...string) (string, error) {
 		return "", nil
 	}
 
-	e := entrySort{entries}.First()
-	return mapEntries(e)[0], nil
+	return entries[0].Value, nil
+}
+
+// Lookup returns the best matching value for a set of tags, the same way as Get(), and whether there was any
+// match.
+func (t *TagStash) Lookup(tags ...string) (value string, found bool, err error) {
+	entries, err := t.Query(tags, WithLimit(1))
+	if err != nil || len(entries) == 0 {
+		return "", false, err
+	}
+
+	return entries[0].Value, true, nil
+}
+
+// GetByExactTags returns the value whose complete set of tags equals the provided tags, ignoring their order. When
+// there are multiple such values, it returns the one that Get() would prioritize. When no value has exactly the
+// provided tags, it returns an empty string. It returns ErrNotSupported if the storage implementation doesn't
+// support counting the tags of the values.
+func (t *TagStash) GetByExactTags(tags ...string) (string, error) {
+	tc, ok := t.storage.(TagCountLookup)
+	if !ok {
+		return "", ErrNotSupported
+	}
+
+	var unique []string
+	seen := make(map[string]bool)
+	for _, tag := range t.normalizeTags(tags) {
+		if !seen[tag] {
+			seen[tag] = true
+			unique = append(unique, tag)
+		}
+	}
+
+	entries, err := t.Query(unique, WithMinMatch(len(unique)))
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+
+	c, err := t.storageTagCountForValues(tc, mapEntries(entries...))
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		if c[e.Value] == len(unique) {
+			return e.Value, nil
+		}
+	}
+
+	return "", nil
 }
 
 // GetAll returns all matches for a set of tags, sorted by the same rules that are used for prioritization when
-// calling Get().
+// calling Get(). When there are no matches, it returns an empty, non-nil slice, regardless of whether the tags
+// were read from the cache or from the storage. It returns nil only together with an error.
 func (t *TagStash) GetAll(tags ...string) ([]string, error) {
-	entries, err := t.getAll(tags)
+	entries, err := t.Query(tags)
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Sort(entrySort{entries})
 	return mapEntries(entries...), nil
 }
 
-// GetTags returns the tags associated with the provided value or ErrNotSupported if the storage implementation
-// doesn't support this query.
-func (t *TagStash) GetTags(value string) ([]string, error) {
-	if tl, ok := t.storage.(TagLookup); ok {
-		return tl.GetTags(value)
+// GetByPrefix returns the values associated with any tag starting with the prefix, ranked by the number of such
+// tags of the values, then by the tag index of these tags, lower first. The cache is keyed by the exact tags,
+// so the associations are read from the storage, and the discovered tags are cached. It returns ErrNoTags for
+// an empty prefix, and ErrNotSupported if the storage implementation doesn't support finding tags by prefix.
+func (t *TagStash) GetByPrefix(prefix string) ([]string, error) {
+	pl, ok := t.storage.(TagPrefixLookup)
+	if !ok {
+		return nil, ErrNotSupported
 	}
 
-	return nil, ErrNotSupported
+	if prefix == "" {
+		return nil, ErrNoTags
+	}
+
+	prefix = t.normalizeTag(prefix)
+	e, err := t.storageGetByTagPrefix(pl, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.cacheStored(e); err != nil {
+		return nil, err
+	}
+
+	// without query tags, the index delta of an association equals its tag index
+	m := newMerge(nil)
+	m.dedupKey = t.dedupKey
+	for _, ei := range e {
+		m.add(ei)
+	}
+
+	sort.Sort(entrySort{entries: m.unique, ranker: t.ranker})
+	return mapEntries(m.unique...), nil
 }
 
-// Set stores tags associated with a value. The order of the tags is taken into account when there are
-// overlapping matches during retrieval.
-func (t *TagStash) Set(value string, tags ...string) error {
-	for i, ti := range tags {
-		e := &Entry{
-			Value:    value,
-			Tag:      ti,
-			TagIndex: i,
-		}
+// GetTop returns at most n best matching values for a set of tags, ranked the same way as GetAll. When n is
+// zero or negative, it returns all the matches, like GetAll.
+func (t *TagStash) GetTop(n int, tags ...string) ([]string, error) {
+	entries, err := t.Query(tags, WithLimit(n))
+	if err != nil {
+		return nil, err
+	}
 
-		if err := t.storage.Set(e); err != nil {
-			return err
-		}
+	return mapEntries(entries...), nil
+}
 
-		if err := t.cache.Set(e); err != nil {
-			return err
-		}
+// GetAllMatching returns the values associated with every tag of the query, ranked the same way as GetAll,
+// which, among these values, means by the tag order. It returns ErrNoTags when called without tags.
+func (t *TagStash) GetAllMatching(tags ...string) ([]string, error) {
+	// a repeated tag would count twice toward the match
+	tags = uniqueTags(t.normalizeTags(tags))
+	entries, err := t.Query(tags, WithMinMatch(len(tags)))
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return mapEntries(entries...), nil
 }
 
-// Remove deletes a value-tag association.
-func (t *TagStash) Remove(value string, tag string) error {
-	e := &Entry{Value: value, Tag: tag}
+// GetExcluding returns the values matching the include tags, ranked the same way as GetAll, without the values
+// associated with any of the exclude tags, even if they match some of the include tags, too. It returns
+// ErrNoTags when called without include tags.
+func (t *TagStash) GetExcluding(include []string, exclude []string) ([]string, error) {
+	entries, err := t.Query(include, WithExclude(exclude...))
+	if err != nil {
+		return nil, err
+	}
 
-	if err := t.cache.Remove(e); err != nil {
-		return err
+	return mapEntries(entries...), nil
+}
+
+// GetByOverlapRatio returns the values matching at least the provided ratio of the query tags, e.g. 0.7 for
+// 70%, ranked the same way as GetAll. The ratio is calculated with the number of distinct query tags. It
+// returns ErrNoTags when called without tags.
+func (t *TagStash) GetByOverlapRatio(ratio float64, tags ...string) ([]string, error) {
+	entries, err := t.Query(tags)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := t.storage.Remove(e); err != nil {
-		return err
+	n := float64(len(uniqueTags(t.normalizeTags(tags))))
+	entries = filterEntries(entries, func(e *Entry) bool { return float64(e.requestTagMatch)/n >= ratio })
+	return mapEntries(entries...), nil
+}
+
+// GetRequiring returns the values associated with the required tag, ranked by the preference tags the same
+// way as GetAll ranks by its arguments. Only those values are returned that match at least one preference tag.
+// When called without preference tags, it ranks the values of the required tag by their tag index.
+func (t *TagStash) GetRequiring(required string, prefer ...string) ([]string, error) {
+	if len(prefer) == 0 {
+		return t.GetAll(required)
 	}
 
-	return nil
+	entries, err := t.Query(prefer, WithRequire(required))
+	if err != nil {
+		return nil, err
+	}
+
+	return mapEntries(entries...), nil
 }
 
-// Delete deletes all associations of a tag.
-func (t *TagStash) Delete(tag string) error {
-	if err := t.cache.Delete(tag); err != nil {
-		return err
+// GetRanked returns the same values as GetAll, in the same order, together with their rank and the measures used
+// for the ranking: the number of matched query tags, and the summed index delta. It can be used to show why a
+// value matched, without querying again.
+func (t *TagStash) GetRanked(tags ...string) ([]RankedValue, error) {
+	entries, err := t.Query(tags)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := t.storage.Delete(tag); err != nil {
-		return err
+	v := make([]RankedValue, len(entries))
+	for i, e := range entries {
+		v[i] = RankedValue{
+			Value:      e.Value,
+			Rank:       i + 1,
+			MatchCount: e.requestTagMatch,
+			IndexDelta: e.requestIndexDelta,
+		}
 	}
 
-	return nil
+	return v, nil
 }
 
-// Close releases all resources.
-func (t *TagStash) Close() {
+// GetWithPositions returns the same values as GetAll, in the same order, together with the query tags that they
+// matched and the tag index of the matching associations, to explain the ranking of the values, or to highlight
+// the matching query tags. The number of the positions of a value is its match count.
+func (t *TagStash) GetWithPositions(tags ...string) ([]ValuePositions, error) {
+	positions := make(map[*Entry][]TagPosition)
+	entries, err := t.Query(tags, func(q *query) { q.positions = positions })
+	if err != nil {
+		return nil, err
+	}
+
+	v := make([]ValuePositions, len(entries))
+	for i, e := range entries {
+		v[i] = ValuePositions{Value: e.Value, Positions: positions[e]}
+	}
+
+	return v, nil
+}
+
+// GetTiered returns the same values as GetAll, grouped by the number of query tags that they match. The values
+// in each group keep their ranked order, so the first value of a group is the best value with that number of
+// matching tags.
+func (t *TagStash) GetTiered(tags ...string) (map[int][]string, error) {
+	entries, err := t.Query(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tiers := make(map[int][]string)
+	for _, e := range entries {
+		tiers[e.requestTagMatch] = append(tiers[e.requestTagMatch], e.Value)
+	}
+
+	return tiers, nil
+}
+
+// GetAllChan returns the same values as GetAll, sending them on the returned value channel. The value channel
+// is closed after the last value was sent, or when an error occurred. The error, if any, is sent on the error
+// channel, which is closed together with the value channel. When the consumer stops reading early, it needs to
+// close the done channel, which stops the sending and closes both channels. A nil done channel means that all
+// the values are read.
+func (t *TagStash) GetAllChan(done <-chan struct{}, tags ...string) (<-chan string, <-chan error) {
+	values := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(values)
+
+		entries, err := t.Query(tags)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		for _, e := range entries {
+			select {
+			case values <- e.Value:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return values, errs
+}
+
+// GetTags returns the tags associated with the provided value or ErrNotSupported if the storage implementation
+// doesn't support this query.
+func (t *TagStash) GetTags(value string) ([]string, error) {
+	tl, ok := t.storage.(TagLookup)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	tags, generation, ok := t.reverse.get(value)
+	if ok {
+		return tags, nil
+	}
+
+	tags, err := t.storageGetTags(tl, value)
+	if err != nil {
+		return nil, err
+	}
+
+	t.reverse.set(value, tags, generation)
+	return tags, nil
+}
+
+// GetValueEntries returns the associations of a value, with their tag and tag index, ordered by the tag index.
+// It returns ErrNotSupported if the storage implementation doesn't support looking up the associations of a
+// value.
+func (t *TagStash) GetValueEntries(value string) ([]*Entry, error) {
+	vl, ok := t.storage.(ValueEntryLookup)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	defer t.startQuery()()
+	return vl.GetValueEntries(value)
+}
+
+// StreamAll calls f for every stored association, ordered by the value, then by the tag index, e.g. to rebuild
+// an external index. It reads the storage directly, without the cache, and it stops and returns the error
+// when f returns an error. Since the storage may hold the read open while f is running, f should not write to
+// the stash. It returns ErrNotSupported if the storage implementation doesn't support iterating over all the
+// associations.
+func (t *TagStash) StreamAll(f func(*Entry) error) error {
+	es, ok := t.storage.(EntryStreamer)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	defer t.startQuery()()
+	return es.StreamAll(f)
+}
+
+// TagCountForValues returns the number of distinct tags associated with each of the provided values, or
+// ErrNotSupported if the storage implementation doesn't support this query. The result contains all the
+// provided values, with zero for those that have no associations.
+func (t *TagStash) TagCountForValues(values []string) (map[string]int, error) {
+	tc, ok := t.storage.(TagCountLookup)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	c, err := t.storageTagCountForValues(tc, values)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range values {
+		if _, ok := c[v]; !ok {
+			c[v] = 0
+		}
+	}
+
+	return c, nil
+}
+
+// ValuesMissingTag returns the distinct values that have associations, but none of them with the provided tag.
+// It returns ErrNotSupported if the storage implementation doesn't support this query.
+func (t *TagStash) ValuesMissingTag(tag string) ([]string, error) {
+	if ml, ok := t.storage.(MissingTagLookup); ok {
+		defer t.startQuery()()
+		return ml.ValuesMissingTag(t.normalizeTag(tag))
+	}
+
+	return nil, ErrNotSupported
+}
+
+// TagFrequency returns at most n tags with the highest number of associated values, or ErrNotSupported if
+// the storage implementation doesn't support this query.
+func (t *TagStash) TagFrequency(n int) ([]TagCount, error) {
+	tf, ok := t.storage.(TagFrequencyLookup)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	if n <= 0 {
+		return nil, nil
+	}
+
+	defer t.startQuery()()
+	return tf.TagFrequency(n)
+}
+
+// ListTags returns all the distinct stored tags in ascending order, e.g. to build an autocomplete index, or
+// ErrNotSupported if the storage implementation doesn't support this query. For a large number of tags,
+// consider ListTagsPage. It reads the persistent storage directly.
+func (t *TagStash) ListTags() ([]string, error) {
+	te, ok := t.storage.(TagEnumerator)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	defer t.startQuery()()
+	return te.ListTags()
+}
+
+// CountTag returns the number of values associated with a tag. When the storage implements TagCounter, the
+// values are counted by the storage, otherwise the associations of the tag are read, from the cache, when the
+// tag is cached, and from the storage, when not.
+func (t *TagStash) CountTag(tag string) (int, error) {
+	tag = t.normalizeTag(tag)
+	if tc, ok := t.storage.(TagCounter); ok {
+		defer t.startQuery()()
+		return tc.CountTag(tag)
+	}
+
+	var count int
+	if err := t.fetchEach([]string{tag}, Cached, nil, func(*Entry) { count++ }); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// DefaultTagPageSize is used by ListTagsPage when the limit is not set.
+const DefaultTagPageSize = 100
+
+// ListTagsPage returns the stored tags in ascending order, page by page, or ErrNotSupported if the storage
+// implementation doesn't support this query. An empty cursor starts from the first tag, and the returned
+// cursor can be used to get the next page. When the returned cursor is empty, there are no more tags. When the
+// limit is lower than 1, DefaultTagPageSize is used.
+func (t *TagStash) ListTagsPage(cursor string, limit int) (tags []string, nextCursor string, err error) {
+	tp, ok := t.storage.(TagPager)
+	if !ok {
+		return nil, "", ErrNotSupported
+	}
+
+	if limit < 1 {
+		limit = DefaultTagPageSize
+	}
+
+	// one more tag tells whether there is a next page
+	tags, err = t.storageListTagsPage(tp, cursor, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(tags) > limit {
+		tags = tags[:limit]
+		nextCursor = tags[limit-1]
+	}
+
+	return tags, nextCursor, nil
+}
+
+// HasMany returns for each provided entry whether its value is associated with its tag, or ErrNotSupported if
+// the storage implementation doesn't support this query. The tag index of the entries is ignored. It reads the
+// persistent storage directly.
+func (t *TagStash) HasMany(pairs []Entry) (map[Entry]bool, error) {
+	pl, ok := t.storage.(PairLookup)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	defer t.startQuery()()
+	if !t.caseInsensitive {
+		return pl.HasMany(pairs)
+	}
+
+	// the result is keyed by the pairs as they were passed in
+	normalized := make([]Entry, len(pairs))
+	for i, p := range pairs {
+		normalized[i] = Entry{Value: p.Value, Tag: t.normalizeTag(p.Tag)}
+	}
+
+	has, err := pl.HasMany(normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[Entry]bool, len(pairs))
+	for i, p := range pairs {
+		result[p] = has[normalized[i]]
+	}
+
+	return result, nil
+}
+
+// Has tells whether a value is associated with a tag. When the tag is cached, it is answered from the cache,
+// otherwise from the storage, with a single pair lookup, when the storage implements PairLookup, or by looking
+// up the tags of the value, when it implements TagLookup. It returns ErrNotSupported if the storage implements
+// neither.
+func (t *TagStash) Has(value, tag string) (bool, error) {
+	pl, hasPairs := t.storage.(PairLookup)
+	tl, hasTags := t.storage.(TagLookup)
+	if !hasPairs && !hasTags {
+		return false, ErrNotSupported
+	}
+
+	tag = t.normalizeTag(tag)
+
+	// the cache returns either all or none of the associations of a tag
+	cached, err := t.cache.Get([]string{tag})
+	if err != nil {
+		return false, err
+	}
+
+	if len(cached) > 0 {
+		for _, e := range cached {
+			if e.Value == value {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	defer t.startQuery()()
+	if hasPairs {
+		e := Entry{Value: value, Tag: tag}
+		has, err := pl.HasMany([]Entry{e})
+		return has[e], err
+	}
+
+	tags, err := tl.GetTags(value)
+	if err != nil {
+		return false, err
+	}
+
+	for _, ti := range tags {
+		if ti == tag {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// TagCooccurrence returns the pairs of tags that are associated with at least minCount common values, in
+// descending order of the number of common values, or ErrNotSupported if the storage implementation doesn't
+// support this query. It reads the persistent storage directly.
+func (t *TagStash) TagCooccurrence(minCount int) ([]TagPairCount, error) {
+	cl, ok := t.storage.(CooccurrenceLookup)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	defer t.startQuery()()
+	return cl.TagCooccurrence(minCount)
+}
+
+func (t *TagStash) warm(tags []string) error {
+	stored, err := t.storageGet(tags)
+	if err != nil {
+		return err
+	}
+
+	return t.cacheStored(stored)
+}
+
+// Warm loads the associations of the provided tags from the storage into the cache, e.g. after a restart, so
+// that the first queries of these tags don't need to read the storage. Use WarmTopTags() to warm the most
+// frequently used tags.
+func (t *TagStash) Warm(tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	return t.warm(uniqueTags(t.normalizeTags(tags)))
+}
+
+// WarmTopTags loads the associations of the n most frequently used tags into the cache. It returns
+// ErrNotSupported if the storage implementation doesn't support the tag frequency query.
+func (t *TagStash) WarmTopTags(n int) error {
+	c, err := t.TagFrequency(n)
+	if err != nil {
+		return err
+	}
+
+	tags := make([]string, len(c))
+	for i, ci := range c {
+		tags[i] = ci.Tag
+	}
+
+	return t.warm(tags)
+}
+
+// normalizeTag returns the tag in lower case, when the CaseInsensitiveTags option is set. Every method accepting
+// tags calls it, or normalizeTags, before using the tags.
+func (t *TagStash) normalizeTag(tag string) string {
+	if !t.caseInsensitive {
+		return tag
+	}
+
+	return strings.ToLower(tag)
+}
+
+// normalizeTags returns the tags in lower case, when the CaseInsensitiveTags option is set, without modifying
+// the argument.
+func (t *TagStash) normalizeTags(tags []string) []string {
+	if !t.caseInsensitive {
+		return tags
+	}
+
+	n := make([]string, len(tags))
+	for i, tag := range tags {
+		n[i] = strings.ToLower(tag)
+	}
+
+	return n
+}
+
+// checkLength validates the length of a value and its tags against the MaxValueLength and MaxTagLength
+// options.
+func (t *TagStash) checkLength(value string, tags []string) error {
+	if t.maxValueLength > 0 && len(value) > t.maxValueLength {
+		return ErrValueTooLong
+	}
+
+	if t.maxTagLength > 0 {
+		for _, tag := range tags {
+			if len(tag) > t.maxTagLength {
+				return ErrTagTooLong
+			}
+		}
+	}
+
+	return nil
+}
+
+// tagPositions returns the position of each tag whose association is stored, applying the duplicate tag
+// policy.
+func (t *TagStash) tagPositions(tags []string) (map[string]int, error) {
+	p := make(map[string]int, len(tags))
+	for i, tag := range tags {
+		if _, ok := p[tag]; ok {
+			switch t.duplicateTagPolicy {
+			case FailOnDuplicate:
+				return nil, ErrDuplicateTag
+			case KeepFirstDuplicate:
+				continue
+			}
+		}
+
+		p[tag] = i
+	}
+
+	return p, nil
+}
+
+// Set stores tags associated with a value. The order of the tags is taken into account when there are
+// overlapping matches during retrieval. When a tag is listed multiple times, the stored tag index depends on
+// the DuplicateTagPolicy option. It returns ErrValueTooLong or ErrTagTooLong, before writing anything, when
+// the MaxValueLength or MaxTagLength option is exceeded. When the cache fails after the storage was updated,
+// the result depends on the CacheWriteFailure option.
+func (t *TagStash) Set(value string, tags ...string) error {
+	return t.set(value, tags, nil, nil)
+}
+
+// SetWithTagTTL stores tags associated with a value, the same way as Set(), where each association expires
+// after its own TTL. A TTL lower than or equal to zero means that the association doesn't expire. The expired
+// associations are not returned by the queries, and can be deleted with DeleteExpired(). It returns
+// ErrNotSupported if the storage implementation doesn't support expiration.
+func (t *TagStash) SetWithTagTTL(value string, tags []TagTTL) error {
+	if _, ok := t.storage.(ExpiringStorage); !ok {
+		return ErrNotSupported
+	}
+
+	t.reverse.setVolatile(value)
+
+	now := t.clock.Now()
+	names := make([]string, len(tags))
+	expires := make([]time.Time, len(tags))
+	for i, tt := range tags {
+		names[i] = tt.Tag
+		if tt.TTL > 0 {
+			expires[i] = now.Add(tt.TTL)
+		}
+	}
+
+	return t.set(value, names, expires, nil)
+}
+
+// SetWithTTL stores tags associated with a value, the same way as Set(), where all the associations expire
+// after the same TTL. It returns ErrNotSupported if the storage implementation doesn't support expiration.
+func (t *TagStash) SetWithTTL(value string, ttl time.Duration, tags ...string) error {
+	tt := make([]TagTTL, len(tags))
+	for i, tag := range tags {
+		tt[i] = TagTTL{Tag: tag, TTL: ttl}
+	}
+
+	return t.SetWithTagTTL(value, tt)
+}
+
+// SetWeighted stores tags associated with a value, the same way as Set(), where each association has its own
+// weight. A matching tag counts in the ranking by its weight, so e.g. a match on a rare tag can outweigh a
+// match on a common one. Set() stores the default weight, 1, and so do the weights lower than or equal to
+// zero. It returns ErrNotSupported if the storage implementation doesn't store the weights.
+func (t *TagStash) SetWeighted(value string, tags []WeightedTag) error {
+	if _, ok := t.storage.(WeightStorage); !ok {
+		return ErrNotSupported
+	}
+
+	names := make([]string, len(tags))
+	weights := make([]float64, len(tags))
+	for i, wt := range tags {
+		names[i] = wt.Tag
+		if wt.Weight > 0 {
+			weights[i] = wt.Weight
+		}
+	}
+
+	return t.set(value, names, nil, weights)
+}
+
+func (t *TagStash) set(value string, tags []string, expires []time.Time, weights []float64) (err error) {
+	if t.observer != nil {
+		start := t.clock.Now()
+		defer func() { t.observer.ObserveSet(t.clock.Now().Sub(start), err) }()
+	}
+
+	tags = t.normalizeTags(tags)
+	defer t.observe("set", tags)()
+	defer t.reverse.invalidate(value)
+
+	if err := t.checkLength(value, tags); err != nil {
+		return err
+	}
+
+	p, err := t.tagPositions(tags)
+	if err != nil {
+		return err
+	}
+
+	var previous map[string]*Entry
+	if t.cacheWriteFailure == RollbackOnCacheFailure {
+		if previous, err = t.previousEntries(value, tags); err != nil {
+			return err
+		}
+	}
+
+	var written []*Entry
+	for i, ti := range tags {
+		if p[ti] != i {
+			continue
+		}
+
+		e := &Entry{
+			Value:    value,
+			Tag:      ti,
+			TagIndex: t.tagIndex(i, len(tags)),
+		}
+
+		if expires != nil {
+			e.Expires = expires[i]
+		}
+
+		if weights != nil {
+			e.Weight = weights[i]
+		}
+
+		if err := t.storageSet(e); err != nil {
+			return err
+		}
+
+		written = append(written, e)
+		if err := t.cacheWrite(e); err != nil {
+			if err := t.cacheSetFailed(written, previous, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetBatch stores the tags of multiple values, the same way as calling Set() for each of them, with the storage
+// applying all the associations in a single transaction, so that on failure none of them is stored. The
+// cache is updated once per affected tag. When the cache fails after the storage was updated, the affected
+// tag is dropped from the cache, regardless of the CacheWriteFailure option. It returns ErrNotSupported, if
+// the storage implementation doesn't support writing in batches.
+func (t *TagStash) SetBatch(entries []ValueTags) error {
+	bw, ok := t.storage.(BatchWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	var set []*Entry
+	values := make([]string, 0, len(entries))
+	for _, vt := range entries {
+		vtags := t.normalizeTags(vt.Tags)
+		if err := t.checkLength(vt.Value, vtags); err != nil {
+			return err
+		}
+
+		p, err := t.tagPositions(vtags)
+		if err != nil {
+			return err
+		}
+
+		values = append(values, vt.Value)
+		for i, tag := range vtags {
+			if p[tag] != i {
+				continue
+			}
+
+			set = append(set, &Entry{
+				Value:    vt.Value,
+				Tag:      tag,
+				TagIndex: t.tagIndex(i, len(vtags)),
+			})
+		}
+	}
+
+	return t.writeBatch(bw, "set batch", set, values)
+}
+
+// writeBatch stores the associations in a single storage transaction, and updates the cache once per affected
+// tag. When the cache fails, the tag is dropped from the cache.
+func (t *TagStash) writeBatch(bw BatchWriter, op string, set []*Entry, values []string) error {
+	if len(set) == 0 {
+		return nil
+	}
+
+	var tags []string
+	byTag := make(map[string][]*Entry)
+	for _, e := range set {
+		if _, ok := byTag[e.Tag]; !ok {
+			tags = append(tags, e.Tag)
+		}
+
+		byTag[e.Tag] = append(byTag[e.Tag], e)
+	}
+
+	defer t.observe(op, tags)()
+	defer t.reverse.invalidate(values...)
+
+	if err := t.storageWriteBatch(bw, set, nil); err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if err := t.cacheWriteTag(tag, byTag[tag]); err != nil {
+			if err := t.cache.Delete(tag); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type entriesSetter interface {
+	setEntries(string, []*Entry) error
+}
+
+// cacheWriteTag updates the cache after multiple stored associations of the same tag, according to the
+// CacheMode option. When the cache supports it, the associations are written with a single update.
+func (t *TagStash) cacheWriteTag(tag string, e []*Entry) error {
+	es, ok := t.cache.(entriesSetter)
+	if !ok || t.cacheMode == WriteAround {
+		for _, ei := range e {
+			if err := t.cacheWrite(ei); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return es.setEntries(tag, e)
+}
+
+// cacheWrite updates the cache after a stored association, according to the CacheMode option.
+func (t *TagStash) cacheWrite(e *Entry) error {
+	if t.cacheMode != WriteAround {
+		return t.cacheUpdate(e)
+	}
+
+	if ti, ok := t.cache.(tagInvalidator); ok {
+		ti.invalidate(e.Tag)
+		return nil
+	}
+
+	return t.cache.Delete(e.Tag)
+}
+
+// previousEntries returns the current associations of a value with the provided tags, keyed by the tag, so
+// that a rolled back Set() can restore them.
+func (t *TagStash) previousEntries(value string, tags []string) (map[string]*Entry, error) {
+	var (
+		e   []*Entry
+		err error
+	)
+
+	if vl, ok := t.storage.(ValueEntryLookup); ok {
+		e, err = t.storageGetValueEntries(vl, value)
+	} else {
+		e, err = t.storageGet(tags)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	previous := make(map[string]*Entry)
+	for _, ei := range e {
+		if ei.Value == value {
+			// the entries returned by the storage are not kept
+			p := *ei
+			previous[ei.Tag] = &p
+		}
+	}
+
+	return previous, nil
+}
+
+// cacheSetFailed handles a failed cache write after the storage was updated, according to the
+// CacheWriteFailure option.
+func (t *TagStash) cacheSetFailed(written []*Entry, previous map[string]*Entry, err error) error {
+	switch t.cacheWriteFailure {
+	case RollbackOnCacheFailure:
+		for _, e := range written {
+			if p, ok := previous[e.Tag]; ok {
+				t.storageSet(p)
+				t.cacheUpdate(p)
+				continue
+			}
+
+			t.storageRemove(e)
+			t.cache.Remove(e)
+		}
+
+		return err
+	case AcceptCacheDivergence:
+		return err
+	default:
+		return t.cache.Delete(written[len(written)-1].Tag)
+	}
+}
+
+// MoveTag moves a tag of a value to a new position in the order of its tags, and renumbers the rest of the
+// tags of the value accordingly. Positions out of range are clamped. It returns ErrNoAssociation, if the value
+// is not associated with the tag, and ErrNotSupported, if the storage implementation doesn't support looking
+// up the associations of a value or writing in batches. The storage applies the changes in a single
+// transaction.
+func (t *TagStash) MoveTag(value, tag string, newIndex int) error {
+	vl, ok := t.storage.(ValueEntryLookup)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	bw, ok := t.storage.(BatchWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	tag = t.normalizeTag(tag)
+	stored, err := t.storageGetValueEntries(vl, value)
+	if err != nil {
+		return err
+	}
+
+	var (
+		entries []*Entry
+		moved   *Entry
+	)
+
+	for _, e := range stored {
+		// the entries returned by the storage are not modified
+		ei := *e
+		if ei.Tag == tag {
+			moved = &ei
+			continue
+		}
+
+		entries = append(entries, &ei)
+	}
+
+	if moved == nil {
+		return ErrNoAssociation
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].TagIndex < entries[j].TagIndex })
+
+	n := len(entries) + 1
+	if newIndex < 0 {
+		newIndex = 0
+	} else if newIndex >= n {
+		newIndex = n - 1
+	}
+
+	newIndex = t.tagIndex(newIndex, n)
+	defer t.reverse.invalidate(value)
+
+	entries = append(entries, nil)
+	copy(entries[newIndex+1:], entries[newIndex:])
+	entries[newIndex] = moved
+
+	var set []*Entry
+	for i, e := range entries {
+		if e.TagIndex == i {
+			continue
+		}
+
+		e.TagIndex = i
+		set = append(set, e)
+	}
+
+	if len(set) == 0 {
+		return nil
+	}
+
+	if err := t.storageWriteBatch(bw, set, nil); err != nil {
+		return err
+	}
+
+	for _, e := range set {
+		if err := t.cacheUpdate(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SyncTags sets the complete, ordered list of tags of a value. It stores the listed tags the same way as
+// Set(), removes the tags of the value that are not listed, and returns the tags that were added, in the
+// order of the arguments, and the tags that were removed, sorted. The storage applies the changes in a single
+// transaction. When the cache fails after the storage was updated, the affected tags are dropped from the
+// cache, regardless of the CacheWriteFailure option. It returns ErrNotSupported, if the storage
+// implementation doesn't support looking up the tags of a value or writing in batches.
+func (t *TagStash) SyncTags(value string, tags ...string) (added []string, removed []string, err error) {
+	tl, ok := t.storage.(TagLookup)
+	if !ok {
+		return nil, nil, ErrNotSupported
+	}
+
+	bw, ok := t.storage.(BatchWriter)
+	if !ok {
+		return nil, nil, ErrNotSupported
+	}
+
+	tags = t.normalizeTags(tags)
+	defer t.observe("sync", tags)()
+
+	if err := t.checkLength(value, tags); err != nil {
+		return nil, nil, err
+	}
+
+	p, err := t.tagPositions(tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	current, err := t.storageGetTags(tl, value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exists := make(map[string]bool)
+	for _, tag := range current {
+		exists[tag] = true
+	}
+
+	var set, remove []*Entry
+	for i, tag := range tags {
+		if p[tag] != i {
+			continue
+		}
+
+		set = append(set, &Entry{
+			Value:    value,
+			Tag:      tag,
+			TagIndex: t.tagIndex(i, len(tags)),
+		})
+
+		if !exists[tag] {
+			added = append(added, tag)
+		}
+	}
+
+	for tag := range exists {
+		if _, ok := p[tag]; !ok {
+			remove = append(remove, &Entry{Value: value, Tag: tag})
+			removed = append(removed, tag)
+		}
+	}
+
+	sort.Strings(removed)
+	if len(set) == 0 && len(remove) == 0 {
+		return nil, nil, nil
+	}
+
+	defer t.reverse.invalidate(value)
+	if err := t.storageWriteBatch(bw, set, remove); err != nil {
+		return nil, nil, err
+	}
+
+	for _, e := range set {
+		if err := t.cacheUpdate(e); err != nil {
+			if err := t.cache.Delete(e.Tag); err != nil {
+				return added, removed, err
+			}
+		}
+	}
+
+	for _, e := range remove {
+		if err := t.cache.Remove(e); err != nil {
+			if err := t.cache.Delete(e.Tag); err != nil {
+				return added, removed, err
+			}
+		}
+	}
+
+	return added, removed, nil
+}
+
+// Remove deletes a value-tag association. When the cache fails after the association was removed from the
+// storage, the tag is dropped from the cache. The removal cannot be rolled back, because the tag index of the
+// removed association is not known, so RollbackOnCacheFailure only makes it return the error of the cache,
+// and with AcceptCacheDivergence, the cache is left untouched.
+func (t *TagStash) Remove(value string, tag string) (err error) {
+	if t.observer != nil {
+		start := t.clock.Now()
+		defer func() { t.observer.ObserveRemove(t.clock.Now().Sub(start), err) }()
+	}
+
+	tag = t.normalizeTag(tag)
+	e := &Entry{Value: value, Tag: tag}
+	defer t.reverse.invalidate(value)
+
+	if err := t.storageRemove(e); err != nil {
+		return err
+	}
+
+	if err := t.cache.Remove(e); err != nil {
+		if t.cacheWriteFailure == AcceptCacheDivergence {
+			return err
+		}
+
+		if err := t.cache.Delete(tag); err != nil {
+			return err
+		}
+
+		if t.cacheWriteFailure == RollbackOnCacheFailure {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete deletes all associations of a tag. The tag is dropped from the cache after it was deleted from the
+// storage, so that a concurrent query cannot cache the associations that are being deleted.
+func (t *TagStash) Delete(tag string) (err error) {
+	if t.observer != nil {
+		start := t.clock.Now()
+		defer func() { t.observer.ObserveDelete(t.clock.Now().Sub(start), err) }()
+	}
+
+	tag = t.normalizeTag(tag)
+	defer t.reverse.invalidateTags(tag)
+	if err := t.storageDelete(tag); err != nil {
+		return err
+	}
+
+	return t.cache.Delete(tag)
+}
+
+// DeleteValues deletes all the associations of the provided values, and drops their tags from the cache. The
+// storage deletes the associations in a single transaction, and returns the tags of the deleted associations,
+// so that exactly the affected tags are dropped from the cache. It returns ErrNotSupported if the storage
+// implementation doesn't support this operation.
+func (t *TagStash) DeleteValues(values ...string) error {
+	vd, ok := t.storage.(ValueDeleter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	defer t.reverse.invalidate(values...)
+
+	tags, _, err := t.storageDeleteValues(vd, values)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if err := t.cache.Delete(tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteValue deletes all the associations of a value, e.g. when the content it refers to was removed, the
+// same way as DeleteValues(). It returns ErrNotSupported if the storage implementation doesn't support
+// deleting values.
+func (t *TagStash) DeleteValue(value string) error {
+	return t.DeleteValues(value)
+}
+
+// SetTagValues sets exactly the provided values for a tag: it deletes the current associations of the tag,
+// and associates the tag with the provided values, in a single transaction, so that the readers never see
+// the tag partially updated. The tag index of each association is the position of the value in the
+// arguments. When a value is listed multiple times, its first position is used. The tag is dropped from the
+// cache. It returns ErrNotSupported if the storage implementation doesn't support replacing a tag.
+func (t *TagStash) SetTagValues(tag string, values ...string) error {
+	tr, ok := t.storage.(TagReplacer)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	tag = t.normalizeTag(tag)
+	for _, v := range values {
+		if err := t.checkLength(v, []string{tag}); err != nil {
+			return err
+		}
+	}
+
+	var (
+		e    []*Entry
+		seen = make(map[string]bool)
+	)
+
+	for i, v := range values {
+		if seen[v] {
+			continue
+		}
+
+		seen[v] = true
+		e = append(e, &Entry{Value: v, Tag: tag, TagIndex: i})
+	}
+
+	defer t.reverse.invalidateTags(tag)
+	defer t.reverse.invalidate(values...)
+
+	if err := t.storageReplaceTag(tr, tag, e); err != nil {
+		return err
+	}
+
+	return t.cache.Delete(tag)
+}
+
+// MergeTags moves the associations of the source tag to the destination tag, and deletes the source tag. The
+// values associated with both tags get the tag index defined by the policy, the rest keep their tag index. The
+// storage applies the changes in a single transaction, and both tags are dropped from the cache. It returns
+// ErrNotSupported if the storage implementation doesn't support this operation.
+func (t *TagStash) MergeTags(source, dest string, p MergePolicy) error {
+	tm, ok := t.storage.(TagMerger)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	source, dest = t.normalizeTag(source), t.normalizeTag(dest)
+	if source == dest {
+		return nil
+	}
+
+	defer t.reverse.invalidateTags(source, dest)
+	if err := t.storageMergeTags(tm, source, dest, p); err != nil {
+		return err
+	}
+
+	if err := t.cache.Delete(source); err != nil {
+		return err
+	}
+
+	return t.cache.Delete(dest)
+}
+
+// RenameTag renames a tag for all its values, the same way as MergeTags() with KeepMinIndex: the values that
+// already have the new tag keep a single association with it, with the lower of the two tag indexes. It
+// returns ErrNotSupported if the storage implementation doesn't support merging tags.
+func (t *TagStash) RenameTag(old, new string) error {
+	return t.MergeTags(old, new, KeepMinIndex)
+}
+
+// RenameValue moves all the associations of a value to a new value, keeping their tag index, expiration and
+// weight. When the new value is already associated with a tag, it keeps its existing association and tag
+// index. The storage applies the changes in a single transaction, and the affected tags are dropped from the
+// cache. It returns ErrNotSupported if the storage implementation doesn't support looking up the associations
+// of a value or writing in batches.
+func (t *TagStash) RenameValue(old, new string) error {
+	vl, ok := t.storage.(ValueEntryLookup)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	bw, ok := t.storage.(BatchWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	if old == new {
+		return nil
+	}
+
+	if err := t.checkLength(new, nil); err != nil {
+		return err
+	}
+
+	current, err := t.storageGetValueEntries(vl, old)
+	if err != nil {
+		return err
+	}
+
+	existing, err := t.storageGetValueEntries(vl, new)
+	if err != nil {
+		return err
+	}
+
+	has := make(map[string]bool)
+	for _, e := range existing {
+		has[e.Tag] = true
+	}
+
+	var set, remove []*Entry
+	for _, e := range current {
+		remove = append(remove, &Entry{Value: old, Tag: e.Tag})
+		if !has[e.Tag] {
+			set = append(set, &Entry{Value: new, Tag: e.Tag, TagIndex: e.TagIndex, Expires: e.Expires, Weight: e.Weight})
+		}
+	}
+
+	if len(remove) == 0 {
+		return nil
+	}
+
+	defer t.reverse.invalidate(old, new)
+	if err := t.storageWriteBatch(bw, set, remove); err != nil {
+		return err
+	}
+
+	for _, e := range remove {
+		if err := t.cache.Delete(e.Tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IncrementScore adds to the score of a value, used for ranking with the RankByScore option. It returns
+// ErrNotSupported if the storage implementation doesn't support scores.
+func (t *TagStash) IncrementScore(value string, by int) error {
+	ss, ok := t.storage.(ScoreStorage)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	defer t.startQuery()()
+	return ss.IncrementScore(value, by)
+}
+
+// DeleteExpired deletes the expired associations, and returns the number of the deleted associations. It
+// returns ErrNotSupported if the storage implementation doesn't support expiration.
+func (t *TagStash) DeleteExpired() (int, error) {
+	es, ok := t.storage.(ExpiringStorage)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+
+	tags, n, err := t.storageDeleteExpired(es)
+	if err != nil {
+		return 0, err
+	}
+
+	t.reverse.invalidateTags(tags...)
+
+	for _, tag := range tags {
+		if err := t.cache.Delete(tag); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// DeleteOlderThan deletes the associations that were created earlier than the provided duration ago, and
+// returns the number of the deleted associations. It returns ErrNotSupported if the storage implementation
+// doesn't support this operation.
+//
+// When the default storage upgrades a database created by an earlier version, the existing associations get
+// the time of the upgrade as their creation time. Associations stored without a creation time, e.g. by
+// external tools, are never deleted by this method.
+func (t *TagStash) DeleteOlderThan(d time.Duration) (int, error) {
+	ac, ok := t.storage.(AgeCleaner)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+
+	tags, n, err := t.storageDeleteOlderThan(ac, t.clock.Now().Add(-d))
+	if err != nil {
+		return 0, err
+	}
+
+	t.reverse.invalidateTags(tags...)
+
+	for _, tag := range tags {
+		if err := t.cache.Delete(tag); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// CacheStats returns the counters of the cache, e.g. to monitor the hit rate when tuning the cache size. It
+// returns ErrNotSupported if the cache implementation doesn't report its counters.
+func (t *TagStash) CacheStats() (CacheStats, error) {
+	sr, ok := t.cache.(CacheStatsReporter)
+	if !ok {
+		return CacheStats{}, ErrNotSupported
+	}
+
+	return sr.CacheStats(), nil
+}
+
+// Reconcile ensures that every association held by the cache exists in the persistent storage, and stores
+// the missing ones with their cached tag index. The existing associations in the storage are not changed.
+// It is meant as a safety net for custom cache and storage implementations that don't guarantee that the
+// storage is written before the cache. It returns ErrNotSupported if the cache implementation cannot list
+// its tags.
+func (t *TagStash) Reconcile() error {
+	cl, ok := t.cache.(CacheTagLister)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	tags := cl.CachedTags()
+	if len(tags) == 0 {
+		return nil
+	}
+
+	cached, err := t.cache.Get(tags)
+	if err != nil {
+		return err
+	}
+
+	stored, err := t.storageGet(tags)
+	if err != nil {
+		return err
+	}
+
+	type key struct{ value, tag string }
+	exists := make(map[key]bool)
+	for _, e := range stored {
+		exists[key{e.Value, e.Tag}] = true
+	}
+
+	for _, e := range cached {
+		if exists[key{e.Value, e.Tag}] {
+			continue
+		}
+
+		if err := t.storageSet(e); err != nil {
+			return err
+		}
+
+		t.reverse.invalidate(e.Value)
+	}
+
+	return nil
+}
+
+// ValidateTag compares the values associated with a tag in the cache and in the persistent storage. It returns
+// whether they match, and the sorted values found only in the cache or only in the storage. When the cache
+// can list its tags, and the tag is not cached, the tag is considered consistent. It is meant as a diagnostic
+// for a single tag, cheaper than comparing the whole cache.
+func (t *TagStash) ValidateTag(tag string) (consistent bool, cacheOnly []string, storageOnly []string, err error) {
+	tag = t.normalizeTag(tag)
+	if cl, ok := t.cache.(CacheTagLister); ok {
+		var cached bool
+		for _, ct := range cl.CachedTags() {
+			if ct == tag {
+				cached = true
+				break
+			}
+		}
+
+		if !cached {
+			return true, nil, nil, nil
+		}
+	}
+
+	cached, err := t.cache.Get([]string{tag})
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	stored, err := t.storageGet([]string{tag})
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	inStorage := make(map[string]bool)
+	for _, e := range stored {
+		inStorage[e.Value] = true
+	}
+
+	inCache := make(map[string]bool)
+	for _, e := range cached {
+		inCache[e.Value] = true
+		if !inStorage[e.Value] {
+			cacheOnly = append(cacheOnly, e.Value)
+		}
+	}
+
+	for _, e := range stored {
+		if !inCache[e.Value] {
+			storageOnly = append(storageOnly, e.Value)
+		}
+	}
+
+	sort.Strings(cacheOnly)
+	sort.Strings(storageOnly)
+	return len(cacheOnly) == 0 && len(storageOnly) == 0, cacheOnly, storageOnly, nil
+}
+
+// Acquire registers an additional owner of a stash shared by multiple components. Every call to Acquire needs
+// to be followed by a call to Close, when the component doesn't use the stash anymore. It is safe to call
+// from multiple goroutines. It needs to be called before the stash is closed by its last owner.
+func (t *TagStash) Acquire() {
+	t.refMx.Lock()
+	defer t.refMx.Unlock()
+	t.refs++
+}
+
+// Close releases an owner of the stash registered with New or Acquire. When the last owner releases it, it
+// releases all resources. Calling Close after the stash was released has no effect.
+func (t *TagStash) Close() {
+	t.refMx.Lock()
+	defer t.refMx.Unlock()
+
+	if t.refs == 0 {
+		return
+	}
+
+	t.refs--
+	if t.refs > 0 {
+		return
+	}
+
+	if t.sweepQuit != nil {
+		close(t.sweepQuit)
+		<-t.sweepDone
+	}
+
 	t.cache.Close()
 	t.storage.Close()
 }
@@ -1,17 +1,29 @@
 package tagstash
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aryszka/keyval"
 	sqlcmd "github.com/aryszka/tagstash/sql"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
 	testSqliteSource = "test-data.sqlite"
 	testPQSource     = "user=tagstash dbname=tagstash-test sslmode=disable"
+	testBoltSource   = "test-data.bolt"
 )
 
 func stringSetsEqual(left, right []string) bool {
@@ -36,7 +48,7 @@ func stringSetsEqual(left, right []string) bool {
 	return true
 }
 
-func newTestStash() *TagStash {
+func newTestStorageOptions() StorageOptions {
 	so := StorageOptions{
 		DriverName: os.Getenv("TEST_DB"),
 	}
@@ -65,11 +77,24 @@ func newTestStash() *TagStash {
 		}
 	}
 
+	return so
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func (c *testClock) forward(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestStashClock(c Clock) *TagStash {
 	ts, err := New(Options{
-		StorageOptions: so,
+		StorageOptions: newTestStorageOptions(),
 		CacheOptions: CacheOptions{
 			CacheSize: 1 << 12,
 		},
+		Clock: c,
 	})
 
 	if err != nil {
@@ -79,6 +104,10 @@ func newTestStash() *TagStash {
 	return ts
 }
 
+func newTestStash() *TagStash {
+	return newTestStashClock(nil)
+}
+
 func Test(t *testing.T) {
 	t.Run("empty stash", func(t *testing.T) {
 		stash := newTestStash()
@@ -89,6 +118,21 @@ func Test(t *testing.T) {
 		}
 	})
 
+	t.Run("no tags", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org", "foo")
+
+		if _, err := stash.Get(); err != ErrNoTags {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if _, err := stash.GetAll(); err != ErrNoTags {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
 	t.Run("not found", func(t *testing.T) {
 		stash := newTestStash()
 		defer stash.Close()
@@ -186,6 +230,160 @@ func TestGetAll(t *testing.T) {
 	})
 }
 
+func TestLookup(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org", "foo")
+
+	for _, test := range []struct {
+		tag   string
+		value string
+		found bool
+	}{
+		{"foo", "https://www.example.org", true},
+		{"bar", "", false},
+	} {
+		v, found, err := stash.Lookup(test.tag)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if v != test.value || found != test.found {
+			t.Error("invalid lookup", test.tag, v, found)
+		}
+	}
+}
+
+func TestGetRanked(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+	stash.Set("https://www.example.org/page2", "bar", "foo")
+	stash.Set("https://www.example.org/page3", "baz")
+
+	v, err := stash.GetRanked("foo", "bar")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(v) != 2 ||
+		v[0] != (RankedValue{Value: "https://www.example.org/page1", Rank: 1, MatchCount: 2}) ||
+		v[1] != (RankedValue{Value: "https://www.example.org/page2", Rank: 2, MatchCount: 2, IndexDelta: 2}) {
+		t.Error("invalid ranking", v)
+	}
+}
+
+func TestDuplicateAssociations(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "foo")
+
+	// the first query reads the storage, the second one the cache
+	for i := 0; i < 2; i++ {
+		v, err := stash.GetRanked("foo", "foo", "bar")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(v) != 2 || v[0].MatchCount != 2 || v[1].MatchCount != 1 {
+			t.Error("invalid ranking", i, v)
+		}
+	}
+}
+
+func TestGetTiered(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+	stash.Set("https://www.example.org/page2", "baz", "qux")
+	stash.Set("https://www.example.org/page3", "foo", "qux")
+	stash.Set("https://www.example.org/page4", "qux", "quux", "bar")
+
+	tiers, err := stash.GetTiered("foo", "bar", "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tiers) != 2 ||
+		len(tiers[3]) != 1 || tiers[3][0] != "https://www.example.org/page1" ||
+		len(tiers[1]) != 3 || tiers[1][0] != "https://www.example.org/page3" {
+		t.Error("invalid tiers", tiers)
+	}
+}
+
+func TestGetAllChan(t *testing.T) {
+	t.Run("values", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "foo", "qux")
+
+		values, errs := stash.GetAllChan(nil, "foo", "bar")
+
+		var v []string
+		for vi := range values {
+			v = append(v, vi)
+		}
+
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+
+		if len(v) != 2 || v[0] != "https://www.example.org/page1" || v[1] != "https://www.example.org/page2" {
+			t.Error("failed to receive the values", v)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		values, errs := stash.GetAllChan(nil)
+		for range values {
+			t.Error("unexpected value")
+		}
+
+		if err := <-errs; err != ErrNoTags {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("stop early", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo")
+		stash.Set("https://www.example.org/page2", "foo")
+		stash.Set("https://www.example.org/page3", "foo")
+
+		done := make(chan struct{})
+		values, errs := stash.GetAllChan(done, "foo")
+		if _, ok := <-values; !ok {
+			t.Fatal("failed to receive a value")
+		}
+
+		// the error channel is closed when the producer stops, without reading the rest of the values
+		close(done)
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(time.Second):
+			t.Error("failed to stop sending the values")
+		}
+	})
+}
+
 func TestGetTags(t *testing.T) {
 	t.Run("from storage", func(t *testing.T) {
 		stash := newTestStash()
@@ -233,6 +431,102 @@ func TestGetTags(t *testing.T) {
 	})
 }
 
+func TestCacheWriteFailure(t *testing.T) {
+	newStash := func(f CacheWriteFailure) (*TagStash, *mockStorage, *mockStorage) {
+		s, c := &mockStorage{}, &mockStorage{}
+		stash, err := New(Options{Storage: s, Cache: c, CacheWriteFailure: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stash.Set("https://www.example.org/page1", "foo")
+		if _, err := stash.GetAll("foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		c.failNextWrite = true
+		return stash, s, c
+	}
+
+	t.Run("invalidate", func(t *testing.T) {
+		stash, s, c := newStash(InvalidateOnCacheFailure)
+		defer stash.Close()
+
+		if err := stash.Set("https://www.example.org/page2", "foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.entries) != 2 || len(c.entries) != 0 {
+			t.Error("failed to invalidate the cache", len(s.entries), len(c.entries))
+		}
+
+		v, err := stash.GetAll("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 2 {
+			t.Error("failed to read from the storage", v)
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		stash, s, _ := newStash(RollbackOnCacheFailure)
+		defer stash.Close()
+
+		if err := stash.Set("https://www.example.org/page2", "foo"); err != errForgedError {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if len(s.entries) != 1 || s.entries[0].Value != "https://www.example.org/page1" {
+			t.Error("failed to roll back the storage", mapEntries(s.entries...))
+		}
+	})
+
+	t.Run("rollback restores updated associations", func(t *testing.T) {
+		stash, s, c := newStash(RollbackOnCacheFailure)
+		defer stash.Close()
+
+		c.failNextWrite = false
+		if err := stash.Set("https://www.example.org/page1", "bar", "foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		c.failNextWrite = true
+		if err := stash.Set("https://www.example.org/page1", "foo"); err != errForgedError {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		e, err := s.Get([]string{"foo", "bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(e) != 2 {
+			t.Fatal("failed to restore the storage", len(e))
+		}
+
+		for _, ei := range e {
+			if ei.Tag == "foo" && ei.TagIndex != 1 {
+				t.Error("failed to restore the tag index", ei.TagIndex)
+			}
+		}
+	})
+
+	t.Run("accept divergence", func(t *testing.T) {
+		stash, s, c := newStash(AcceptCacheDivergence)
+		defer stash.Close()
+
+		if err := stash.Set("https://www.example.org/page2", "foo"); err != errForgedError {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if len(s.entries) != 2 || len(c.entries) != 1 {
+			t.Error("unexpected state", len(s.entries), len(c.entries))
+		}
+	})
+}
+
 func TestSetFailsInStorage(t *testing.T) {
 	stash := newTestStash()
 	defer stash.Close()
@@ -249,6 +543,50 @@ func TestSetFailsInStorage(t *testing.T) {
 	}
 }
 
+func TestRemoveFails(t *testing.T) {
+	t.Run("in storage", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		s := &mockStorage{}
+		stash.storage = s
+
+		stash.Set("https://www.example.org", "foo")
+		if _, err := stash.GetAll("foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		s.failNextWrite = true
+		if err := stash.Remove("https://www.example.org", "foo"); err == nil {
+			t.Error("failed to fail")
+		}
+
+		if v, err := stash.Get("foo"); err != nil || v != "https://www.example.org" {
+			t.Error("unexpected change of the cache", v, err)
+		}
+	})
+
+	t.Run("in cache", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.cache.Close()
+		c := &mockStorage{}
+		stash.cache = c
+
+		stash.Set("https://www.example.org", "foo")
+		c.failNextWrite = true
+		if err := stash.Remove("https://www.example.org", "foo"); err != nil {
+			t.Error(err)
+		}
+
+		if v, err := stash.Get("foo"); err != nil || v != "" {
+			t.Error("unexpected hit", v, err)
+		}
+	})
+}
+
 func TestDamagedCache(t *testing.T) {
 	t.Run("full range damaged", func(t *testing.T) {
 		stash := newTestStash()
@@ -308,6 +646,7 @@ func TestDamagedCache(t *testing.T) {
 		stash := newTestStash()
 		defer stash.Close()
 
+		stash.cacheWriteFailure = AcceptCacheDivergence
 		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
 		stash.cache.(*cache).forget.SetBytes("foo", []byte{'['}, forEver)
 
@@ -315,6 +654,32 @@ func TestDamagedCache(t *testing.T) {
 			t.Error("failed to detect damaged cache")
 		}
 	})
+
+	t.Run("evict damaged entry on append", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.cache.Close()
+		stash.cache = newCache(CacheOptions{CacheSize: 1 << 12, EvictOnCorruption: true})
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.cache.(*cache).forget.SetBytes("foo", []byte{'['}, forEver)
+
+		if err := stash.Set("https://www.example.org/page2", "foo"); err != nil {
+			t.Error(err)
+			return
+		}
+
+		v, err := stash.GetAll("foo")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !stringSetsEqual(v, []string{"https://www.example.org/page1", "https://www.example.org/page2"}) {
+			t.Error("failed to evict the damaged entry", v)
+		}
+	})
 }
 
 func TestOversize(t *testing.T) {
@@ -322,6 +687,7 @@ func TestOversize(t *testing.T) {
 		stash := newTestStash()
 		defer stash.Close()
 
+		stash.cacheWriteFailure = AcceptCacheDivergence
 		stash.cache.Close()
 		stash.cache = newCache(CacheOptions{
 			CacheSize:        1 << 8,
@@ -333,7 +699,11 @@ func TestOversize(t *testing.T) {
 			large[i] = 42
 		}
 
-		if err := stash.Set("123456789", string(large)); err == nil {
+		if err := stash.Set("123456789", string(large)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := stash.GetAll(string(large)); err == nil {
 			t.Error("failed to fail")
 		}
 	})
@@ -342,6 +712,7 @@ func TestOversize(t *testing.T) {
 		stash := newTestStash()
 		defer stash.Close()
 
+		stash.cacheWriteFailure = AcceptCacheDivergence
 		stash.cache.Close()
 		stash.cache = newCache(CacheOptions{
 			CacheSize:        1 << 8,
@@ -353,50 +724,176 @@ func TestOversize(t *testing.T) {
 			large[i] = 42
 		}
 
-		if err := stash.Set(string(large), "123456"); err == nil {
+		if err := stash.Set(string(large), "123456"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := stash.GetAll("123456"); err == nil {
 			t.Error("failed to fail")
 		}
 	})
 }
 
-func TestWriteFails(t *testing.T) {
-	t.Run("get", func(t *testing.T) {
+func TestSkipOnOverflow(t *testing.T) {
+	t.Run("tag too large", func(t *testing.T) {
 		stash := newTestStash()
 		defer stash.Close()
 
-		stash.storage.Close()
-		stash.storage = &mockStorage{}
+		stash.cache.Close()
+		stash.cache = newCache(CacheOptions{
+			CacheSize:        1 << 8,
+			ExpectedItemSize: 1 << 6,
+			Overflow:         SkipOnOverflow,
+		})
 
-		if err := stash.Set("https://www.example.org", "foo"); err != nil {
-			t.Error("failed to set initial item")
-			return
+		large := make([]byte, 512)
+		for i := range large {
+			large[i] = 42
 		}
 
-		stash.cache.Delete("foo")
-		stash.storage.(*mockStorage).failNext = true
+		if err := stash.Set("123456789", string(large)); err != nil {
+			t.Error(err)
+		}
 
-		if _, err := stash.Get("foo"); err == nil {
-			t.Error("failed to fail")
+		if v, err := stash.Get(string(large)); err != nil || v != "123456789" {
+			t.Error("failed to get the value from the storage", v, err)
 		}
 	})
 
-	t.Run("set", func(t *testing.T) {
+	t.Run("value too large", func(t *testing.T) {
 		stash := newTestStash()
 		defer stash.Close()
 
 		stash.cache.Close()
-		stash.cache = &mockStorage{}
+		stash.cache = newCache(CacheOptions{
+			CacheSize:        1 << 8,
+			ExpectedItemSize: 1 << 6,
+			Overflow:         SkipOnOverflow,
+		})
 
-		if err := stash.Set("https://www.example.org", "foo"); err != nil {
-			t.Error("failed to set initial item")
-			return
+		large := make([]byte, 512)
+		for i := range large {
+			large[i] = 42
 		}
 
-		stash.cache.Delete("foo")
-		stash.cache.(*mockStorage).failNextWrite = true
+		if err := stash.Set(string(large), "123456"); err != nil {
+			t.Error(err)
+		}
 
-		if _, err := stash.Get("foo"); err == nil {
-			t.Error("failed to fail")
+		if v, err := stash.Get("123456"); err != nil || v != string(large) {
+			t.Error("failed to get the value from the storage", len(v), err)
+		}
+	})
+
+	t.Run("too many values", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.cache.Close()
+		stash.cache = newCache(CacheOptions{
+			CacheSize:        1 << 8,
+			ExpectedItemSize: 1 << 6,
+			Overflow:         SkipOnOverflow,
+		})
+
+		var values []string
+		for i := 0; i < 24; i++ {
+			v := fmt.Sprintf("https://www.example.org/page%d", i)
+			if err := stash.Set(v, "foo"); err != nil {
+				t.Error(err)
+				return
+			}
+
+			values = append(values, v)
+		}
+
+		for i := 0; i < 2; i++ {
+			v := fmt.Sprintf("https://www.example.org/more%d", i)
+			if err := stash.Set(v, "foo"); err != nil {
+				t.Error(err)
+				return
+			}
+
+			values = append(values, v)
+			if all, err := stash.GetAll("foo"); err != nil || !stringSetsEqual(all, values) {
+				t.Error("failed to get all the values", len(all), len(values), err)
+			}
+		}
+	})
+}
+
+func TestMaxTagEntries(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.cache.Close()
+	stash.cache = newCache(CacheOptions{
+		CacheSize:     1 << 12,
+		MaxTagEntries: 3,
+	})
+
+	var values []string
+	for i := 0; i < 5; i++ {
+		v := fmt.Sprintf("https://www.example.org/page%d", i)
+		if err := stash.Set(v, "foo", "bar"); err != nil {
+			t.Error(err)
+			return
+		}
+
+		values = append(values, v)
+	}
+
+	stash.Set("https://www.example.org/page0", "baz")
+
+	for i := 0; i < 2; i++ {
+		if v, err := stash.GetAll("foo", "bar", "baz"); err != nil || !stringSetsEqual(v, values) {
+			t.Error("failed to get all the values", v, err)
+		}
+	}
+
+	if cached, err := stash.cache.Get([]string{"foo", "bar", "baz"}); err != nil || len(cached) != 1 || cached[0].Tag != "baz" {
+		t.Error("failed to limit the cached entries", len(cached), err)
+	}
+}
+
+func TestWriteFails(t *testing.T) {
+	t.Run("get", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorage{}
+
+		if err := stash.Set("https://www.example.org", "foo"); err != nil {
+			t.Error("failed to set initial item")
+			return
+		}
+
+		stash.cache.Delete("foo")
+		stash.storage.(*mockStorage).failNext = true
+
+		if _, err := stash.Get("foo"); err == nil {
+			t.Error("failed to fail")
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.cache.Close()
+		stash.cache = &mockStorage{}
+
+		if err := stash.Set("https://www.example.org", "foo"); err != nil {
+			t.Error("failed to set initial item")
+			return
+		}
+
+		stash.cache.Delete("foo")
+		stash.cache.(*mockStorage).failNextWrite = true
+
+		if _, err := stash.Get("foo"); err == nil {
+			t.Error("failed to fail")
 		}
 	})
 }
@@ -419,6 +916,39 @@ func TestReorder(t *testing.T) {
 	}
 }
 
+func TestReorderEvicted(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+	stash.Set("https://www.example.org/page2", "baz", "bar", "foo")
+
+	if v, err := stash.Get("foo", "baz", "bar"); err != nil || v != "https://www.example.org/page1" {
+		t.Error("failed to get the right initial value", v, err)
+	}
+
+	// the cache is not updated for an evicted tag, it is read again from the storage
+	stash.cache.(*cache).forget.Delete("baz")
+	stash.Set("https://www.example.org/page2", "foo", "baz", "bar")
+
+	for i := 0; i < 2; i++ {
+		if v, err := stash.Get("foo", "baz", "bar"); err != nil || v != "https://www.example.org/page2" {
+			t.Error("failed to get the right reordered value", i, v, err)
+		}
+	}
+
+	cached, err := stash.cache.Get([]string{"baz"})
+	if err != nil || len(cached) != 2 {
+		t.Fatal("failed to cache the tag again", len(cached), err)
+	}
+
+	for _, e := range cached {
+		if e.Value == "https://www.example.org/page2" && e.TagIndex != 1 {
+			t.Error("failed to cache the fresh tag index", e.TagIndex)
+		}
+	}
+}
+
 func TestRemoveTag(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		stash := newTestStash()
@@ -443,6 +973,7 @@ func TestRemoveTag(t *testing.T) {
 
 		stash.Set("https://www.example.org", "foo", "bar", "baz")
 
+		stash.cacheWriteFailure = AcceptCacheDivergence
 		stash.cache.(*mockStorage).failNext = true
 		if err := stash.Remove("https://www.example.org", "foo"); err == nil {
 			t.Error("failed to fail")
@@ -522,3 +1053,3653 @@ func TestClearTag(t *testing.T) {
 		}
 	})
 }
+
+func TestConcurrentCacheAccess(t *testing.T) {
+	c := newCache(CacheOptions{CacheSize: 1 << 16})
+	defer c.Close()
+
+	// Set updates only the tags that are already cached
+	tags := []string{"foo", "bar", "baz"}
+	for _, tag := range tags {
+		c.setTag(tag, []*Entry{{Value: "https://www.example.org", Tag: tag}})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := c.Get(tags); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				e := &Entry{
+					Value:    fmt.Sprintf("https://www.example.org/page%d", i),
+					Tag:      tags[j%len(tags)],
+					TagIndex: j % len(tags),
+				}
+
+				if err := c.Set(e); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func BenchmarkCacheParallelGet(b *testing.B) {
+	c := newCache(CacheOptions{CacheSize: 1 << 20})
+	defer c.Close()
+
+	tags := []string{"foo", "bar", "baz"}
+	byTag := make(map[string][]*Entry)
+	for i := 0; i < 64; i++ {
+		tag := tags[i%len(tags)]
+		byTag[tag] = append(byTag[tag], &Entry{
+			Value:    fmt.Sprintf("https://www.example.org/page%d", i),
+			Tag:      tag,
+			TagIndex: i % len(tags),
+		})
+	}
+
+	for tag, entries := range byTag {
+		c.setTag(tag, entries)
+	}
+
+	// the exclusive case serializes the readers the same way as the cache did before using a read
+	// lock in Get
+	var exclusive sync.Mutex
+	for _, bench := range []struct {
+		name string
+		get  func() error
+	}{{
+		name: "exclusive",
+		get: func() error {
+			exclusive.Lock()
+			defer exclusive.Unlock()
+			_, err := c.Get(tags)
+			return err
+		},
+	}, {
+		name: "shared",
+		get: func() error {
+			_, err := c.Get(tags)
+			return err
+		},
+	}} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := bench.get(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDeleteOlderThan(t *testing.T) {
+	t.Run("keeps newer", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org", "foo", "bar")
+		if n, err := stash.DeleteOlderThan(time.Hour); err != nil || n != 0 {
+			t.Error("failed to keep associations", n, err)
+		}
+
+		if v, err := stash.Get("foo"); err != nil || v != "https://www.example.org" {
+			t.Error("failed to keep associations", v, err)
+		}
+	})
+
+	t.Run("deletes older", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org", "foo", "bar")
+		if v, err := stash.Get("foo"); err != nil || v != "https://www.example.org" {
+			t.Error("failed to get initial value", v, err)
+		}
+
+		if n, err := stash.DeleteOlderThan(0); err != nil || n != 2 {
+			t.Error("failed to delete associations", n, err)
+		}
+
+		if v, err := stash.Get("foo"); err != nil || v != "" {
+			t.Error("failed to delete associations", v, err)
+		}
+	})
+
+	t.Run("clock", func(t *testing.T) {
+		clock := &testClock{now: time.Now()}
+		stash := newTestStashClock(clock)
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar")
+		clock.forward(2 * time.Hour)
+		stash.Set("https://www.example.org/page2", "foo", "baz")
+		clock.forward(2 * time.Hour)
+
+		if n, err := stash.DeleteOlderThan(3 * time.Hour); err != nil || n != 2 {
+			t.Error("failed to delete associations", n, err)
+		}
+
+		if v, err := stash.GetAll("foo", "bar", "baz"); err != nil || len(v) != 1 || v[0] != "https://www.example.org/page2" {
+			t.Error("failed to delete the right associations", v, err)
+		}
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		so := newTestStorageOptions()
+		db, err := sql.Open(so.DriverName, so.DataSourceName)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, cmd := range []string{
+			"drop table if exists tags",
+			"create table tags (tag text not null, value text not null, tag_index int, primary key (tag, value))",
+			"insert into tags (tag, value, tag_index) values ('foo', 'https://www.example.org/page1', 0)",
+		} {
+			if _, err := db.Exec(cmd); err != nil {
+				db.Close()
+				t.Error(err)
+				return
+			}
+		}
+
+		db.Close()
+
+		clock := &testClock{now: time.Now()}
+		stash, err := New(Options{StorageOptions: so, Clock: clock})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		defer stash.Close()
+
+		clock.forward(2 * time.Hour)
+		if err := stash.Set("https://www.example.org/page2", "foo"); err != nil {
+			t.Error(err)
+			return
+		}
+
+		clock.forward(2 * time.Hour)
+		if n, err := stash.DeleteOlderThan(3 * time.Hour); err != nil || n != 1 {
+			t.Error("failed to delete the migrated association", n, err)
+		}
+
+		if v, err := stash.GetAll("foo"); err != nil || len(v) != 1 || v[0] != "https://www.example.org/page2" {
+			t.Error("failed to keep the new association", v, err)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorage{}
+
+		if _, err := stash.DeleteOlderThan(time.Hour); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestWarm(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+	stash.Set("https://www.example.org/page2", "foo", "bar")
+	for _, tag := range []string{"foo", "bar", "baz"} {
+		stash.cache.Delete(tag)
+	}
+
+	if err := stash.Warm(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := stash.Warm("foo", "bar", "foo", "qux"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cached, err := stash.cache.Get([]string{"foo", "bar", "baz"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(cached) != 4 {
+		t.Error("failed to warm the tags", len(cached))
+	}
+
+	if v, err := stash.GetAll("foo", "bar"); err != nil || len(v) != 2 {
+		t.Error("failed to query the warmed tags", v, err)
+	}
+}
+
+func TestWarmTopTags(t *testing.T) {
+	t.Run("frequency", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "foo", "bar")
+		stash.Set("https://www.example.org/page3", "foo")
+
+		c, err := stash.TagFrequency(2)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(c) != 2 ||
+			c[0].Tag != "foo" || c[0].Count != 3 ||
+			c[1].Tag != "bar" || c[1].Count != 2 {
+			t.Error("failed to get tag frequency", c)
+		}
+	})
+
+	t.Run("warm", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.cache.Close()
+		stash.cache = &mockStorage{}
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "foo", "bar")
+		stash.Set("https://www.example.org/page3", "foo")
+
+		for _, tag := range []string{"foo", "bar", "baz"} {
+			stash.cache.Delete(tag)
+		}
+
+		if err := stash.WarmTopTags(2); err != nil {
+			t.Error(err)
+			return
+		}
+
+		cached, err := stash.cache.Get([]string{"foo", "bar", "baz"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(cached) != 5 {
+			t.Error("failed to warm the top tags", len(cached))
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorage{}
+
+		if err := stash.WarmTopTags(2); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if err := stash.WarmTopTags(0); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("default cache", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar")
+		stash.Set("https://www.example.org/page2", "foo")
+		stash.cache.Delete("foo")
+		stash.cache.Delete("bar")
+
+		if err := stash.WarmTopTags(1); err != nil {
+			t.Error(err)
+			return
+		}
+
+		cached, err := stash.cache.Get([]string{"foo", "bar"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(cached) != 2 || cached[0].Tag != "foo" || cached[1].Tag != "foo" {
+			t.Error("failed to warm the top tag", len(cached))
+		}
+	})
+}
+
+func TestValuesMissingTag(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "reviewed")
+		stash.Set("https://www.example.org/page2", "foo", "bar")
+		stash.Set("https://www.example.org/page3", "bar")
+
+		v, err := stash.ValuesMissingTag("reviewed")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !stringSetsEqual(v, []string{"https://www.example.org/page2", "https://www.example.org/page3"}) {
+			t.Error("failed to get the values missing the tag", v)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorage{}
+
+		if _, err := stash.ValuesMissingTag("reviewed"); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestTagCountForValues(t *testing.T) {
+	check := func(t *testing.T, stash *TagStash) {
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "foo", "bar")
+		stash.Set("https://www.example.org/page3", "qux")
+
+		c, err := stash.TagCountForValues([]string{
+			"https://www.example.org/page1",
+			"https://www.example.org/page2",
+			"https://www.example.org/page4",
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(c) != 3 ||
+			c["https://www.example.org/page1"] != 3 ||
+			c["https://www.example.org/page2"] != 2 ||
+			c["https://www.example.org/page4"] != 0 {
+			t.Error("failed to count the tags", c)
+		}
+	}
+
+	t.Run("count", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+		check(t, stash)
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorageLookup{&mockStorage{}}
+
+		if _, err := stash.TagCountForValues([]string{"https://www.example.org"}); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+// BenchmarkCacheCompression fills a cache that is too small for all the tags, and reports the ratio of the
+// tags that are still cached, and the cached size of a tag.
+func BenchmarkCacheCompression(b *testing.B) {
+	const size = 1 << 20
+	byTag := make(map[string][]*Entry)
+	var tags []string
+	for i := 0; i < 256; i++ {
+		tag := fmt.Sprintf("tag%d", i)
+		tags = append(tags, tag)
+		for j := 0; j < 128; j++ {
+			byTag[tag] = append(byTag[tag], &Entry{
+				Value:    fmt.Sprintf("https://www.example.org/section%d/page%d", i%16, j),
+				Tag:      tag,
+				TagIndex: j % 8,
+			})
+		}
+	}
+
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "gzip"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var hits, bytes int
+			for i := 0; i < b.N; i++ {
+				c := newCache(CacheOptions{CacheSize: size, CompressEntries: compress})
+				for _, tag := range tags {
+					if err := c.setTag(tag, byTag[tag]); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				hits, bytes = 0, 0
+				for _, tag := range tags {
+					e, err := c.Get([]string{tag})
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					if len(e) > 0 {
+						hits++
+					}
+				}
+
+				// the last written tag is always cached
+				if r, ok := c.forget.Get(tags[len(tags)-1]); ok {
+					n, _ := io.Copy(io.Discard, r)
+					r.Close()
+					bytes = int(n)
+				}
+
+				c.Close()
+			}
+
+			b.ReportMetric(float64(hits)/float64(len(tags)), "hit-ratio")
+			b.ReportMetric(float64(bytes), "bytes/tag")
+		})
+	}
+}
+
+func BenchmarkCacheGetWide(b *testing.B) {
+	c := newCache(CacheOptions{CacheSize: 1 << 24})
+	defer c.Close()
+
+	tags := []string{"foo", "bar"}
+	for _, tag := range tags {
+		entries := make([]*Entry, 1<<12)
+		for i := range entries {
+			entries[i] = &Entry{
+				Value:    fmt.Sprintf("https://www.example.org/page%d", i),
+				Tag:      tag,
+				TagIndex: i % 8,
+			}
+		}
+
+		c.setTag(tag, entries)
+	}
+
+	// the collected case decodes the entries of each tag into a slice, and merges them afterwards, the
+	// way the cache was read before the streaming iteration
+	b.Run("collected", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var entries []*Entry
+			for _, t := range tags {
+				r, ok := c.forget.Get(t)
+				if !ok {
+					b.Error("missing tag")
+					return
+				}
+
+				tagEntries, err := readAll(r, t, time.Now)
+				r.Close()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+
+				entries = append(entries, tagEntries...)
+			}
+
+			m := newMerge(tags)
+			for _, e := range entries {
+				m.add(e)
+			}
+		}
+	})
+
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := newMerge(tags)
+			if err := c.each(tags, m.add); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	const snapshotPath = "test-cache.snapshot"
+
+	newStash := func(s Storage, ttl time.Duration) *TagStash {
+		ts, err := New(Options{
+			Storage: s,
+			CacheOptions: CacheOptions{
+				CacheSize:    1 << 12,
+				SnapshotPath: snapshotPath,
+				SnapshotTTL:  ttl,
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ts
+	}
+
+	setup := func(t *testing.T) {
+		if err := os.RemoveAll(snapshotPath); err != nil {
+			t.Fatal(err)
+		}
+
+		s := newStash(&mockStorage{}, 0)
+		if err := s.Set("foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Set("baz", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.GetAll("bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		s.Close()
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		setup(t)
+		defer os.RemoveAll(snapshotPath)
+
+		s := newStash(&mockStorage{}, 0)
+		defer s.Close()
+
+		v, err := s.GetAll("bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !stringSetsEqual(v, []string{"foo", "baz"}) {
+			t.Error("failed to reload the cache", v)
+		}
+	})
+
+	t.Run("no snapshot", func(t *testing.T) {
+		if err := os.RemoveAll(snapshotPath); err != nil {
+			t.Fatal(err)
+		}
+
+		defer os.RemoveAll(snapshotPath)
+
+		s := newStash(&mockStorage{}, 0)
+		defer s.Close()
+
+		v, err := s.GetAll("bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 0 {
+			t.Error("unexpected values", v)
+		}
+	})
+
+	t.Run("reloaded tags expire", func(t *testing.T) {
+		setup(t)
+		defer os.RemoveAll(snapshotPath)
+
+		s := newStash(&mockStorage{}, time.Nanosecond)
+		defer s.Close()
+
+		time.Sleep(time.Millisecond)
+		if err := s.Set("qux", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := s.GetAll("bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !stringSetsEqual(v, []string{"qux"}) {
+			t.Error("failed to expire the reloaded tag", v)
+		}
+	})
+
+	t.Run("reloaded tags expire by the clock", func(t *testing.T) {
+		setup(t)
+		defer os.RemoveAll(snapshotPath)
+
+		clock := &testClock{now: time.Now()}
+		s, err := New(Options{
+			Storage: &mockStorage{},
+			CacheOptions: CacheOptions{
+				CacheSize:    1 << 12,
+				SnapshotPath: snapshotPath,
+				SnapshotTTL:  time.Hour,
+			},
+			Clock: clock,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		clock.forward(2 * time.Hour)
+		if err := s.Set("qux", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := s.GetAll("bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !stringSetsEqual(v, []string{"qux"}) {
+			t.Error("failed to expire the reloaded tag", v)
+		}
+	})
+
+	t.Run("snapshot larger than the cache", func(t *testing.T) {
+		setup(t)
+		defer os.RemoveAll(snapshotPath)
+
+		s, err := New(Options{
+			Storage: &mockStorage{},
+			CacheOptions: CacheOptions{
+				CacheSize:    1,
+				SnapshotPath: snapshotPath,
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		v, err := s.GetAll("bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 0 {
+			t.Error("unexpected values", v)
+		}
+	})
+}
+
+type noDeleteCache struct {
+	*mockStorage
+}
+
+func (noDeleteCache) Delete(string) error { return nil }
+
+func TestCacheCheck(t *testing.T) {
+	newStash := func(c Storage, check CacheCheck) (*TagStash, error) {
+		return New(Options{
+			Storage:    &mockStorage{},
+			Cache:      c,
+			CacheCheck: check,
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		c := &mockStorage{}
+		s, err := newStash(c, FailOnInvalidCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		if s.cache != c || len(c.entries) != 0 {
+			t.Error("failed to keep the valid cache clean")
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		if _, err := newStash(noDeleteCache{&mockStorage{}}, FailOnInvalidCache); err != ErrInvalidCache {
+			t.Error("failed to detect the invalid cache", err)
+		}
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		s, err := newStash(noDeleteCache{&mockStorage{}}, DisableInvalidCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		if err := s.Set("foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Delete("bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := s.GetAll("bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 0 {
+			t.Error("failed to disable the invalid cache", v)
+		}
+	})
+
+	t.Run("no check", func(t *testing.T) {
+		c := noDeleteCache{&mockStorage{}}
+		s, err := newStash(c, NoCacheCheck)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		if s.cache != c {
+			t.Error("failed to keep the custom cache")
+		}
+	})
+}
+
+func TestGetByExactTags(t *testing.T) {
+	t.Run("exact", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "bar", "foo")
+		stash.Set("https://www.example.org/page3", "foo")
+
+		for _, test := range []struct {
+			tags   []string
+			expect string
+		}{
+			{[]string{"foo", "bar"}, "https://www.example.org/page2"},
+			{[]string{"bar", "foo", "bar"}, "https://www.example.org/page2"},
+			{[]string{"foo"}, "https://www.example.org/page3"},
+			{[]string{"baz"}, ""},
+			{[]string{"foo", "bar", "baz", "qux"}, ""},
+		} {
+			v, err := stash.GetByExactTags(test.tags...)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if v != test.expect {
+				t.Error("invalid value", test.tags, v, test.expect)
+			}
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorageLookup{&mockStorage{}}
+
+		if _, err := stash.GetByExactTags("foo"); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+type tickingClock struct {
+	now  time.Time
+	tick time.Duration
+}
+
+func (c *tickingClock) Now() time.Time {
+	now := c.now
+	c.now = c.now.Add(c.tick)
+	return now
+}
+
+func TestSlowQuery(t *testing.T) {
+	type report struct {
+		op   string
+		tags []string
+		d    time.Duration
+	}
+
+	newStash := func(tick time.Duration) (*TagStash, *[]report) {
+		var r []report
+		s, err := New(Options{
+			Storage:            &mockStorage{},
+			Clock:              &tickingClock{now: time.Now(), tick: tick},
+			SlowQueryThreshold: time.Second,
+			OnSlowQuery: func(op string, tags []string, d time.Duration) {
+				r = append(r, report{op, tags, d})
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s, &r
+	}
+
+	t.Run("slow", func(t *testing.T) {
+		s, r := newStash(2 * time.Second)
+		defer s.Close()
+
+		if err := s.Set("https://www.example.org", "foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Get("foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(*r) != 2 ||
+			(*r)[0].op != "set" || !stringSetsEqual((*r)[0].tags, []string{"foo", "bar"}) ||
+			(*r)[1].op != "query" || !stringSetsEqual((*r)[1].tags, []string{"foo"}) ||
+			(*r)[1].d != 2*time.Second {
+			t.Error("failed to report the slow operations", *r)
+		}
+	})
+
+	t.Run("fast", func(t *testing.T) {
+		s, r := newStash(time.Millisecond)
+		defer s.Close()
+
+		if err := s.Set("https://www.example.org", "foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Get("foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(*r) != 0 {
+			t.Error("unexpected report", *r)
+		}
+	})
+}
+
+func TestTagCooccurrence(t *testing.T) {
+	t.Run("cooccurrence", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "bar", "foo")
+		stash.Set("https://www.example.org/page3", "qux")
+
+		c, err := stash.TagCooccurrence(2)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(c) != 1 || c[0] != (TagPairCount{Left: "bar", Right: "foo", Count: 2}) {
+			t.Error("failed to count the cooccurrences", c)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorageLookup{&mockStorage{}}
+
+		if _, err := stash.TagCooccurrence(1); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	t.Run("reconcile", func(t *testing.T) {
+		s := &mockStorage{}
+		stash, err := New(Options{Storage: s})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar")
+		stash.Set("https://www.example.org/page2", "bar")
+		if _, err := stash.GetAll("foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		s.entries = s.entries[:1]
+		s.entries[0].TagIndex = 42
+
+		if err := stash.Reconcile(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.entries) != 3 {
+			t.Error("failed to restore the missing associations", len(s.entries))
+			return
+		}
+
+		for _, e := range s.entries {
+			switch {
+			case e.Value == "https://www.example.org/page1" && e.Tag == "foo" && e.TagIndex == 42:
+			case e.Value == "https://www.example.org/page1" && e.Tag == "bar" && e.TagIndex == 1:
+			case e.Value == "https://www.example.org/page2" && e.Tag == "bar" && e.TagIndex == 0:
+			default:
+				t.Error("invalid association", e.Value, e.Tag, e.TagIndex)
+			}
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.cache.Close()
+		stash.cache = &mockStorage{}
+
+		if err := stash.Reconcile(); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestConflictColumns(t *testing.T) {
+	if os.Getenv("TEST_DB") != postgres {
+		t.Skip("requires postgres")
+	}
+
+	so := newTestStorageOptions()
+	db, err := sql.Open(so.DriverName, so.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if _, err := db.Exec(sqlcmd.Cmd_delete_db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`
+		create table tags (
+		  tag text not null,
+		  value text not null,
+		  tag_index int,
+		  created_at bigint,
+		  constraint custom_value_tag_unique unique (value, tag)
+		)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	so.ConflictColumns = []string{"value", "tag"}
+	s, err := newStorage(so, realClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	if err := s.Set(&Entry{Value: "https://www.example.org", Tag: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set(&Entry{Value: "https://www.example.org", Tag: "foo", TagIndex: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := s.Get([]string{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 1 || e[0].TagIndex != 1 {
+		t.Error("failed to update the association", mapEntries(e...))
+	}
+}
+
+func TestInvertTagStrength(t *testing.T) {
+	stash, err := New(Options{
+		Storage:           &mockStorage{},
+		InvertTagStrength: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "baz", "bar", "foo")
+	stash.Set("https://www.example.org/page2", "foo", "bar", "baz")
+
+	v, err := stash.Get("bar", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "https://www.example.org/page1" {
+		t.Error("failed to invert the tag strength", v)
+	}
+
+	e := stash.storage.(*mockStorage).entries
+	if e[0].Tag != "baz" || e[0].TagIndex != 2 || e[2].Tag != "foo" || e[2].TagIndex != 0 {
+		t.Error("failed to store the strongest-first tag index")
+	}
+}
+
+func TestHasMany(t *testing.T) {
+	t.Run("many", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		var pairs []Entry
+		for i := 0; i < 1000; i++ {
+			v := fmt.Sprintf("https://www.example.org/page%d", i)
+			if i%2 == 0 {
+				stash.Set(v, "foo")
+			}
+
+			pairs = append(pairs, Entry{Value: v, Tag: "foo"})
+		}
+
+		h, err := stash.HasMany(pairs)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(h) != len(pairs) {
+			t.Error("invalid result size", len(h))
+			return
+		}
+
+		for i, p := range pairs {
+			if h[p] != (i%2 == 0) {
+				t.Error("invalid existence", p.Value, h[p])
+			}
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorageLookup{&mockStorage{}}
+
+		if _, err := stash.HasMany([]Entry{{Value: "https://www.example.org", Tag: "foo"}}); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestDuplicateTagPolicy(t *testing.T) {
+	for _, storage := range []struct {
+		name string
+		new  func() Storage
+	}{{
+		name: "default",
+		new: func() Storage {
+			s, err := newStorage(newTestStorageOptions(), realClock{})
+			if err != nil {
+				panic(err)
+			}
+
+			return s
+		},
+	}, {
+		name: "mock",
+		new:  func() Storage { return &mockStorage{} },
+	}} {
+		for _, test := range []struct {
+			name   string
+			policy DuplicateTagPolicy
+			index  int
+			fail   bool
+		}{
+			{"keep last", KeepLastDuplicate, 2, false},
+			{"keep first", KeepFirstDuplicate, 0, false},
+			{"fail", FailOnDuplicate, 0, true},
+		} {
+			t.Run(storage.name+"/"+test.name, func(t *testing.T) {
+				s := storage.new()
+				stash, err := New(Options{Storage: s, DuplicateTagPolicy: test.policy})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer stash.Close()
+
+				// the cache is updated only for the tags that it already holds
+				stash.Set("https://www.example.org/other", "foo", "bar")
+				if _, err := stash.GetAll("foo", "bar"); err != nil {
+					t.Fatal(err)
+				}
+
+				get := func(src Storage, tags ...string) []*Entry {
+					e, err := src.Get(tags)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					return filterEntries(e, func(ei *Entry) bool { return ei.Value == "https://www.example.org" })
+				}
+
+				err = stash.Set("https://www.example.org", "foo", "bar", "foo")
+				if test.fail {
+					if err != ErrDuplicateTag {
+						t.Error("failed to fail with the right error", err)
+					}
+
+					if e := get(s, "foo", "bar"); len(e) != 0 {
+						t.Error("unexpected associations", len(e))
+					}
+
+					return
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, src := range []Storage{s, stash.cache} {
+					e := get(src, "foo")
+
+					if len(e) != 1 || e[0].TagIndex != test.index {
+						t.Error("invalid tag index", mapEntries(e...))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		policy MergePolicy
+		index  int
+	}{
+		{"keep dest", KeepDestIndex, 1},
+		{"keep source", KeepSourceIndex, 2},
+		{"keep min", KeepMinIndex, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stash := newTestStash()
+			defer stash.Close()
+
+			stash.Set("https://www.example.org/page1", "qux", "bar", "foo")
+			stash.Set("https://www.example.org/page2", "baz", "foo")
+			stash.Set("https://www.example.org/page1", "baz", "bar")
+
+			// load both tags in the cache
+			if _, err := stash.GetAll("foo", "bar"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := stash.MergeTags("foo", "bar", test.policy); err != nil {
+				t.Fatal(err)
+			}
+
+			if v, err := stash.GetAll("foo"); err != nil || len(v) != 0 {
+				t.Error("failed to delete the source tag", v, err)
+			}
+
+			e, err := stash.Query([]string{"bar"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			indexes := make(map[string]int)
+			for _, ei := range e {
+				indexes[ei.Value] = ei.TagIndex
+			}
+
+			if len(indexes) != 2 ||
+				indexes["https://www.example.org/page1"] != test.index ||
+				indexes["https://www.example.org/page2"] != 1 {
+				t.Error("invalid merge", indexes)
+			}
+		})
+	}
+
+	t.Run("expiring", func(t *testing.T) {
+		clock := &testClock{now: time.Now()}
+		stash := newTestStashClock(clock)
+		defer stash.Close()
+
+		stash.SetWithTTL("https://www.example.org/page1", time.Hour, "foo")
+		stash.SetWithTTL("https://www.example.org/page2", 3*time.Hour, "foo")
+		stash.Set("https://www.example.org/page3", "bar")
+		clock.forward(2 * time.Hour)
+
+		if err := stash.MergeTags("foo", "bar", KeepDestIndex); err != nil {
+			t.Fatal(err)
+		}
+
+		if v, err := stash.GetAll("bar"); err != nil || len(v) != 2 {
+			t.Error("failed to skip the expired association", v, err)
+		}
+
+		clock.forward(2 * time.Hour)
+		if v, err := stash.GetAll("bar"); err != nil || len(v) != 1 || v[0] != "https://www.example.org/page3" {
+			t.Error("failed to keep the expiration", v, err)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorageLookup{&mockStorage{}}
+
+		if err := stash.MergeTags("foo", "bar", KeepDestIndex); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestListTagsPage(t *testing.T) {
+	t.Run("pages", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "qux", "bar")
+
+		var pages [][]string
+		var cursor string
+		for {
+			tags, next, err := stash.ListTagsPage(cursor, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pages = append(pages, tags)
+			if next == "" {
+				break
+			}
+
+			cursor = next
+		}
+
+		if len(pages) != 2 ||
+			len(pages[0]) != 2 || pages[0][0] != "bar" || pages[0][1] != "baz" ||
+			len(pages[1]) != 2 || pages[1][0] != "foo" || pages[1][1] != "qux" {
+			t.Error("invalid pages", pages)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage.Close()
+		stash.storage = &mockStorageLookup{&mockStorage{}}
+
+		if _, _, err := stash.ListTagsPage("", 0); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestMaxConcurrentQueries(t *testing.T) {
+	s := &blockingStorage{
+		mockStorage: &mockStorage{},
+		started:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+
+	stash, err := New(Options{Storage: s, MaxConcurrentQueries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	const n = 5
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stash.Get(fmt.Sprintf("tag%d", i))
+		}(i)
+	}
+
+	<-s.started
+	<-s.started
+	for i := 2; i < n; i++ {
+		s.release <- struct{}{}
+		<-s.started
+	}
+
+	s.release <- struct{}{}
+	s.release <- struct{}{}
+	wg.Wait()
+
+	if s.max != 2 {
+		t.Error("failed to limit the concurrent queries", s.max)
+	}
+
+	t.Run("optional interfaces", func(t *testing.T) {
+		stash, err := New(Options{Storage: &mockStorageLookup{&mockStorage{}}, MaxConcurrentQueries: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		for name, op := range map[string]func() error{
+			"sync tags": func() error {
+				_, _, err := stash.SyncTags("https://www.example.org/page1", "foo", "bar")
+				return err
+			},
+			"increment score": func() error {
+				return stash.IncrementScore("https://www.example.org/page1", 1)
+			},
+			"delete expired": func() error {
+				_, err := stash.DeleteExpired()
+				return err
+			},
+		} {
+			// occupy the only slot
+			stash.queries <- struct{}{}
+
+			done := make(chan error, 1)
+			go func() { done <- op() }()
+
+			select {
+			case <-done:
+				t.Error("failed to wait for the limit", name)
+				<-stash.queries
+				continue
+			case <-time.After(3 * time.Millisecond):
+			}
+
+			<-stash.queries
+			if err := <-done; err != nil {
+				t.Error(name, err)
+			}
+		}
+	})
+}
+
+func TestMoveTag(t *testing.T) {
+	check := func(t *testing.T, stash *TagStash, expect ...string) {
+		for _, src := range []interface {
+			Get([]string) ([]*Entry, error)
+		}{stash.storage, stash.cache} {
+			e, err := src.Get([]string{"foo", "bar", "baz", "qux"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			order := make([]string, len(expect))
+			for _, ei := range e {
+				if ei.Value != "https://www.example.org/page1" {
+					continue
+				}
+
+				if ei.TagIndex >= len(order) {
+					t.Fatal("invalid tag index", ei.Tag, ei.TagIndex)
+				}
+
+				order[ei.TagIndex] = ei.Tag
+			}
+
+			for i := range expect {
+				if order[i] != expect[i] {
+					t.Error("invalid order", order, expect)
+					break
+				}
+			}
+		}
+	}
+
+	newStash := func() *TagStash {
+		s, err := New(Options{Storage: &mockStorageLookup{&mockStorage{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Set("https://www.example.org/page1", "foo", "bar", "baz", "qux")
+		s.Set("https://www.example.org/page2", "baz", "foo")
+		if _, err := s.GetAll("foo", "bar", "baz", "qux"); err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	t.Run("to front", func(t *testing.T) {
+		stash := newStash()
+		defer stash.Close()
+
+		if err := stash.MoveTag("https://www.example.org/page1", "baz", 0); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, stash, "baz", "foo", "bar", "qux")
+	})
+
+	t.Run("backwards, clamped", func(t *testing.T) {
+		stash := newStash()
+		defer stash.Close()
+
+		if err := stash.MoveTag("https://www.example.org/page1", "foo", 42); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, stash, "bar", "baz", "qux", "foo")
+	})
+
+	t.Run("storage failure", func(t *testing.T) {
+		stash := newStash()
+		defer stash.Close()
+
+		stash.storage.(*mockStorageLookup).failNextWrite = true
+		if err := stash.MoveTag("https://www.example.org/page1", "baz", 0); err == nil {
+			t.Fatal("failed to fail")
+		}
+
+		check(t, stash, "foo", "bar", "baz", "qux")
+	})
+
+	t.Run("no association", func(t *testing.T) {
+		stash := newStash()
+		defer stash.Close()
+
+		if err := stash.MoveTag("https://www.example.org/page2", "qux", 0); err != ErrNoAssociation {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newStash()
+		defer stash.Close()
+
+		stash.storage = &mockStorage{}
+		if err := stash.MoveTag("https://www.example.org/page1", "foo", 1); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestSetWithTagTTL(t *testing.T) {
+	test := func(t *testing.T, stash *TagStash, clock *testClock) {
+		defer stash.Close()
+
+		if err := stash.SetWithTagTTL("https://www.example.org/page1", []TagTTL{
+			{Tag: "foo", TTL: time.Hour},
+			{Tag: "bar"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		stash.Set("https://www.example.org/page2", "baz", "foo")
+		if v, err := stash.Get("foo"); err != nil || v != "https://www.example.org/page1" {
+			t.Error("failed to get the value before expiration", v, err)
+		}
+
+		clock.forward(2 * time.Hour)
+		if v, err := stash.Get("foo"); err != nil || v != "https://www.example.org/page2" {
+			t.Error("failed to hide the expired association", v, err)
+		}
+
+		if v, err := stash.Get("bar"); err != nil || v != "https://www.example.org/page1" {
+			t.Error("failed to keep the association without TTL", v, err)
+		}
+
+		if n, err := stash.DeleteExpired(); err != nil || n != 1 {
+			t.Error("failed to delete the expired association", n, err)
+		}
+
+		if v, err := stash.GetAll("foo"); err != nil || len(v) != 1 || v[0] != "https://www.example.org/page2" {
+			t.Error("failed to keep the valid associations", v, err)
+		}
+	}
+
+	t.Run("expires", func(t *testing.T) {
+		clock := &testClock{now: time.Now()}
+		stash := newTestStashClock(clock)
+		test(t, stash, clock)
+	})
+
+	t.Run("expires, mock", func(t *testing.T) {
+		clock := &testClock{now: time.Now()}
+		stash, err := New(Options{Storage: &mockStorage{now: clock.Now}, Clock: clock})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test(t, stash, clock)
+	})
+
+	t.Run("update cached", func(t *testing.T) {
+		clock := &testClock{now: time.Now()}
+		stash, err := New(Options{
+			Storage:      &mockStorage{now: clock.Now},
+			CacheOptions: CacheOptions{CacheSize: 1 << 12},
+			Clock:        clock,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo")
+		stash.Set("https://www.example.org/page3", "foo", "bar")
+		if err := stash.SetWithTTL("https://www.example.org/page2", time.Hour, "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := stash.GetAll("foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		// the TTL is set on a cached association, and removed from another one
+		if err := stash.SetWithTTL("https://www.example.org/page1", time.Hour, "foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		stash.Set("https://www.example.org/page2", "bar")
+		clock.forward(2 * time.Hour)
+
+		if v, err := stash.GetAll("foo"); err != nil || len(v) != 1 {
+			t.Error("failed to expire the cached association", v, err)
+		}
+
+		if v, err := stash.GetAll("bar"); err != nil || len(v) != 2 {
+			t.Error("failed to clear the expiration of the cached association", v, err)
+		}
+	})
+
+	t.Run("update cached batch", func(t *testing.T) {
+		c := newCache(CacheOptions{CacheSize: 1 << 12})
+		defer c.Close()
+
+		expires := time.Now().Add(time.Hour)
+		c.setTag("foo", []*Entry{{Value: "https://www.example.org", Tag: "foo"}})
+		c.setEntries("foo", []*Entry{{Value: "https://www.example.org", Tag: "foo", Expires: expires}})
+		e, err := c.Get([]string{"foo"})
+		if err != nil || len(e) != 1 || !e[0].Expires.Equal(expires) {
+			t.Error("failed to set the expiration", e, err)
+		}
+
+		c.setEntries("foo", []*Entry{{Value: "https://www.example.org", Tag: "foo"}})
+		e, err = c.Get([]string{"foo"})
+		if err != nil || len(e) != 1 || !e[0].Expires.IsZero() {
+			t.Error("failed to clear the expiration", e, err)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash, err := New(Options{Storage: struct{ Storage }{&mockStorage{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		if err := stash.SetWithTagTTL("https://www.example.org", []TagTTL{{Tag: "foo", TTL: time.Hour}}); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if _, err := stash.DeleteExpired(); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestValidateTag(t *testing.T) {
+	s := &mockStorage{}
+	stash, err := New(Options{Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "bar")
+	if _, err := stash.GetAll("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, e := range s.entries {
+		if e.Value == "https://www.example.org/page2" {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+
+	s.entries = append(s.entries, &Entry{Value: "https://www.example.org/page3", Tag: "bar"})
+
+	t.Run("consistent", func(t *testing.T) {
+		if ok, cacheOnly, storageOnly, err := stash.ValidateTag("foo"); err != nil || !ok ||
+			len(cacheOnly) != 0 || len(storageOnly) != 0 {
+			t.Error("failed to validate tag", ok, cacheOnly, storageOnly, err)
+		}
+	})
+
+	t.Run("diverged", func(t *testing.T) {
+		ok, cacheOnly, storageOnly, err := stash.ValidateTag("bar")
+		if err != nil || ok ||
+			len(cacheOnly) != 1 || cacheOnly[0] != "https://www.example.org/page2" ||
+			len(storageOnly) != 1 || storageOnly[0] != "https://www.example.org/page3" {
+			t.Error("failed to detect divergence", ok, cacheOnly, storageOnly, err)
+		}
+	})
+
+	t.Run("not cached", func(t *testing.T) {
+		s.entries = append(s.entries, &Entry{Value: "https://www.example.org/page1", Tag: "baz"})
+		if ok, _, _, err := stash.ValidateTag("baz"); err != nil || !ok {
+			t.Error("failed to validate uncached tag", ok, err)
+		}
+	})
+}
+
+func TestMaxQueryParameters(t *testing.T) {
+	test := func(t *testing.T, maxParams, tagCount int) {
+		so := newTestStorageOptions()
+		so.MaxQueryParameters = maxParams
+		s, err := newStorage(so, realClock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		var tags []string
+		for i := 0; i < tagCount; i++ {
+			tag := fmt.Sprintf("tag%d", i)
+			if err := s.Set(&Entry{Value: "https://www.example.org", Tag: tag}); err != nil {
+				t.Fatal(err)
+			}
+
+			tags = append(tags, tag, tag)
+		}
+
+		e, err := s.Get(tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(e) != tagCount {
+			t.Error("invalid number of associations", len(e))
+		}
+	}
+
+	t.Run("configured", func(t *testing.T) { test(t, 3, 10) })
+	t.Run("default", func(t *testing.T) { test(t, 0, 1200) })
+
+	t.Run("tag counts", func(t *testing.T) {
+		so := newTestStorageOptions()
+		so.MaxQueryParameters = 3
+		s, err := newStorage(so, realClock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		var values []string
+		for i := 0; i < 10; i++ {
+			value := fmt.Sprintf("https://www.example.org/page%d", i)
+			for _, e := range []*Entry{
+				{Value: value, Tag: "foo"},
+				{Value: value, Tag: "bar"},
+				{Value: value, Tag: "baz", Expires: time.Now().Add(-time.Hour)},
+			} {
+				if err := s.Set(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			values = append(values, value, value)
+		}
+
+		c, err := s.TagCountForValues(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c) != 10 {
+			t.Error("invalid number of values", len(c))
+		}
+
+		for value, count := range c {
+			if count != 2 {
+				t.Error("invalid tag count", value, count)
+			}
+		}
+	})
+}
+
+func TestStorageFromDB(t *testing.T) {
+	so := newTestStorageOptions()
+
+	// creates the schema
+	s, err := newStorage(so, realClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Close()
+
+	db, err := sql.Open(so.DriverName, so.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	shared, err := NewStorageFromDB(db, StorageOptions{DriverName: so.DriverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stash, err := New(Options{Storage: shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stash.Set("https://www.example.org", "foo")
+	if v, err := stash.Get("foo"); err != nil || v != "https://www.example.org" {
+		t.Error("failed to use the shared database", v, err)
+	}
+
+	stash.Close()
+	if err := db.Ping(); err != nil {
+		t.Error("failed to keep the shared database open", err)
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	so := newTestStorageOptions()
+	so.MaxOpenConns = 3
+	s, err := newStorage(so, realClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	if n := s.db.Stats().MaxOpenConnections; n != 3 {
+		t.Error("failed to limit the open connections", n)
+	}
+}
+
+func TestSQLiteOptions(t *testing.T) {
+	t.Run("connection string", func(t *testing.T) {
+		for _, test := range []struct {
+			dsn, journalMode string
+			busyTimeout      time.Duration
+			expect           string
+		}{
+			{"data.sqlite", "", 0, "data.sqlite"},
+			{"data.sqlite", "WAL", 0, "data.sqlite?_journal_mode=WAL"},
+			{"data.sqlite", "", 5 * time.Second, "data.sqlite?_busy_timeout=5000"},
+			{"data.sqlite", "WAL", time.Microsecond, "data.sqlite?_journal_mode=WAL&_busy_timeout=1"},
+			{"file:data.sqlite?cache=shared", "WAL", time.Second, "file:data.sqlite?cache=shared&_journal_mode=WAL&_busy_timeout=1000"},
+		} {
+			if dsn := withSQLiteParams(test.dsn, test.journalMode, test.busyTimeout); dsn != test.expect {
+				t.Error("invalid connection string", dsn)
+			}
+		}
+	})
+
+	t.Run("wal", func(t *testing.T) {
+		if os.Getenv("TEST_DB") == postgres {
+			t.Skip("applies to sqlite3")
+		}
+
+		// the WAL files are not removed together with the shared test database
+		so := StorageOptions{DriverName: sqlite, DataSourceName: filepath.Join(t.TempDir(), "data.sqlite")}
+		so.SQLiteJournalMode = "WAL"
+		so.SQLiteBusyTimeout = time.Second
+		s, err := newStorage(so, realClock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		var mode string
+		if err := s.db.QueryRow("pragma journal_mode").Scan(&mode); err != nil || mode != "wal" {
+			t.Error("failed to set the journal mode", mode, err)
+		}
+
+		var timeout int
+		if err := s.db.QueryRow("pragma busy_timeout").Scan(&timeout); err != nil || timeout != 1000 {
+			t.Error("failed to set the busy timeout", timeout, err)
+		}
+	})
+}
+
+func TestStatementTimeout(t *testing.T) {
+	t.Run("connection string", func(t *testing.T) {
+		for _, test := range []struct{ dsn, expect string }{
+			{"", "statement_timeout=1500"},
+			{"dbname=tagstash sslmode=disable", "dbname=tagstash sslmode=disable statement_timeout=1500"},
+			{"postgres://localhost/tagstash?sslmode=disable", "postgres://localhost/tagstash?sslmode=disable&statement_timeout=1500"},
+		} {
+			if dsn, err := withStatementTimeout(test.dsn, 1500*time.Millisecond); err != nil || dsn != test.expect {
+				t.Error("invalid connection string", dsn, err)
+			}
+		}
+	})
+
+	t.Run("client side", func(t *testing.T) {
+		if os.Getenv("TEST_DB") == postgres {
+			t.Skip("applies to sqlite3")
+		}
+
+		so := newTestStorageOptions()
+		so.StatementTimeout = time.Nanosecond
+		s, err := newStorage(so, realClock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		if err := s.Set(&Entry{Value: "https://www.example.org", Tag: "foo"}); err != context.DeadlineExceeded {
+			t.Error("failed to time out", err)
+		}
+	})
+}
+
+type countingLookup struct {
+	*mockStorageLookup
+	calls int
+}
+
+func (s *countingLookup) GetTags(value string) ([]string, error) {
+	s.calls++
+	return s.mockStorageLookup.GetTags(value)
+}
+
+func TestCacheReverseLookups(t *testing.T) {
+	newStash := func() (*TagStash, *countingLookup) {
+		s := &countingLookup{mockStorageLookup: &mockStorageLookup{&mockStorage{}}}
+		stash, err := New(Options{
+			Storage:      s,
+			CacheOptions: CacheOptions{CacheReverseLookups: true},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stash.Set("https://www.example.org/page1", "foo", "bar")
+		stash.Set("https://www.example.org/page2", "foo")
+		return stash, s
+	}
+
+	check := func(t *testing.T, stash *TagStash, value string, expect ...string) {
+		tags, err := stash.GetTags(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !stringSetsEqual(tags, expect) {
+			t.Error("invalid tags", tags, expect)
+		}
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		stash, s := newStash()
+		defer stash.Close()
+
+		check(t, stash, "https://www.example.org/page1", "foo", "bar")
+		check(t, stash, "https://www.example.org/page1", "foo", "bar")
+		if s.calls != 1 {
+			t.Error("failed to cache the tags", s.calls)
+		}
+	})
+
+	t.Run("invalidated", func(t *testing.T) {
+		stash, s := newStash()
+		defer stash.Close()
+
+		check(t, stash, "https://www.example.org/page1", "foo", "bar")
+		check(t, stash, "https://www.example.org/page2", "foo")
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		check(t, stash, "https://www.example.org/page1", "foo", "bar", "baz")
+
+		stash.Remove("https://www.example.org/page1", "bar")
+		check(t, stash, "https://www.example.org/page1", "foo", "baz")
+
+		check(t, stash, "https://www.example.org/page2", "foo")
+		stash.Delete("foo")
+		check(t, stash, "https://www.example.org/page1", "baz")
+		check(t, stash, "https://www.example.org/page2")
+
+		if s.calls != 6 {
+			t.Error("unexpected storage lookups", s.calls)
+		}
+	})
+
+	t.Run("expiring values not cached", func(t *testing.T) {
+		stash, s := newStash()
+		defer stash.Close()
+
+		if err := stash.SetWithTagTTL("https://www.example.org/page3", []TagTTL{{Tag: "foo", TTL: time.Hour}}); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, stash, "https://www.example.org/page3", "foo")
+		check(t, stash, "https://www.example.org/page3", "foo")
+		if s.calls != 2 {
+			t.Error("unexpected storage lookups", s.calls)
+		}
+	})
+}
+
+func TestRankByScore(t *testing.T) {
+	newStash := func(s Storage, rankByScore bool) *TagStash {
+		stash, err := New(Options{Storage: s, RankByScore: rankByScore})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stash.Set("https://www.example.org/page1", "foo", "bar")
+		stash.Set("https://www.example.org/page2", "bar", "foo")
+		stash.Set("https://www.example.org/page3", "baz")
+		return stash
+	}
+
+	t.Run("score breaks ties", func(t *testing.T) {
+		stash := newStash(&mockStorage{}, true)
+		defer stash.Close()
+
+		if err := stash.IncrementScore("https://www.example.org/page2", 2); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := stash.IncrementScore("https://www.example.org/page3", 5); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := stash.GetAll("foo", "bar", "baz")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 3 ||
+			v[0] != "https://www.example.org/page2" ||
+			v[1] != "https://www.example.org/page1" ||
+			v[2] != "https://www.example.org/page3" {
+			t.Error("invalid order", v)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		stash := newStash(&mockStorage{}, false)
+		defer stash.Close()
+
+		if err := stash.IncrementScore("https://www.example.org/page2", 2); err != nil {
+			t.Fatal(err)
+		}
+
+		if v, err := stash.Get("foo", "bar"); err != nil || v != "https://www.example.org/page1" {
+			t.Error("failed to ignore the score", v, err)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newStash(struct{ Storage }{&mockStorage{}}, true)
+		defer stash.Close()
+
+		if err := stash.IncrementScore("https://www.example.org/page2", 2); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if _, err := stash.Get("foo"); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestIncompleteCachedTag(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		cache Cache
+	}{
+		{"default cache", nil},
+		{"custom cache", &mockStorage{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// the storage holds an association that was not written by this instance
+			s := &mockStorage{entries: []*Entry{{Value: "https://www.example.org/page1", Tag: "foo"}}}
+			stash, err := New(Options{Storage: s, Cache: test.cache})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer stash.Close()
+
+			if err := stash.Set("https://www.example.org/page2", "foo"); err != nil {
+				t.Fatal(err)
+			}
+
+			v, err := stash.GetAll("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !stringSetsEqual(v, []string{"https://www.example.org/page1", "https://www.example.org/page2"}) {
+				t.Error("failed to read the complete tag", v)
+			}
+		})
+	}
+}
+
+func TestSyncTags(t *testing.T) {
+	t.Run("sync", func(t *testing.T) {
+		stash, err := New(Options{Storage: &mockStorageLookup{&mockStorage{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+		stash.Set("https://www.example.org/page2", "bar")
+		if _, err := stash.GetAll("foo", "bar", "baz"); err != nil {
+			t.Fatal(err)
+		}
+
+		added, removed, err := stash.SyncTags("https://www.example.org/page1", "qux", "baz", "foo", "quux")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(added) != 2 || added[0] != "qux" || added[1] != "quux" {
+			t.Error("invalid added tags", added)
+		}
+
+		if len(removed) != 1 || removed[0] != "bar" {
+			t.Error("invalid removed tags", removed)
+		}
+
+		tags, err := stash.GetTags("https://www.example.org/page1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !stringSetsEqual(tags, []string{"qux", "baz", "foo", "quux"}) {
+			t.Error("invalid tags", tags)
+		}
+
+		if v, err := stash.GetAll("bar"); err != nil || len(v) != 1 || v[0] != "https://www.example.org/page2" {
+			t.Error("failed to remove the tag from the cache", v, err)
+		}
+
+		e, err := stash.Query([]string{"baz"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(e) != 1 || e[0].TagIndex != 1 {
+			t.Error("failed to update the tag index in the cache", mapEntries(e...))
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash, err := New(Options{Storage: &mockStorage{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		if _, _, err := stash.SyncTags("https://www.example.org", "foo"); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestStartupRetry(t *testing.T) {
+	test := func(t *testing.T, failures, attempts int, fail bool) {
+		var pings int
+		ping := func() error {
+			pings++
+			if pings <= failures {
+				return errForgedError
+			}
+
+			return nil
+		}
+
+		var slept time.Duration
+		sleep := func(d time.Duration) { slept += d }
+
+		err := retryPing(ping, StartupRetry{Attempts: attempts, Interval: time.Second}, sleep)
+		if fail {
+			if err != errForgedError {
+				t.Error("failed to fail with the right error", err)
+			}
+
+			return
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pings != failures+1 || slept != time.Duration(failures)*time.Second {
+			t.Error("invalid retries", pings, slept)
+		}
+	}
+
+	t.Run("reachable", func(t *testing.T) { test(t, 0, 3, false) })
+	t.Run("reachable after retries", func(t *testing.T) { test(t, 2, 3, false) })
+	t.Run("unreachable", func(t *testing.T) { test(t, 3, 3, true) })
+}
+
+func TestMaxLength(t *testing.T) {
+	s := &mockStorageLookup{&mockStorage{}}
+	stash, err := New(Options{Storage: s, MaxValueLength: 24, MaxTagLength: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	if err := stash.Set("https://www.example.org/page1", "foo"); err != ErrValueTooLong {
+		t.Error("failed to fail with the right error", err)
+	}
+
+	if err := stash.Set("https://www.example.org", "foo", "quux"); err != ErrTagTooLong {
+		t.Error("failed to fail with the right error", err)
+	}
+
+	if _, _, err := stash.SyncTags("https://www.example.org", "quux"); err != ErrTagTooLong {
+		t.Error("failed to fail with the right error", err)
+	}
+
+	if len(s.entries) != 0 {
+		t.Error("unexpected write", mapEntries(s.entries...))
+	}
+
+	if err := stash.Set("https://www.example.org", "foo", "bar"); err != nil {
+		t.Error(err)
+	}
+}
+
+type closeCountingStorage struct {
+	*mockStorage
+	closed int
+}
+
+func (s *closeCountingStorage) Close() { s.closed++ }
+
+func TestAcquire(t *testing.T) {
+	s := &closeCountingStorage{mockStorage: &mockStorage{}}
+	stash, err := New(Options{Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		stash.Acquire()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stash.Close()
+		}()
+	}
+
+	wg.Wait()
+	if s.closed != 0 {
+		t.Error("closed while acquired")
+	}
+
+	if _, err := stash.Get("foo"); err != nil {
+		t.Error(err)
+	}
+
+	stash.Close()
+	if s.closed != 1 {
+		t.Error("failed to close", s.closed)
+	}
+
+	stash.Close()
+	if s.closed != 1 {
+		t.Error("closed twice", s.closed)
+	}
+}
+
+func TestQueryExpander(t *testing.T) {
+	synonyms := map[string]string{"colour": "color", "color": "colour"}
+	stash, err := New(Options{
+		Storage: &mockStorage{},
+		QueryExpander: func(tags []string) []string {
+			for _, tag := range tags {
+				if s, ok := synonyms[tag]; ok {
+					tags = append(tags, s)
+				}
+			}
+
+			return tags
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "color", "red")
+	stash.Set("https://www.example.org/page2", "red")
+
+	v, err := stash.Get("colour", "red")
+	if err != nil || v != "https://www.example.org/page1" {
+		t.Error("failed to expand the query", v, err)
+	}
+
+	e, err := stash.Query([]string{"color", "colour"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 1 || e[0].Value != "https://www.example.org/page1" || e[0].MatchCount() != 1 {
+		t.Error("failed to deduplicate the expanded tags", mapEntries(e...))
+	}
+}
+
+func TestGetWithPositions(t *testing.T) {
+	stash, err := New(Options{Storage: &mockStorage{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "baz", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "foo")
+
+	v, err := stash.GetWithPositions("foo", "bar", "qux")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []ValuePositions{{
+		Value:     "https://www.example.org/page1",
+		Positions: []TagPosition{{Tag: "foo", Index: 1}, {Tag: "bar", Index: 2}},
+	}, {
+		Value:     "https://www.example.org/page2",
+		Positions: []TagPosition{{Tag: "foo", Index: 0}},
+	}}
+
+	if fmt.Sprint(v) != fmt.Sprint(expect) {
+		t.Error("invalid positions", v)
+	}
+
+	if _, err := stash.GetWithPositions(); err != ErrNoTags {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestDetectDriver(t *testing.T) {
+	for _, test := range []struct{ dsn, expect string }{
+		{"", sqlite},
+		{"data.sqlite", sqlite},
+		{"file:test.db?cache=shared", sqlite},
+		{"postgres://localhost/tagstash?sslmode=disable", postgres},
+		{"postgresql://user@localhost:5432/tagstash", postgres},
+		{"host=localhost dbname=tagstash sslmode=disable", postgres},
+		{"dbname=tagstash", sqlite},
+	} {
+		if driver := detectDriver(test.dsn); driver != test.expect {
+			t.Error("invalid driver", test.dsn, driver)
+		}
+	}
+}
+
+func TestWriteAround(t *testing.T) {
+	stash, err := New(Options{Storage: &mockStorage{}, CacheMode: WriteAround})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	cached := func() []string { return stash.cache.(CacheTagLister).CachedTags() }
+	stash.Set("https://www.example.org/page1", "foo")
+	if tags := cached(); len(tags) != 0 {
+		t.Error("unexpected cache write", tags)
+	}
+
+	if _, err := stash.GetAll("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	stash.Set("https://www.example.org/page2", "foo", "bar")
+	if tags := cached(); len(tags) != 0 {
+		t.Error("failed to drop the written tag from the cache", tags)
+	}
+
+	if v, err := stash.GetAll("foo"); err != nil || len(v) != 2 {
+		t.Error("failed to read the written tag from the storage", v, err)
+	}
+
+	if tags := cached(); len(tags) != 1 || tags[0] != "foo" {
+		t.Error("failed to cache the tag on read", tags)
+	}
+
+	c := &mockStorage{}
+	custom, err := New(Options{Storage: &mockStorage{}, Cache: c, CacheMode: WriteAround})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer custom.Close()
+
+	custom.Set("https://www.example.org/page1", "foo")
+	custom.GetAll("foo")
+	custom.Set("https://www.example.org/page2", "foo")
+	if len(c.entries) != 0 {
+		t.Error("failed to drop the written tag from the custom cache", mapEntries(c.entries...))
+	}
+}
+
+func TestGetValueEntries(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+	stash.Set("https://www.example.org/page2", "foo")
+
+	e, err := stash.GetValueEntries("https://www.example.org/page1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 3 ||
+		e[0].Tag != "foo" || e[0].TagIndex != 0 ||
+		e[1].Tag != "bar" || e[1].TagIndex != 1 ||
+		e[2].Tag != "baz" || e[2].TagIndex != 2 {
+		t.Error("invalid entries", e)
+	}
+
+	stash.storage = &mockStorage{}
+	if _, err := stash.GetValueEntries("https://www.example.org/page1"); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestStorageNotWritable(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "data.sqlite")
+	if err := checkWritable(path); err != nil {
+		t.Error("failed to accept a writable path", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("failed to leave the database to the driver", err)
+	}
+
+	_, err := New(Options{StorageOptions: StorageOptions{
+		DriverName:     sqlite,
+		DataSourceName: filepath.Join(dir, "missing", "data.sqlite"),
+	}})
+
+	if !errors.Is(err, ErrStorageNotWritable) {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestStreamAll(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page2", "foo", "bar")
+	stash.Set("https://www.example.org/page1", "baz", "foo")
+
+	var e []string
+	if err := stash.StreamAll(func(ei *Entry) error {
+		e = append(e, fmt.Sprintf("%s %s %d", ei.Value, ei.Tag, ei.TagIndex))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 4 ||
+		e[0] != "https://www.example.org/page1 baz 0" ||
+		e[1] != "https://www.example.org/page1 foo 1" ||
+		e[2] != "https://www.example.org/page2 foo 0" ||
+		e[3] != "https://www.example.org/page2 bar 1" {
+		t.Error("invalid entries", e)
+	}
+
+	stash.storage = &mockStorage{}
+	if err := stash.StreamAll(func(*Entry) error { return nil }); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestGetAllEmpty(t *testing.T) {
+	check := func(t *testing.T, v []string, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v == nil || len(v) != 0 {
+			t.Error("failed to return an empty result", v == nil, v)
+		}
+	}
+
+	t.Run("storage miss", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo")
+
+		v, err := stash.GetAll("bar")
+		check(t, v, err)
+
+		v, err = stash.GetAll("bar", "baz")
+		check(t, v, err)
+	})
+
+	t.Run("cache hit", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo")
+		if _, err := stash.GetAll("foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := stash.Remove("https://www.example.org/page1", "foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		if tags := stash.cache.(CacheTagLister).CachedTags(); len(tags) != 1 || tags[0] != "foo" {
+			t.Fatal("failed to keep the tag cached", tags)
+		}
+
+		v, err := stash.GetAll("foo")
+		check(t, v, err)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		if v, err := stash.GetAll(); err != ErrNoTags || v != nil {
+			t.Error("failed to fail with the right error", v, err)
+		}
+	})
+}
+
+func TestCacheSizeRatio(t *testing.T) {
+	m, err := parseMemTotal(strings.NewReader("MemTotal:        2048 kB\nMemFree:         1024 kB\n"))
+	if err != nil || m != 2<<20 {
+		t.Error("failed to parse the total memory", m, err)
+	}
+
+	if _, err := parseMemTotal(strings.NewReader("MemFree:         1024 kB\n")); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+
+	memory := func() (int, error) { return 8 << 20, nil }
+	if s, err := cacheSizeFromRatio(0.25, memory); err != nil || s != 2<<20 {
+		t.Error("invalid cache size", s, err)
+	}
+
+	if s, err := cacheSizeFromRatio(2, memory); err != nil || s != 8<<20 {
+		t.Error("invalid cache size", s, err)
+	}
+
+	if _, err := os.Stat(meminfoPath); err != nil {
+		t.Skip("no system memory info")
+	}
+
+	stash, err := New(Options{Storage: &mockStorage{}, CacheOptions: CacheOptions{CacheSizeRatio: 0.001}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo")
+	if v, err := stash.GetAll("foo"); err != nil || len(v) != 1 {
+		t.Error("failed to query with the calculated cache size", v, err)
+	}
+}
+
+func TestGetByOverlapRatio(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	tags := []string{"t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7", "t8", "t9"}
+	stash.Set("https://www.example.org/page1", tags[:7]...)
+	stash.Set("https://www.example.org/page2", tags[:6]...)
+	stash.Set("https://www.example.org/page3", tags...)
+
+	v, err := stash.GetByOverlapRatio(0.7, tags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v) != 2 || v[0] != "https://www.example.org/page3" || v[1] != "https://www.example.org/page1" {
+		t.Error("invalid values", v)
+	}
+
+	if v, err := stash.GetByOverlapRatio(0.5, "t0", "t0", "foo"); err != nil || len(v) != 3 {
+		t.Error("failed to count the distinct tags", v, err)
+	}
+
+	if _, err := stash.GetByOverlapRatio(0.5); err != ErrNoTags {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestCompressEntries(t *testing.T) {
+	stash, err := New(Options{
+		Storage:      &mockStorage{},
+		CacheOptions: CacheOptions{CompressEntries: true},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+	if _, err := stash.GetAll("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	stash.Set("https://www.example.org/page2", "bar", "foo")
+	stash.Remove("https://www.example.org/page1", "bar")
+
+	e, err := stash.cache.Get([]string{"foo", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 3 {
+		t.Error("invalid cached entries", mapEntries(e...))
+	}
+
+	v, err := stash.GetAll("foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v) != 2 || v[0] != "https://www.example.org/page2" || v[1] != "https://www.example.org/page1" {
+		t.Error("invalid values", v)
+	}
+}
+
+func TestDeleteValues(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "foo", "baz")
+	stash.Set("https://www.example.org/page3", "qux")
+	if _, err := stash.GetAll("foo", "bar", "baz", "qux"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stash.DeleteValues("https://www.example.org/page1", "https://www.example.org/page3"); err != nil {
+		t.Fatal(err)
+	}
+
+	cached := stash.cache.(CacheTagLister).CachedTags()
+	sort.Strings(cached)
+	if len(cached) != 1 || cached[0] != "baz" {
+		t.Error("failed to drop the affected tags from the cache", cached)
+	}
+
+	for _, tags := range [][]string{{"foo"}, {"foo", "bar", "qux"}} {
+		v, err := stash.GetAll(tags...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 1 || v[0] != "https://www.example.org/page2" {
+			t.Error("failed to delete the values", tags, v)
+		}
+	}
+
+	stash.storage = struct{ Storage }{&mockStorage{}}
+	if err := stash.DeleteValues("https://www.example.org/page1"); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestDeleteValue(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "foo")
+	if _, err := stash.GetAll("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stash.DeleteValue("https://www.example.org/page1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := stash.GetAll("foo", "bar"); err != nil || len(v) != 1 || v[0] != "https://www.example.org/page2" {
+		t.Error("failed to delete the value", v, err)
+	}
+
+	if tags, err := stash.GetTags("https://www.example.org/page1"); err != nil || len(tags) != 0 {
+		t.Error("failed to delete the tags of the value", tags, err)
+	}
+
+	stash.storage = struct{ Storage }{&mockStorage{}}
+	if err := stash.DeleteValue("https://www.example.org/page2"); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestSetTagValues(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "featured", "foo")
+	stash.Set("https://www.example.org/page2", "featured")
+	if _, err := stash.GetAll("featured"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stash.SetTagValues(
+		"featured",
+		"https://www.example.org/page3",
+		"https://www.example.org/page1",
+		"https://www.example.org/page3",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := stash.Query([]string{"featured"}, WithOrderByIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 2 ||
+		e[0].Value != "https://www.example.org/page3" || e[0].IndexDelta() != 0 ||
+		e[1].Value != "https://www.example.org/page1" || e[1].IndexDelta() != 1 {
+		t.Error("failed to set the values of the tag", mapEntries(e...))
+	}
+
+	if v, err := stash.GetAll("foo"); err != nil || len(v) != 1 || v[0] != "https://www.example.org/page1" {
+		t.Error("unexpected change of another tag", v, err)
+	}
+
+	stash.storage = struct{ Storage }{&mockStorage{}}
+	if err := stash.SetTagValues("featured"); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestGetRequiring(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "red", "large", "shoe")
+	stash.Set("https://www.example.org/page2", "shoe", "red")
+	stash.Set("https://www.example.org/page3", "red", "large", "hat")
+	stash.Set("https://www.example.org/page4", "shoe")
+
+	v, err := stash.GetRequiring("shoe", "red", "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v) != 2 || v[0] != "https://www.example.org/page1" || v[1] != "https://www.example.org/page2" {
+		t.Error("failed to rank the values of the required tag", v)
+	}
+
+	v, err = stash.GetRequiring("shoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v) != 3 || v[0] != "https://www.example.org/page2" || v[1] != "https://www.example.org/page4" {
+		t.Error("failed to return the values of the required tag", v)
+	}
+}
+
+func TestGetTop(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar", "baz")
+	stash.Set("https://www.example.org/page2", "foo", "bar")
+	stash.Set("https://www.example.org/page3", "foo")
+
+	for _, test := range []struct {
+		n        int
+		expected []string
+	}{{
+		n:        2,
+		expected: []string{"https://www.example.org/page1", "https://www.example.org/page2"},
+	}, {
+		n:        1,
+		expected: []string{"https://www.example.org/page1"},
+	}, {
+		n: 0,
+		expected: []string{
+			"https://www.example.org/page1",
+			"https://www.example.org/page2",
+			"https://www.example.org/page3",
+		},
+	}, {
+		n: -1,
+		expected: []string{
+			"https://www.example.org/page1",
+			"https://www.example.org/page2",
+			"https://www.example.org/page3",
+		},
+	}} {
+		v, err := stash.GetTop(test.n, "foo", "bar", "baz")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(v) != fmt.Sprint(test.expected) {
+			t.Error("failed to limit the values", test.n, v)
+		}
+	}
+}
+
+func TestSetBatch(t *testing.T) {
+	t.Run("stores and caches", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "foo")
+		if _, err := stash.GetAll("foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := stash.SetBatch([]ValueTags{{
+			Value: "https://www.example.org/page2",
+			Tags:  []string{"foo", "bar"},
+		}, {
+			Value: "https://www.example.org/page3",
+			Tags:  []string{"bar", "foo"},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := stash.GetAll("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 3 || v[0] != "https://www.example.org/page1" || v[1] != "https://www.example.org/page2" {
+			t.Error("failed to update the cached tag", v)
+		}
+
+		v, err = stash.GetAll("bar", "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 3 || v[0] != "https://www.example.org/page3" || v[1] != "https://www.example.org/page2" {
+			t.Error("failed to store the batch", v)
+		}
+	})
+
+	t.Run("fails as a whole", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		s := &mockStorage{}
+		stash.storage = s
+		s.failNextWrite = true
+		if err := stash.SetBatch([]ValueTags{{
+			Value: "https://www.example.org/page1",
+			Tags:  []string{"foo", "bar"},
+		}, {
+			Value: "https://www.example.org/page2",
+			Tags:  []string{"foo"},
+		}}); err != errForgedError {
+			t.Fatal("failed to fail", err)
+		}
+
+		if v, err := stash.GetAll("foo", "bar"); err != nil || len(v) != 0 {
+			t.Error("unexpected partial write", v, err)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage = struct{ Storage }{&mockStorage{}}
+		if err := stash.SetBatch(nil); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestListTags(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "foo", "baz")
+
+	tags, err := stash.ListTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 3 || tags[0] != "bar" || tags[1] != "baz" || tags[2] != "foo" {
+		t.Error("failed to list the tags", tags)
+	}
+
+	stash.storage = struct{ Storage }{&mockStorage{}}
+	if _, err := stash.ListTags(); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestCountTag(t *testing.T) {
+	for _, s := range []struct {
+		name    string
+		storage Storage
+	}{{
+		name:    "counted by the storage",
+		storage: &mockStorageLookup{&mockStorage{}},
+	}, {
+		name:    "counted from the associations",
+		storage: &mockStorage{},
+	}} {
+		t.Run(s.name, func(t *testing.T) {
+			stash := newTestStash()
+			defer stash.Close()
+
+			stash.storage.Close()
+			stash.storage = s.storage
+
+			stash.Set("https://www.example.org/page1", "foo", "bar")
+			stash.Set("https://www.example.org/page2", "foo")
+
+			for tag, expected := range map[string]int{"foo": 2, "bar": 1, "baz": 0} {
+				if count, err := stash.CountTag(tag); err != nil || count != expected {
+					t.Error("failed to count the tag", tag, count, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameTag(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "web", "javascript")
+	stash.Set("https://www.example.org/page2", "javascript", "js")
+	if _, err := stash.GetAll("javascript", "js"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stash.RenameTag("javascript", "js"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := stash.GetAll("javascript"); err != nil || len(v) != 0 {
+		t.Error("failed to delete the old tag", v, err)
+	}
+
+	e, err := stash.Query([]string{"js"}, WithOrderByIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 2 ||
+		e[0].Value != "https://www.example.org/page2" || e[0].IndexDelta() != 0 ||
+		e[1].Value != "https://www.example.org/page1" || e[1].IndexDelta() != 1 {
+		t.Error("failed to rename the tag", mapEntries(e...))
+	}
+}
+
+func TestRenameValue(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("http://www.example.org", "foo", "bar", "baz")
+	stash.Set("https://www.example.org", "qux", "bar")
+	if _, err := stash.GetAll("foo", "bar", "baz", "qux"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stash.RenameValue("http://www.example.org", "https://www.example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := stash.GetAll("foo", "bar", "baz", "qux"); err != nil || len(v) != 1 || v[0] != "https://www.example.org" {
+		t.Error("failed to rename the value", v, err)
+	}
+
+	e, err := stash.GetValueEntries("https://www.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var positions []string
+	for _, ei := range e {
+		positions = append(positions, fmt.Sprintf("%s:%d", ei.Tag, ei.TagIndex))
+	}
+
+	sort.Strings(positions)
+	if fmt.Sprint(positions) != "[bar:1 baz:2 foo:0 qux:0]" {
+		t.Error("failed to keep the tag indexes", positions)
+	}
+
+	stash.storage = struct{ Storage }{&mockStorage{}}
+	if err := stash.RenameValue("https://www.example.org", "https://www.example.org"); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+type sweepSignalStorage struct {
+	*mockStorage
+	swept chan struct{}
+}
+
+func (s sweepSignalStorage) DeleteExpired(t time.Time) ([]string, int, error) {
+	tags, n, err := s.mockStorage.DeleteExpired(t)
+	if n > 0 {
+		select {
+		case s.swept <- struct{}{}:
+		default:
+		}
+	}
+
+	return tags, n, err
+}
+
+func TestSetWithTTL(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	stash, err := New(Options{Storage: &mockStorage{now: clock.Now}, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	if err := stash.SetWithTTL("https://www.example.org/page1", time.Hour, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	stash.Set("https://www.example.org/page2", "foo")
+	if v, err := stash.GetAll("foo", "bar"); err != nil || len(v) != 2 {
+		t.Error("failed to get the values before expiration", v, err)
+	}
+
+	clock.forward(2 * time.Hour)
+	if v, err := stash.GetAll("foo", "bar"); err != nil || len(v) != 1 || v[0] != "https://www.example.org/page2" {
+		t.Error("failed to hide the expired associations", v, err)
+	}
+}
+
+func TestExpiredSweep(t *testing.T) {
+	t.Run("sweeps", func(t *testing.T) {
+		s := sweepSignalStorage{mockStorage: &mockStorage{}, swept: make(chan struct{}, 1)}
+		s.Set(&Entry{Value: "https://www.example.org/page1", Tag: "foo", Expires: time.Now().Add(-time.Hour)})
+		s.Set(&Entry{Value: "https://www.example.org/page2", Tag: "foo"})
+
+		stash, err := New(Options{Storage: s, ExpiredSweepInterval: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-s.swept:
+		case <-time.After(time.Second):
+			t.Error("failed to sweep the expired associations")
+		}
+
+		stash.Close()
+		if len(s.entries) != 1 || s.entries[0].Value != "https://www.example.org/page2" {
+			t.Error("failed to delete the expired association", mapEntries(s.entries...))
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		if _, err := New(Options{
+			Storage:              struct{ Storage }{&mockStorage{}},
+			ExpiredSweepInterval: time.Millisecond,
+		}); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	stash, err := New(Options{Storage: NewMemoryStorage()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := fmt.Sprintf("https://www.example.org/page%d", i)
+			if err := stash.Set(value, "foo", "bar"); err != nil {
+				t.Error(err)
+			}
+
+			if _, err := stash.GetAll("foo"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	if v, err := stash.GetAll("foo", "bar"); err != nil || len(v) != 8 {
+		t.Error("failed to store the values", v, err)
+	}
+
+	if tags, err := stash.GetTags("https://www.example.org/page1"); err != nil || len(tags) != 2 {
+		t.Error("failed to get the tags", tags, err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	stash, err := New(Options{
+		Storage:      &mockStorage{},
+		CacheOptions: CacheOptions{CacheSize: 1 << 12},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "foo")
+
+	// misses foo and bar, and writes both
+	if _, err := stash.GetAll("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	// hits foo and bar
+	if _, err := stash.GetAll("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := stash.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Hits != 2 || s.Misses != 2 || s.EntriesWritten != 3 || s.WriteFailures != 0 {
+		t.Error("unexpected stats", s)
+	}
+
+	stash.cache = noCache{}
+	if _, err := stash.CacheStats(); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestCaseInsensitiveTags(t *testing.T) {
+	stash, err := New(Options{
+		Storage:             &mockStorageLookup{&mockStorage{}},
+		CacheOptions:        CacheOptions{CacheSize: 1 << 12},
+		CaseInsensitiveTags: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "Golang", "Web")
+	stash.Set("https://www.example.org/page2", "golang")
+
+	e, err := stash.Query([]string{"GOLANG", "golang", "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e) != 2 || e[0].Value != "https://www.example.org/page1" || e[0].MatchCount() != 2 {
+		t.Error("failed to match the tags regardless of the case", mapEntries(e...))
+	}
+
+	if tags, err := stash.GetTags("https://www.example.org/page1"); err != nil ||
+		fmt.Sprint(tags) != "[golang web]" {
+		t.Error("failed to store the tags in lower case", tags, err)
+	}
+
+	if err := stash.Remove("https://www.example.org/page1", "WEB"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := stash.GetAll("web"); err != nil || len(v) != 0 {
+		t.Error("failed to remove the tag regardless of the case", v, err)
+	}
+
+	if err := stash.Delete("GoLang"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := stash.GetAll("golang"); err != nil || len(v) != 0 {
+		t.Error("failed to delete the tag regardless of the case", v, err)
+	}
+}
+
+func TestGetByPrefix(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "web", "programming")
+	stash.Set("https://www.example.org/page2", "programming", "progressive", "web")
+	stash.Set("https://www.example.org/page3", "progress")
+	stash.Set("https://www.example.org/page4", "web")
+
+	v, err := stash.GetByPrefix("prog")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(v) != fmt.Sprint([]string{
+		"https://www.example.org/page2",
+		"https://www.example.org/page3",
+		"https://www.example.org/page1",
+	}) {
+		t.Error("failed to rank the values by the matching tags", v)
+	}
+
+	if _, err := stash.GetByPrefix(""); err != ErrNoTags {
+		t.Error("failed to fail with the right error", err)
+	}
+
+	stash.storage = struct{ Storage }{&mockStorage{}}
+	if _, err := stash.GetByPrefix("prog"); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page2", "foo")
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+
+	var b bytes.Buffer
+	if err := stash.Export(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	r := keyval.NewEntryReader(&b)
+	var records []string
+	for {
+		e, err := r.ReadEntry()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		records = append(records, fmt.Sprintf("%s:%s", strings.Join(e.Key, " "), e.Val))
+	}
+
+	if fmt.Sprint(records) != fmt.Sprint([]string{
+		"foo https://www.example.org/page1:0",
+		"bar https://www.example.org/page1:1",
+		"foo https://www.example.org/page2:0",
+	}) {
+		t.Error("invalid export", records)
+	}
+
+	stash.storage = struct{ Storage }{&mockStorage{}}
+	if err := stash.Export(&b); err != ErrNotSupported {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	t.Run("export and import", func(t *testing.T) {
+		source := newTestStash()
+		defer source.Close()
+
+		source.Set("https://www.example.org/page1", "foo", "bar")
+		source.Set("https://www.example.org/page2", "bar", "foo")
+
+		var b bytes.Buffer
+		if err := source.Export(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		stash, err := New(Options{Storage: NewMemoryStorage()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		if err := stash.Import(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		if v, err := stash.GetAll("foo", "bar"); err != nil ||
+			len(v) != 2 || v[0] != "https://www.example.org/page1" || v[1] != "https://www.example.org/page2" {
+			t.Error("failed to import the associations", v, err)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		stash, err := New(Options{Storage: NewMemoryStorage()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		var b bytes.Buffer
+		w := keyval.NewEntryWriter(&b)
+		w.WriteEntry(&keyval.Entry{Key: []string{"foo", "https://www.example.org/page1"}, Val: "0"})
+		w.WriteEntry(&keyval.Entry{Key: []string{"foo", "https://www.example.org/page2"}, Val: "first"})
+
+		err = stash.Import(&b)
+		if !errors.Is(err, ErrInvalidImport) || !strings.Contains(err.Error(), "record 2") {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if v, err := stash.GetAll("foo"); err != nil || len(v) != 0 {
+			t.Error("unexpected partial import", v, err)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage = struct{ Storage }{&mockStorage{}}
+		if err := stash.Import(strings.NewReader("")); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestGetAllMatching(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "billing", "urgent")
+	stash.Set("https://www.example.org/page2", "urgent", "billing", "backend")
+	stash.Set("https://www.example.org/page3", "urgent")
+
+	v, err := stash.GetAllMatching("urgent", "billing", "urgent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v) != 2 || v[0] != "https://www.example.org/page2" || v[1] != "https://www.example.org/page1" {
+		t.Error("failed to return the values matching all the tags", v)
+	}
+
+	if _, err := stash.GetAllMatching(); err != ErrNoTags {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestGetExcluding(t *testing.T) {
+	stash := newTestStash()
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "cat", "kitten")
+	stash.Set("https://www.example.org/page2", "cat", "lion")
+	stash.Set("https://www.example.org/page3", "kitten")
+	stash.Set("https://www.example.org/page4", "cat")
+
+	v, err := stash.GetExcluding([]string{"cat", "kitten"}, []string{"kitten", "lion"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v) != 1 || v[0] != "https://www.example.org/page4" {
+		t.Error("failed to drop the excluded values", v)
+	}
+
+	if _, err := stash.GetExcluding(nil, []string{"kitten"}); err != ErrNoTags {
+		t.Error("failed to fail with the right error", err)
+	}
+}
+
+func TestHas(t *testing.T) {
+	for _, s := range []struct {
+		name    string
+		storage Storage
+	}{{
+		name:    "tag lookup",
+		storage: &mockStorageLookup{&mockStorage{}},
+	}, {
+		name:    "default",
+		storage: nil,
+	}} {
+		t.Run(s.name, func(t *testing.T) {
+			stash := newTestStash()
+			defer stash.Close()
+
+			if s.storage != nil {
+				stash.storage.Close()
+				stash.storage = s.storage
+			}
+
+			stash.Set("https://www.example.org/page1", "foo", "bar")
+			stash.Set("https://www.example.org/page2", "foo")
+			if _, err := stash.GetAll("bar"); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, test := range []struct {
+				value, tag string
+				expect     bool
+			}{
+				{"https://www.example.org/page1", "foo", true},
+				{"https://www.example.org/page2", "bar", false},
+				{"https://www.example.org/page1", "bar", true},
+				{"https://www.example.org/page3", "foo", false},
+			} {
+				if has, err := stash.Has(test.value, test.tag); err != nil || has != test.expect {
+					t.Error("invalid result", test.value, test.tag, has, err)
+				}
+			}
+		})
+	}
+
+	t.Run("not supported", func(t *testing.T) {
+		stash := newTestStash()
+		defer stash.Close()
+
+		stash.storage = struct{ Storage }{&mockStorage{}}
+		if _, err := stash.Has("https://www.example.org", "foo"); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
+
+func TestRanker(t *testing.T) {
+	for _, test := range []struct {
+		title  string
+		ranker Ranker
+		expect []string
+	}{{
+		title:  "default",
+		expect: []string{"https://www.example.org/page1", "https://www.example.org/page2", "https://www.example.org/page3"},
+	}, {
+		title:  "match count first",
+		ranker: MatchCountFirst,
+		expect: []string{"https://www.example.org/page1", "https://www.example.org/page2", "https://www.example.org/page3"},
+	}, {
+		title:  "order first",
+		ranker: OrderFirst,
+		expect: []string{"https://www.example.org/page2", "https://www.example.org/page3", "https://www.example.org/page1"},
+	}, {
+		title:  "custom",
+		ranker: RankerFunc(func(left, right *Entry) bool { return left.Value > right.Value }),
+		expect: []string{"https://www.example.org/page3", "https://www.example.org/page2", "https://www.example.org/page1"},
+	}} {
+		t.Run(test.title, func(t *testing.T) {
+			stash, err := New(Options{
+				Storage:      &mockStorage{},
+				CacheOptions: CacheOptions{CacheSize: 1 << 12},
+				Ranker:       test.ranker,
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer stash.Close()
+
+			stash.Set("https://www.example.org/page1", "bar", "baz", "foo")
+			stash.Set("https://www.example.org/page2", "foo")
+			stash.Set("https://www.example.org/page3", "bar")
+
+			v, err := stash.GetAll("foo", "bar")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(v) != len(test.expect) {
+				t.Fatal("invalid result", v)
+			}
+
+			for i := range v {
+				if v[i] != test.expect[i] {
+					t.Error("invalid order", v)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestSetWeighted(t *testing.T) {
+	t.Run("not supported", func(t *testing.T) {
+		stash, err := New(Options{Storage: NewMemoryStorage()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		if err := stash.SetWeighted("https://www.example.org", []WeightedTag{{Tag: "foo", Weight: 2}}); err != ErrNotSupported {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("weighted ranking", func(t *testing.T) {
+		stash, err := New(Options{
+			Storage:      &mockStorage{},
+			CacheOptions: CacheOptions{CacheSize: 1 << 12},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer stash.Close()
+
+		stash.Set("https://www.example.org/page1", "common", "generic")
+		if err := stash.SetWeighted("https://www.example.org/page2", []WeightedTag{
+			{Tag: "rare", Weight: 3},
+			{Tag: "common", Weight: -1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// the first query reads the storage, the second one the cache
+		for i := 0; i < 2; i++ {
+			e, err := stash.Query([]string{"common", "generic", "rare"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(e) != 2 ||
+				e[0].Value != "https://www.example.org/page2" || e[0].MatchWeight() != 4 || e[0].MatchCount() != 2 ||
+				e[1].Value != "https://www.example.org/page1" || e[1].MatchWeight() != 2 {
+				t.Error("invalid ranking", i, e)
+			}
+		}
+
+		// Set() stores the default weight
+		stash.Set("https://www.example.org/page2", "rare", "common")
+		v, err := stash.GetAll("common", "generic", "rare")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(v) != 2 || v[0] != "https://www.example.org/page1" {
+			t.Error("invalid ranking", v)
+		}
+	})
+}
+
+type observation struct {
+	op      string
+	results int
+	err     error
+}
+
+type recordingObserver struct {
+	observations []observation
+	durations    []time.Duration
+}
+
+func (o *recordingObserver) observe(op string, d time.Duration, results int, err error) {
+	o.observations = append(o.observations, observation{op: op, results: results, err: err})
+	o.durations = append(o.durations, d)
+}
+
+func (o *recordingObserver) ObserveGet(d time.Duration, results int, err error) {
+	o.observe("get", d, results, err)
+}
+
+func (o *recordingObserver) ObserveSet(d time.Duration, err error)    { o.observe("set", d, 0, err) }
+func (o *recordingObserver) ObserveRemove(d time.Duration, err error) { o.observe("remove", d, 0, err) }
+func (o *recordingObserver) ObserveDelete(d time.Duration, err error) { o.observe("delete", d, 0, err) }
+
+func TestObserver(t *testing.T) {
+	o := &recordingObserver{}
+	stash, err := New(Options{
+		Storage:        &mockStorage{},
+		CacheOptions:   CacheOptions{CacheSize: 1 << 12},
+		Clock:          &tickingClock{now: time.Now(), tick: time.Millisecond},
+		MaxValueLength: 32,
+		Observer:       o,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stash.Close()
+
+	stash.Set("https://www.example.org/page1", "foo", "bar")
+	stash.Set("https://www.example.org/page2", "foo")
+	stash.Set("https://www.example.org/a-much-longer-page", "foo")
+	stash.GetAll("foo")
+	stash.Get()
+	stash.Remove("https://www.example.org/page1", "foo")
+	stash.Delete("bar")
+
+	expect := []observation{
+		{op: "set"},
+		{op: "set"},
+		{op: "set", err: ErrValueTooLong},
+		{op: "get", results: 2},
+		{op: "get", err: ErrNoTags},
+		{op: "remove"},
+		{op: "delete"},
+	}
+
+	if len(o.observations) != len(expect) {
+		t.Fatal("invalid observations", o.observations)
+	}
+
+	for i := range expect {
+		if o.observations[i] != expect[i] {
+			t.Error("invalid observation", i, o.observations[i])
+		}
+
+		if o.durations[i] <= 0 {
+			t.Error("invalid duration", i, o.durations[i])
+		}
+	}
+}
+
+func TestBoltStorage(t *testing.T) {
+	t.Run("empty tag or value", func(t *testing.T) {
+		s := NewTestBoltStorage()
+		defer s.Close()
+
+		if err := s.Set(&Entry{Value: "https://www.example.org/page1"}); err != ErrEmptyKey {
+			t.Error("failed to fail with the right error", err)
+		}
+
+		if err := s.Set(&Entry{Tag: "foo"}); err != ErrEmptyKey {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+
+	t.Run("damaged reverse lookup", func(t *testing.T) {
+		s := NewTestBoltStorage()
+		defer s.Close()
+
+		if err := s.Set(&Entry{Value: "https://www.example.org/page1", Tag: "foo"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.(*boltStorage).db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(boltTags).DeleteBucket([]byte("foo"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.(ValueEntryLookup).GetValueEntries("https://www.example.org/page1"); err != ErrDamagedStorageData {
+			t.Error("failed to fail with the right error", err)
+		}
+	})
+}
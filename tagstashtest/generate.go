@@ -0,0 +1,49 @@
+package tagstashtest
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/aryszka/tagstash"
+)
+
+// Generate returns a deterministic set of associations, for n values, each with tagsPerValue distinct tags
+// taken from a vocabulary of vocab tags. The tags are picked with a Zipf distribution, so that a few tags are
+// shared by many values, while most of them are rare. The associations of a value are returned together, in
+// the order of their tag index. The same arguments always produce the same associations.
+func Generate(n, tagsPerValue, vocab int) []tagstash.Entry {
+	if vocab < 1 || tagsPerValue < 1 {
+		return nil
+	}
+
+	if tagsPerValue > vocab {
+		tagsPerValue = vocab
+	}
+
+	r := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(r, 1.1, 1, uint64(vocab-1))
+	entries := make([]tagstash.Entry, 0, n*tagsPerValue)
+	for i := 0; i < n; i++ {
+		value := fmt.Sprintf("https://www.example.org/page%d", i)
+		picked := make(map[uint64]bool)
+		for len(picked) < tagsPerValue {
+			t := zipf.Uint64()
+			if picked[t] {
+				// fall back to a uniform pick, when the skewed distribution keeps returning the same tags
+				t = uint64(r.Intn(vocab))
+				if picked[t] {
+					continue
+				}
+			}
+
+			picked[t] = true
+			entries = append(entries, tagstash.Entry{
+				Value:    value,
+				Tag:      fmt.Sprintf("tag%d", t),
+				TagIndex: len(picked) - 1,
+			})
+		}
+	}
+
+	return entries
+}
@@ -0,0 +1,938 @@
+/*
+Package tagstashtest provides helpers to verify custom implementations of the tagstash interfaces.
+*/
+package tagstashtest
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aryszka/tagstash"
+)
+
+type entryKey struct {
+	value, tag string
+	tagIndex   int
+}
+
+func keys(e []*tagstash.Entry) []entryKey {
+	k := make([]entryKey, len(e))
+	for i, ei := range e {
+		k[i] = entryKey{value: ei.Value, tag: ei.Tag, tagIndex: ei.TagIndex}
+	}
+
+	sort.Slice(k, func(i, j int) bool {
+		if k[i].tag == k[j].tag {
+			return k[i].value < k[j].value
+		}
+
+		return k[i].tag < k[j].tag
+	})
+
+	return k
+}
+
+func entriesEqual(left, right []*tagstash.Entry) bool {
+	lk, rk := keys(left), keys(right)
+	if len(lk) != len(rk) {
+		return false
+	}
+
+	for i := range lk {
+		if lk[i] != rk[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func set(t *testing.T, s tagstash.Storage, e ...*tagstash.Entry) bool {
+	for _, ei := range e {
+		if err := s.Set(ei); err != nil {
+			t.Error("failed to set entry", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+func checkGet(t *testing.T, s tagstash.Storage, tags []string, expect ...*tagstash.Entry) {
+	e, err := s.Get(tags)
+	if err != nil {
+		t.Error("failed to get entries", err)
+		return
+	}
+
+	if !entriesEqual(e, expect) {
+		t.Error("invalid entries", keys(e), keys(expect))
+	}
+}
+
+func setTestEntries(t *testing.T, s tagstash.Storage) bool {
+	return set(
+		t,
+		s,
+		&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo"},
+		&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "bar", TagIndex: 1},
+		&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "baz", TagIndex: 2},
+		&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo"},
+		&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "bar", TagIndex: 1},
+		&tagstash.Entry{Value: "https://www.example.org/page3", Tag: "foo"},
+	)
+}
+
+// RunStorageTests verifies that a storage implementation satisfies the contract that tagstash relies on.
+// The newStorage function needs to return a new, empty storage on every call. When the storage implements
+// any of the optional interfaces, like TagLookup, those are verified, too.
+func RunStorageTests(t *testing.T, newStorage func() tagstash.Storage) {
+	run := func(name string, test func(*testing.T, tagstash.Storage)) {
+		t.Run(name, func(t *testing.T) {
+			s := newStorage()
+			defer s.Close()
+			test(t, s)
+		})
+	}
+
+	run("empty", func(t *testing.T, s tagstash.Storage) {
+		checkGet(t, s, []string{"foo"})
+	})
+
+	run("no tags", func(t *testing.T, s tagstash.Storage) {
+		if !set(t, s, &tagstash.Entry{Value: "https://www.example.org", Tag: "foo"}) {
+			return
+		}
+
+		checkGet(t, s, nil)
+	})
+
+	// storages may reject the empty tags and values with ErrEmptyKey, otherwise they need to store them
+	run("empty tag or value", func(t *testing.T, s tagstash.Storage) {
+		for _, e := range []*tagstash.Entry{
+			{Value: "", Tag: "foo"},
+			{Value: "https://www.example.org", Tag: ""},
+		} {
+			err := s.Set(e)
+			if err == tagstash.ErrEmptyKey {
+				continue
+			}
+
+			if err != nil {
+				t.Error("failed to set entry", err)
+				return
+			}
+
+			checkGet(t, s, []string{e.Tag}, e)
+		}
+	})
+
+	run("get after set", func(t *testing.T, s tagstash.Storage) {
+		e := []*tagstash.Entry{
+			{Value: "https://www.example.org/page1", Tag: "foo", TagIndex: 0},
+			{Value: "https://www.example.org/page1", Tag: "bar", TagIndex: 1},
+			{Value: "https://www.example.org/page2", Tag: "foo", TagIndex: 2},
+			{Value: "https://www.example.org/page3", Tag: "baz", TagIndex: 0},
+		}
+
+		if !set(t, s, e...) {
+			return
+		}
+
+		checkGet(t, s, []string{"foo"}, e[0], e[2])
+		checkGet(t, s, []string{"foo", "bar"}, e[:3]...)
+		checkGet(t, s, []string{"qux"})
+	})
+
+	run("unique value-tag", func(t *testing.T, s tagstash.Storage) {
+		if !set(
+			t,
+			s,
+			&tagstash.Entry{Value: "https://www.example.org", Tag: "foo", TagIndex: 0},
+			&tagstash.Entry{Value: "https://www.example.org", Tag: "foo", TagIndex: 2},
+		) {
+			return
+		}
+
+		checkGet(t, s, []string{"foo"}, &tagstash.Entry{Value: "https://www.example.org", Tag: "foo", TagIndex: 2})
+	})
+
+	run("remove", func(t *testing.T, s tagstash.Storage) {
+		e := []*tagstash.Entry{
+			{Value: "https://www.example.org/page1", Tag: "foo"},
+			{Value: "https://www.example.org/page2", Tag: "foo"},
+			{Value: "https://www.example.org/page1", Tag: "bar"},
+		}
+
+		if !set(t, s, e...) {
+			return
+		}
+
+		if err := s.Remove(&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo"}); err != nil {
+			t.Error("failed to remove entry", err)
+			return
+		}
+
+		checkGet(t, s, []string{"foo", "bar"}, e[1:]...)
+	})
+
+	run("remove missing", func(t *testing.T, s tagstash.Storage) {
+		e := &tagstash.Entry{Value: "https://www.example.org", Tag: "foo"}
+		if !set(t, s, e) {
+			return
+		}
+
+		if err := s.Remove(&tagstash.Entry{Value: "https://www.example.org", Tag: "bar"}); err != nil {
+			t.Error("failed to remove missing entry", err)
+			return
+		}
+
+		checkGet(t, s, []string{"foo", "bar"}, e)
+	})
+
+	run("delete", func(t *testing.T, s tagstash.Storage) {
+		e := []*tagstash.Entry{
+			{Value: "https://www.example.org/page1", Tag: "foo"},
+			{Value: "https://www.example.org/page2", Tag: "foo"},
+			{Value: "https://www.example.org/page1", Tag: "bar"},
+		}
+
+		if !set(t, s, e...) {
+			return
+		}
+
+		if err := s.Delete("foo"); err != nil {
+			t.Error("failed to delete tag", err)
+			return
+		}
+
+		checkGet(t, s, []string{"foo", "bar"}, e[2])
+	})
+
+	run("tag lookup", func(t *testing.T, s tagstash.Storage) {
+		tl, ok := s.(tagstash.TagLookup)
+		if !ok {
+			t.Skip("tag lookup not supported")
+		}
+
+		if !set(
+			t,
+			s,
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "bar", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "baz"},
+		) {
+			return
+		}
+
+		tags, err := tl.GetTags("https://www.example.org/page1")
+		if err != nil {
+			t.Error("failed to get tags", err)
+			return
+		}
+
+		sort.Strings(tags)
+		if len(tags) != 2 || tags[0] != "bar" || tags[1] != "foo" {
+			t.Error("invalid tags", tags)
+		}
+	})
+
+	run("value entry lookup", func(t *testing.T, s tagstash.Storage) {
+		vl, ok := s.(tagstash.ValueEntryLookup)
+		if !ok {
+			t.Skip("value entry lookup not supported")
+		}
+
+		if !set(
+			t,
+			s,
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo", TagIndex: 2},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "qux", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "baz", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "bar"},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo"},
+		) {
+			return
+		}
+
+		e, err := vl.GetValueEntries("https://www.example.org/page1")
+		if err != nil {
+			t.Error("failed to get entries", err)
+			return
+		}
+
+		expect := []entryKey{
+			{value: "https://www.example.org/page1", tag: "bar", tagIndex: 0},
+			{value: "https://www.example.org/page1", tag: "baz", tagIndex: 1},
+			{value: "https://www.example.org/page1", tag: "qux", tagIndex: 1},
+			{value: "https://www.example.org/page1", tag: "foo", tagIndex: 2},
+		}
+
+		if len(e) != len(expect) {
+			t.Error("invalid entries", len(e))
+			return
+		}
+
+		for i, ei := range e {
+			if (entryKey{value: ei.Value, tag: ei.Tag, tagIndex: ei.TagIndex}) != expect[i] {
+				t.Error("invalid entry", i, ei.Value, ei.Tag, ei.TagIndex)
+			}
+		}
+	})
+
+	run("value deleter", func(t *testing.T, s tagstash.Storage) {
+		vd, ok := s.(tagstash.ValueDeleter)
+		if !ok {
+			t.Skip("deleting values not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		tags, n, err := vd.DeleteValues([]string{"https://www.example.org/page1", "https://www.example.org/page3"})
+		if err != nil {
+			t.Error("failed to delete values", err)
+			return
+		}
+
+		sort.Strings(tags)
+		if n != 4 || len(tags) != 3 || tags[0] != "bar" || tags[1] != "baz" || tags[2] != "foo" {
+			t.Error("invalid deleted associations", tags, n)
+		}
+
+		checkGet(
+			t,
+			s,
+			[]string{"foo", "bar", "baz"},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "bar", TagIndex: 1},
+		)
+	})
+
+	run("tag replacer", func(t *testing.T, s tagstash.Storage) {
+		tr, ok := s.(tagstash.TagReplacer)
+		if !ok {
+			t.Skip("replacing tags not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		if err := tr.ReplaceTag("foo", []*tagstash.Entry{
+			{Value: "https://www.example.org/page3", Tag: "foo"},
+			{Value: "https://www.example.org/page4", Tag: "foo", TagIndex: 1},
+		}); err != nil {
+			t.Error("failed to replace tag", err)
+			return
+		}
+
+		checkGet(
+			t,
+			s,
+			[]string{"foo", "baz"},
+			&tagstash.Entry{Value: "https://www.example.org/page3", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page4", Tag: "foo", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "baz", TagIndex: 2},
+		)
+	})
+
+	run("entry streamer", func(t *testing.T, s tagstash.Storage) {
+		es, ok := s.(tagstash.EntryStreamer)
+		if !ok {
+			t.Skip("streaming entries not supported")
+		}
+
+		if !set(
+			t,
+			s,
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "qux", TagIndex: 2},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "baz", TagIndex: 2},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "bar"},
+		) {
+			return
+		}
+
+		var k []entryKey
+		if err := es.StreamAll(func(e *tagstash.Entry) error {
+			k = append(k, entryKey{value: e.Value, tag: e.Tag, tagIndex: e.TagIndex})
+			return nil
+		}); err != nil {
+			t.Error("failed to stream entries", err)
+			return
+		}
+
+		expect := []entryKey{
+			{value: "https://www.example.org/page1", tag: "bar", tagIndex: 0},
+			{value: "https://www.example.org/page1", tag: "foo", tagIndex: 1},
+			{value: "https://www.example.org/page1", tag: "baz", tagIndex: 2},
+			{value: "https://www.example.org/page1", tag: "qux", tagIndex: 2},
+			{value: "https://www.example.org/page2", tag: "foo", tagIndex: 0},
+		}
+
+		if len(k) != len(expect) {
+			t.Error("invalid entries", k)
+			return
+		}
+
+		for i := range k {
+			if k[i] != expect[i] {
+				t.Error("invalid entry", i, k[i], expect[i])
+			}
+		}
+
+		errStop := errors.New("stop")
+		var n int
+		if err := es.StreamAll(func(*tagstash.Entry) error {
+			n++
+			return errStop
+		}); err != errStop || n != 1 {
+			t.Error("failed to stop streaming", n, err)
+		}
+	})
+
+	run("age cleaner", func(t *testing.T, s tagstash.Storage) {
+		ac, ok := s.(tagstash.AgeCleaner)
+		if !ok {
+			t.Skip("deleting by age not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		if tags, n, err := ac.DeleteOlderThan(time.Now().Add(-time.Hour)); err != nil || len(tags) != 0 || n != 0 {
+			t.Error("failed to keep the newer associations", tags, n, err)
+			return
+		}
+
+		tags, n, err := ac.DeleteOlderThan(time.Now().Add(time.Hour))
+		if err != nil {
+			t.Error("failed to delete the older associations", err)
+			return
+		}
+
+		sort.Strings(tags)
+		if n != 6 || len(tags) != 3 || tags[0] != "bar" || tags[1] != "baz" || tags[2] != "foo" {
+			t.Error("invalid result of deleting the older associations", tags, n)
+		}
+
+		checkGet(t, s, []string{"foo", "bar", "baz"})
+	})
+
+	run("expiring storage", func(t *testing.T, s tagstash.Storage) {
+		es, ok := s.(tagstash.ExpiringStorage)
+		if !ok {
+			t.Skip("expiration not supported")
+		}
+
+		now := time.Now()
+		if !set(
+			t,
+			s,
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo", Expires: now.Add(-time.Hour)},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo", Expires: now.Add(time.Hour)},
+			&tagstash.Entry{Value: "https://www.example.org/page3", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "bar"},
+		) {
+			return
+		}
+
+		checkGet(
+			t,
+			s,
+			[]string{"foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page3", Tag: "foo"},
+		)
+
+		tags, n, err := es.DeleteExpired(now)
+		if err != nil {
+			t.Error("failed to delete the expired associations", err)
+			return
+		}
+
+		if n != 1 || len(tags) != 1 || tags[0] != "foo" {
+			t.Error("invalid result of deleting the expired associations", tags, n)
+			return
+		}
+
+		checkGet(
+			t,
+			s,
+			[]string{"foo", "bar"},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page3", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "bar"},
+		)
+	})
+
+	run("weight storage", func(t *testing.T, s tagstash.Storage) {
+		if _, ok := s.(tagstash.WeightStorage); !ok {
+			t.Skip("weights not supported")
+		}
+
+		checkWeights := func(expect map[string]float64) {
+			e, err := s.Get([]string{"foo"})
+			if err != nil {
+				t.Error("failed to get entries", err)
+				return
+			}
+
+			if len(e) != len(expect) {
+				t.Error("invalid entries", keys(e))
+				return
+			}
+
+			for _, ei := range e {
+				if w, ok := expect[ei.Value]; !ok || ei.Weight != w {
+					t.Error("invalid weight", ei.Value, ei.Weight, w)
+				}
+			}
+		}
+
+		if !set(
+			t,
+			s,
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo", Weight: 2.5},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo"},
+		) {
+			return
+		}
+
+		checkWeights(map[string]float64{
+			"https://www.example.org/page1": 2.5,
+			"https://www.example.org/page2": 0,
+		})
+
+		if !set(t, s, &tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo", TagIndex: 1}) {
+			return
+		}
+
+		checkWeights(map[string]float64{
+			"https://www.example.org/page1": 0,
+			"https://www.example.org/page2": 0,
+		})
+	})
+
+	run("batch writer", func(t *testing.T, s tagstash.Storage) {
+		bw, ok := s.(tagstash.BatchWriter)
+		if !ok {
+			t.Skip("batch writing not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		if err := bw.WriteBatch(
+			[]*tagstash.Entry{
+				{Value: "https://www.example.org/page1", Tag: "qux", TagIndex: 3},
+				{Value: "https://www.example.org/page2", Tag: "foo", TagIndex: 1},
+			},
+			[]*tagstash.Entry{
+				{Value: "https://www.example.org/page1", Tag: "bar"},
+				{Value: "https://www.example.org/page3", Tag: "foo"},
+			},
+		); err != nil {
+			t.Error("failed to write batch", err)
+			return
+		}
+
+		checkGet(
+			t,
+			s,
+			[]string{"foo", "bar", "qux"},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo"},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "bar", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "qux", TagIndex: 3},
+		)
+	})
+
+	run("index limited lookup", func(t *testing.T, s tagstash.Storage) {
+		il, ok := s.(tagstash.IndexLimitedLookup)
+		if !ok {
+			t.Skip("index limited lookup not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		e, err := il.GetMaxIndex([]string{"foo", "bar", "baz"}, map[string]int{"bar": 0, "baz": 2, "qux": 0})
+		if err != nil {
+			t.Error("failed to get entries", err)
+			return
+		}
+
+		expect := []*tagstash.Entry{
+			{Value: "https://www.example.org/page1", Tag: "foo"},
+			{Value: "https://www.example.org/page1", Tag: "baz", TagIndex: 2},
+			{Value: "https://www.example.org/page2", Tag: "foo"},
+			{Value: "https://www.example.org/page3", Tag: "foo"},
+		}
+
+		if !entriesEqual(e, expect) {
+			t.Error("invalid entries", keys(e), keys(expect))
+		}
+	})
+
+	run("score storage", func(t *testing.T, s tagstash.Storage) {
+		ss, ok := s.(tagstash.ScoreStorage)
+		if !ok {
+			t.Skip("scores not supported")
+		}
+
+		for _, inc := range []struct {
+			value string
+			by    int
+		}{
+			{"https://www.example.org/page1", 3},
+			{"https://www.example.org/page2", 1},
+			{"https://www.example.org/page1", -1},
+		} {
+			if err := ss.IncrementScore(inc.value, inc.by); err != nil {
+				t.Error("failed to increment score", err)
+				return
+			}
+		}
+
+		scores, err := ss.GetScores([]string{
+			"https://www.example.org/page1",
+			"https://www.example.org/page2",
+			"https://www.example.org/page3",
+		})
+
+		if err != nil {
+			t.Error("failed to get scores", err)
+			return
+		}
+
+		if scores["https://www.example.org/page1"] != 2 ||
+			scores["https://www.example.org/page2"] != 1 ||
+			scores["https://www.example.org/page3"] != 0 {
+			t.Error("invalid scores", scores)
+		}
+	})
+
+	run("tag frequency", func(t *testing.T, s tagstash.Storage) {
+		tf, ok := s.(tagstash.TagFrequencyLookup)
+		if !ok {
+			t.Skip("tag frequency not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		c, err := tf.TagFrequency(2)
+		if err != nil {
+			t.Error("failed to get the tag frequency", err)
+			return
+		}
+
+		if len(c) != 2 || c[0].Tag != "foo" || c[0].Count != 3 || c[1].Tag != "bar" || c[1].Count != 2 {
+			t.Error("invalid tag frequency", c)
+		}
+	})
+
+	run("missing tag", func(t *testing.T, s tagstash.Storage) {
+		ml, ok := s.(tagstash.MissingTagLookup)
+		if !ok {
+			t.Skip("missing tag lookup not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		v, err := ml.ValuesMissingTag("bar")
+		if err != nil {
+			t.Error("failed to get the values missing the tag", err)
+			return
+		}
+
+		if len(v) != 1 || v[0] != "https://www.example.org/page3" {
+			t.Error("invalid values missing the tag", v)
+		}
+	})
+
+	run("tag count", func(t *testing.T, s tagstash.Storage) {
+		tc, ok := s.(tagstash.TagCountLookup)
+		if !ok {
+			t.Skip("tag count not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		c, err := tc.TagCountForValues([]string{
+			"https://www.example.org/page1",
+			"https://www.example.org/page3",
+			"https://www.example.org/page4",
+		})
+
+		if err != nil {
+			t.Error("failed to count the tags", err)
+			return
+		}
+
+		if c["https://www.example.org/page1"] != 3 ||
+			c["https://www.example.org/page3"] != 1 ||
+			c["https://www.example.org/page4"] != 0 {
+			t.Error("invalid tag count", c)
+		}
+	})
+
+	run("ranked lookup", func(t *testing.T, s tagstash.Storage) {
+		rl, ok := s.(tagstash.RankedLookup)
+		if !ok {
+			t.Skip("ranked lookup not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		v, err := rl.GetRanked([]string{"baz", "foo"}, 0)
+		if err != nil {
+			t.Error("failed to rank the values", err)
+			return
+		}
+
+		if len(v) != 3 ||
+			v[0] != (tagstash.RankedValue{Value: "https://www.example.org/page1", MatchCount: 2, IndexDelta: 3}) ||
+			v[1].MatchCount != 1 || v[1].IndexDelta != 1 ||
+			v[2].MatchCount != 1 || v[2].IndexDelta != 1 {
+			t.Error("invalid ranking", v)
+			return
+		}
+
+		v, err = rl.GetRanked([]string{"foo", "bar"}, 1)
+		if err != nil {
+			t.Error("failed to rank the values", err)
+			return
+		}
+
+		if len(v) != 1 || v[0].MatchCount != 2 || v[0].IndexDelta != 0 {
+			t.Error("failed to apply the limit", v)
+		}
+	})
+
+	run("cooccurrence", func(t *testing.T, s tagstash.Storage) {
+		cl, ok := s.(tagstash.CooccurrenceLookup)
+		if !ok {
+			t.Skip("cooccurrence not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		c, err := cl.TagCooccurrence(1)
+		if err != nil {
+			t.Error("failed to count the cooccurrences", err)
+			return
+		}
+
+		if len(c) != 3 ||
+			c[0] != (tagstash.TagPairCount{Left: "bar", Right: "foo", Count: 2}) ||
+			c[1] != (tagstash.TagPairCount{Left: "bar", Right: "baz", Count: 1}) ||
+			c[2] != (tagstash.TagPairCount{Left: "baz", Right: "foo", Count: 1}) {
+			t.Error("invalid cooccurrence", c)
+			return
+		}
+
+		c, err = cl.TagCooccurrence(2)
+		if err != nil {
+			t.Error("failed to count the cooccurrences", err)
+			return
+		}
+
+		if len(c) != 1 || c[0] != (tagstash.TagPairCount{Left: "bar", Right: "foo", Count: 2}) {
+			t.Error("failed to apply the min count", c)
+		}
+	})
+
+	run("pair lookup", func(t *testing.T, s tagstash.Storage) {
+		pl, ok := s.(tagstash.PairLookup)
+		if !ok {
+			t.Skip("pair lookup not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		pairs := []tagstash.Entry{
+			{Value: "https://www.example.org/page1", Tag: "baz"},
+			{Value: "https://www.example.org/page2", Tag: "bar", TagIndex: 42},
+			{Value: "https://www.example.org/page3", Tag: "bar"},
+			{Value: "https://www.example.org/page4", Tag: "foo"},
+		}
+
+		h, err := pl.HasMany(pairs)
+		if err != nil {
+			t.Error("failed to check the pairs", err)
+			return
+		}
+
+		if len(h) != 4 || !h[pairs[0]] || !h[pairs[1]] || h[pairs[2]] || h[pairs[3]] {
+			t.Error("invalid existence", h)
+		}
+	})
+
+	run("tag merger", func(t *testing.T, s tagstash.Storage) {
+		tm, ok := s.(tagstash.TagMerger)
+		if !ok {
+			t.Skip("tag merger not supported")
+		}
+
+		if !set(
+			t,
+			s,
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "foo", TagIndex: 2},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "foo", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "bar", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page3", Tag: "bar"},
+		) {
+			return
+		}
+
+		if err := tm.MergeTags("foo", "bar", tagstash.KeepMinIndex); err != nil {
+			t.Error("failed to merge the tags", err)
+			return
+		}
+
+		checkGet(t, s, []string{"foo"})
+		checkGet(
+			t,
+			s,
+			[]string{"bar"},
+			&tagstash.Entry{Value: "https://www.example.org/page1", Tag: "bar", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page2", Tag: "bar", TagIndex: 1},
+			&tagstash.Entry{Value: "https://www.example.org/page3", Tag: "bar"},
+		)
+	})
+
+	run("tag pager", func(t *testing.T, s tagstash.Storage) {
+		tp, ok := s.(tagstash.TagPager)
+		if !ok {
+			t.Skip("tag pager not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		tags, err := tp.ListTagsPage("", 2)
+		if err != nil {
+			t.Error("failed to list the tags", err)
+			return
+		}
+
+		if len(tags) != 2 || tags[0] != "bar" || tags[1] != "baz" {
+			t.Error("invalid page", tags)
+			return
+		}
+
+		tags, err = tp.ListTagsPage("baz", 2)
+		if err != nil {
+			t.Error("failed to list the tags", err)
+			return
+		}
+
+		if len(tags) != 1 || tags[0] != "foo" {
+			t.Error("invalid page", tags)
+		}
+	})
+
+	run("tag prefix lookup", func(t *testing.T, s tagstash.Storage) {
+		pl, ok := s.(tagstash.TagPrefixLookup)
+		if !ok {
+			t.Skip("tag prefix lookup not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		e, err := pl.GetByTagPrefix("ba")
+		if err != nil {
+			t.Error("failed to get the entries by prefix", err)
+			return
+		}
+
+		if !entriesEqual(e, []*tagstash.Entry{
+			{Value: "https://www.example.org/page1", Tag: "bar", TagIndex: 1},
+			{Value: "https://www.example.org/page1", Tag: "baz", TagIndex: 2},
+			{Value: "https://www.example.org/page2", Tag: "bar", TagIndex: 1},
+		}) {
+			t.Error("invalid entries", e)
+			return
+		}
+
+		for _, prefix := range []string{"b_", "b%", "Ba"} {
+			e, err := pl.GetByTagPrefix(prefix)
+			if err != nil {
+				t.Error("failed to get the entries by prefix", err)
+				return
+			}
+
+			if len(e) != 0 {
+				t.Error("unexpected entries", prefix, e)
+			}
+		}
+	})
+
+	run("tag counter", func(t *testing.T, s tagstash.Storage) {
+		tc, ok := s.(tagstash.TagCounter)
+		if !ok {
+			t.Skip("tag counter not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		for tag, expected := range map[string]int{"foo": 3, "bar": 2, "qux": 0} {
+			count, err := tc.CountTag(tag)
+			if err != nil {
+				t.Error("failed to count the tag", err)
+				return
+			}
+
+			if count != expected {
+				t.Error("invalid count", tag, count, expected)
+			}
+		}
+	})
+
+	run("tag enumerator", func(t *testing.T, s tagstash.Storage) {
+		te, ok := s.(tagstash.TagEnumerator)
+		if !ok {
+			t.Skip("tag enumerator not supported")
+		}
+
+		if !setTestEntries(t, s) {
+			return
+		}
+
+		tags, err := te.ListTags()
+		if err != nil {
+			t.Error("failed to list the tags", err)
+			return
+		}
+
+		if len(tags) != 3 || tags[0] != "bar" || tags[1] != "baz" || tags[2] != "foo" {
+			t.Error("invalid tags", tags)
+		}
+	})
+}